@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"wb/internal/dependency"
 )
@@ -17,27 +22,83 @@ func main() {
 	// Устанавливаем KafkaService в FakeDataService
 	app.FakeData.SetKafkaService(app.Kafka)
 
-	// Подключаемся к Kafka и запускаем consumer
-	if err := app.Kafka.Connect(); err != nil {
-		log.Printf("Warning: Failed to connect to Kafka: %v", err)
-	} else {
-		if err := app.Kafka.StartConsuming(); err != nil {
-			log.Printf("Warning: Failed to start Kafka consumer: %v", err)
-		} else {
-			log.Println("Kafka consumer started successfully")
-		}
+	// Тестовые данные загружаем один раз, после первого успешного подключения к Kafka
+	var loadTestData sync.Once
 
-		// Загружаем тестовые данные при старте
-		if err := app.FakeData.LoadTestDataFromFile(); err != nil {
-			log.Printf("Warning: Failed to load test data: %v", err)
-		}
+	app.Kafka.OnConnected(func() {
+		loadTestData.Do(func() {
+			if err := app.FakeData.LoadTestDataFromFile(); err != nil {
+				log.Printf("Warning: Failed to load test data: %v", err)
+			}
+		})
+	})
+
+	// Конвейеры регистрируются до подключения, чтобы первая подписка включила их топики
+	if err := app.Pipelines.Load(); err != nil {
+		log.Printf("Warning: Failed to load pipelines: %v", err)
 	}
 
+	// Правила маршрутизации применяются к заказам, сохраненным после загрузки
+	if err := app.Routing.Load(); err != nil {
+		log.Printf("Warning: Failed to load routing rules: %v", err)
+	}
+
+	// Обработчики топиков частей заказов тоже регистрируются до подключения
+	app.Assembler.Start()
+
+	// Супервизор подключается к Kafka в фоне и переподключается при потере соединения
+	if err := app.Kafka.Start(); err != nil {
+		log.Printf("Warning: Failed to start Kafka consumer: %v", err)
+	} else {
+		log.Println("Kafka consumer started successfully")
+	}
+
+	// События о заказах публикуются из outbox, когда есть подключение к Kafka
+	app.Outbox.Start()
+
 	// Start server
 	addr := fmt.Sprintf("%s:%s", app.Config.App.Host, app.Config.App.Port)
 	log.Printf("Starting server on %s", addr)
 
-	if err := app.FiberApp.Listen(addr); err != nil {
-		log.Fatalf("Error starting server: %v", err)
+	serverErr := make(chan error, 1)
+
+	go func() {
+		serverErr <- app.FiberApp.Listen(addr)
+	}()
+
+	// Ждем сигнала остановки или падения HTTP-сервера
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Ненулевой код выхода сообщает супервизору или оркестратору, что остановка была нештатной
+	exitCode := 0
+
+	select {
+	case <-signals.Done():
+		log.Println("Получен сигнал остановки, завершаем работу")
+	case err := <-serverErr:
+		if err != nil {
+			log.Printf("Error starting server: %v", err)
+
+			exitCode = 1
+		}
 	}
+
+	// Повторный сигнал во время остановки завершает процесс сразу
+	stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.App.GetShutdownTimeout())
+	err = app.Shutdown(ctx)
+
+	cancel()
+
+	if err != nil {
+		log.Printf("Ошибка при остановке приложения: %v", err)
+
+		exitCode = 1
+	} else {
+		log.Println("Приложение остановлено")
+	}
+
+	os.Exit(exitCode)
 }
@@ -1,6 +1,19 @@
 package config
 
+import "time"
+
 type App struct {
 	Host string `envconfig:"APP_HOST" default:"localhost"`
 	Port string `envconfig:"APP_PORT" default:"8080"`
+
+	// Общее время на остановку: HTTP-запросы, consumer и producer Kafka, пул БД
+	ShutdownTimeout time.Duration `envconfig:"APP_SHUTDOWN_TIMEOUT" default:"30s"`
+}
+
+func (a *App) GetShutdownTimeout() time.Duration {
+	if a.ShutdownTimeout <= 0 {
+		return 30 * time.Second
+	}
+
+	return a.ShutdownTimeout
 }
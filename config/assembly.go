@@ -0,0 +1,115 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// Действия с незавершенной сборкой заказа по истечении ASSEMBLY_TIMEOUT
+const (
+	AssemblyTimeoutAlert      = "alert"
+	AssemblyTimeoutDeadLetter = "dead_letter"
+)
+
+// Assembly настройки сборки заказов из частей, которые публикуются в отдельные топики
+type Assembly struct {
+	Enabled bool `envconfig:"ASSEMBLY_ENABLED" default:"false"`
+
+	// Топики частей: заказ без оплаты и доставки, оплата и доставка
+	OrderTopic    string `envconfig:"ASSEMBLY_ORDER_TOPIC" default:"orders.parts"`
+	PaymentTopic  string `envconfig:"ASSEMBLY_PAYMENT_TOPIC" default:"orders.payments"`
+	DeliveryTopic string `envconfig:"ASSEMBLY_DELIVERY_TOPIC" default:"orders.deliveries"`
+
+	// Сколько ждать недостающие части с момента получения первой и как часто это проверять
+	Timeout        time.Duration `envconfig:"ASSEMBLY_TIMEOUT" default:"10m"`
+	SweepInterval  time.Duration `envconfig:"ASSEMBLY_SWEEP_INTERVAL" default:"30s"`
+	SweepBatchSize int           `envconfig:"ASSEMBLY_SWEEP_BATCH_SIZE" default:"100"`
+
+	// alert — сообщение о незавершенном заказе в AlertTopic, dead_letter — части в DLQ
+	TimeoutAction string `envconfig:"ASSEMBLY_TIMEOUT_ACTION" default:"alert"`
+	AlertTopic    string `envconfig:"ASSEMBLY_ALERT_TOPIC" default:"orders.incomplete"`
+
+	// Сколько хранить отметку о завершенной сборке: в течение этого времени
+	// опоздавшие и повторно доставленные части отбрасываются
+	CompletedRetention time.Duration `envconfig:"ASSEMBLY_COMPLETED_RETENTION" default:"24h"`
+}
+
+func (a *Assembly) GetTimeout() time.Duration {
+	if a.Timeout <= 0 {
+		return 10 * time.Minute
+	}
+
+	return a.Timeout
+}
+
+func (a *Assembly) GetSweepInterval() time.Duration {
+	if a.SweepInterval <= 0 {
+		return 30 * time.Second
+	}
+
+	return a.SweepInterval
+}
+
+func (a *Assembly) GetSweepBatchSize() int {
+	if a.SweepBatchSize < 1 {
+		return 100
+	}
+
+	return a.SweepBatchSize
+}
+
+func (a *Assembly) GetTimeoutAction() string {
+	if a.TimeoutAction == "" {
+		return AssemblyTimeoutAlert
+	}
+
+	return strings.ToLower(a.TimeoutAction)
+}
+
+func (a *Assembly) GetAlertTopic() string {
+	if a.AlertTopic == "" {
+		return "orders.incomplete"
+	}
+
+	return a.AlertTopic
+}
+
+func (a *Assembly) GetCompletedRetention() time.Duration {
+	if a.CompletedRetention <= 0 {
+		return 24 * time.Hour
+	}
+
+	return a.CompletedRetention
+}
+
+// Validate проверяет настройки сборки, если она включена. Топики частей не могут совпадать
+// с основным топиком заказов ordersTopic: его читает встроенный обработчик.
+func (a *Assembly) Validate(ordersTopic string) error {
+	if !a.Enabled {
+		return nil
+	}
+
+	if a.OrderTopic == "" || a.PaymentTopic == "" || a.DeliveryTopic == "" {
+		return eris.New("ASSEMBLY_ORDER_TOPIC, ASSEMBLY_PAYMENT_TOPIC and ASSEMBLY_DELIVERY_TOPIC must be set")
+	}
+
+	if a.OrderTopic == a.PaymentTopic || a.OrderTopic == a.DeliveryTopic || a.PaymentTopic == a.DeliveryTopic {
+		return eris.New("ASSEMBLY_ORDER_TOPIC, ASSEMBLY_PAYMENT_TOPIC and ASSEMBLY_DELIVERY_TOPIC must differ")
+	}
+
+	for _, topic := range []string{a.OrderTopic, a.PaymentTopic, a.DeliveryTopic} {
+		if topic == ordersTopic {
+			return eris.Errorf("assembly topic %s is the main orders topic", topic)
+		}
+	}
+
+	switch a.GetTimeoutAction() {
+	case AssemblyTimeoutAlert, AssemblyTimeoutDeadLetter:
+	default:
+		return eris.Errorf("invalid ASSEMBLY_TIMEOUT_ACTION %q: expected alert or dead_letter", a.TimeoutAction)
+	}
+
+	return nil
+}
@@ -12,6 +12,11 @@ type Config struct {
 	App      *App
 	Database *Database
 	Kafka    *KafkaConfig
+	Orders   *Orders
+	Outbox   *Outbox
+
+	Pipelines *Pipelines
+	Assembly  *Assembly
 }
 
 func LoadConfig() (*Config, error) {
@@ -25,11 +30,27 @@ func LoadConfig() (*Config, error) {
 	cfg.App = &App{}
 	cfg.Database = &Database{}
 	cfg.Kafka = &KafkaConfig{}
+	cfg.Orders = &Orders{}
+	cfg.Outbox = &Outbox{}
+	cfg.Pipelines = &Pipelines{}
+	cfg.Assembly = &Assembly{}
 
 	err = envconfig.Process("", &cfg)
 	if err != nil {
 		return nil, eris.Wrapf(err, "failed to process environment variables")
 	}
 
+	if err := cfg.Kafka.Validate(); err != nil {
+		return nil, eris.Wrap(err, "invalid kafka configuration")
+	}
+
+	if err := cfg.Orders.Validate(); err != nil {
+		return nil, eris.Wrap(err, "invalid orders configuration")
+	}
+
+	if err := cfg.Assembly.Validate(cfg.Kafka.GetTopic()); err != nil {
+		return nil, eris.Wrap(err, "invalid assembly configuration")
+	}
+
 	return &cfg, nil
 }
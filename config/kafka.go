@@ -1,8 +1,12 @@
 package config
 
 import (
+	"fmt"
 	"strings"
 	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
 )
 
 type KafkaConfig struct {
@@ -14,6 +18,260 @@ type KafkaConfig struct {
 	AutoOffset     string        `envconfig:"KAFKA_AUTO_OFFSET" default:"earliest"`
 	MaxWaitTime    time.Duration `envconfig:"KAFKA_MAX_WAIT_TIME" default:"1s"`
 	MaxBytes       int           `envconfig:"KAFKA_MAX_BYTES" default:"1048576"`
+
+	// Дополнительные топики подписки и регулярные выражения для поиска топиков в кластере
+	Topics               []string      `envconfig:"KAFKA_TOPICS"`
+	TopicPatterns        []string      `envconfig:"KAFKA_TOPIC_PATTERNS"`
+	TopicRefreshInterval time.Duration `envconfig:"KAFKA_TOPIC_REFRESH_INTERVAL" default:"30s"`
+
+	// Режим фиксации offset'ов: auto — периодический автокоммит,
+	// manual — коммит только после сохранения заказа в БД
+	CommitMode string `envconfig:"KAFKA_COMMIT_MODE" default:"auto"`
+
+	// Dead letter queue для сообщений, которые не удалось обработать
+	DeadLetterEnabled bool   `envconfig:"KAFKA_DLQ_ENABLED" default:"true"`
+	DeadLetterTopic   string `envconfig:"KAFKA_DLQ_TOPIC" default:"orders.dlq"`
+
+	// Повторная обработка: сначала внутри процесса с экспоненциальной паузой,
+	// затем через топики отложенных повторов (<topic>.retry.<delay>)
+	RetryMaxAttempts int             `envconfig:"KAFKA_RETRY_MAX_ATTEMPTS" default:"3"`
+	RetryBackoff     time.Duration   `envconfig:"KAFKA_RETRY_BACKOFF" default:"200ms"`
+	RetryMaxBackoff  time.Duration   `envconfig:"KAFKA_RETRY_MAX_BACKOFF" default:"5s"`
+	RetryDelays      []time.Duration `envconfig:"KAFKA_RETRY_DELAYS" default:"10s,1m"`
+
+	// Пакетная обработка: до BatchSize сообщений или BatchTimeout ожидания пишутся
+	// в БД одной транзакцией. Размер 0 или 1 отключает пакетный режим
+	BatchSize    int           `envconfig:"KAFKA_BATCH_SIZE" default:"0"`
+	BatchTimeout time.Duration `envconfig:"KAFKA_BATCH_TIMEOUT" default:"500ms"`
+
+	// Параллельная обработка claim'а: число воркеров (1 — последовательно) и лимит
+	// сообщений в работе. Порядок сохраняется для сообщений с одним ключом
+	Workers         int `envconfig:"KAFKA_WORKERS" default:"1"`
+	WorkerQueueSize int `envconfig:"KAFKA_WORKER_QUEUE_SIZE" default:"100"`
+
+	// Отставание consumer group: период замера и число хранимых точек временного ряда
+	LagSampleInterval time.Duration `envconfig:"KAFKA_LAG_SAMPLE_INTERVAL" default:"15s"`
+	LagHistorySize    int           `envconfig:"KAFKA_LAG_HISTORY_SIZE" default:"120"`
+
+	// Идентификация клиента и участие в группе: стратегия ребалансировки
+	// (range, round-robin, sticky) и статическое членство
+	ClientID          string `envconfig:"KAFKA_CLIENT_ID" default:"wb-service"`
+	RebalanceStrategy string `envconfig:"KAFKA_REBALANCE_STRATEGY" default:"round-robin"`
+	GroupInstanceID   string `envconfig:"KAFKA_GROUP_INSTANCE_ID"`
+
+	// TLS: CA для проверки брокеров и клиентский сертификат для mTLS
+	TLSEnabled            bool   `envconfig:"KAFKA_TLS_ENABLED" default:"false"`
+	TLSCAFile             string `envconfig:"KAFKA_TLS_CA_FILE"`
+	TLSCertFile           string `envconfig:"KAFKA_TLS_CERT_FILE"`
+	TLSKeyFile            string `envconfig:"KAFKA_TLS_KEY_FILE"`
+	TLSServerName         string `envconfig:"KAFKA_TLS_SERVER_NAME"`
+	TLSInsecureSkipVerify bool   `envconfig:"KAFKA_TLS_INSECURE_SKIP_VERIFY" default:"false"`
+
+	// SASL: PLAIN, SCRAM-SHA-256 или SCRAM-SHA-512, пустое значение отключает аутентификацию
+	SASLMechanism string `envconfig:"KAFKA_SASL_MECHANISM"`
+	SASLUser      string `envconfig:"KAFKA_SASL_USER"`
+	SASLPassword  string `envconfig:"KAFKA_SASL_PASSWORD"`
+
+	// Переподключение: экспоненциальная пауза между попытками и число подряд
+	// неудачных сессий consumer group, после которого соединение пересоздается
+	ReconnectBackoff       time.Duration `envconfig:"KAFKA_RECONNECT_BACKOFF" default:"1s"`
+	ReconnectMaxBackoff    time.Duration `envconfig:"KAFKA_RECONNECT_MAX_BACKOFF" default:"1m"`
+	ReconnectAfterFailures int           `envconfig:"KAFKA_RECONNECT_AFTER_FAILURES" default:"3"`
+
+	// Producer: sync ждет подтверждения каждого сообщения, async копит сообщения в пакеты
+	// до ProducerBatchSize штук или ProducerLinger ожидания. Сжатие: none, gzip, snappy, lz4, zstd
+	ProducerMode        string        `envconfig:"KAFKA_PRODUCER_MODE" default:"sync"`
+	ProducerLinger      time.Duration `envconfig:"KAFKA_PRODUCER_LINGER" default:"10ms"`
+	ProducerBatchSize   int           `envconfig:"KAFKA_PRODUCER_BATCH_SIZE" default:"100"`
+	ProducerCompression string        `envconfig:"KAFKA_PRODUCER_COMPRESSION" default:"none"`
+	ProducerIdempotent  bool          `envconfig:"KAFKA_PRODUCER_IDEMPOTENT" default:"false"`
+
+	// Создание недостающих топиков подписки и DLQ при подключении (топики повторов
+	// создаются всегда, если заданы KAFKA_RETRY_DELAYS), а также настройки по умолчанию
+	// для топиков, создаваемых через /api/kafka/admin
+	AutoCreateTopics       bool  `envconfig:"KAFKA_AUTO_CREATE_TOPICS" default:"false"`
+	TopicPartitions        int32 `envconfig:"KAFKA_TOPIC_PARTITIONS" default:"3"`
+	TopicReplicationFactor int16 `envconfig:"KAFKA_TOPIC_REPLICATION_FACTOR" default:"1"`
+
+	// Просмотр сообщений топиков: предел сообщений в ответе, число прочитанных сообщений
+	// при поиске по фильтру и общее время чтения одного запроса
+	BrowseMaxMessages int           `envconfig:"KAFKA_BROWSE_MAX_MESSAGES" default:"500"`
+	BrowseMaxScan     int           `envconfig:"KAFKA_BROWSE_MAX_SCAN" default:"10000"`
+	BrowseTimeout     time.Duration `envconfig:"KAFKA_BROWSE_TIMEOUT" default:"5s"`
+}
+
+// Режимы работы producer'а
+const (
+	ProducerModeSync  = "sync"
+	ProducerModeAsync = "async"
+)
+
+// Поддерживаемые механизмы SASL
+const (
+	SASLMechanismPlain       = "PLAIN"
+	SASLMechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	SASLMechanismSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// Validate проверяет настройки Kafka при старте, чтобы ошибка конфигурации
+// не проявилась только при первом подключении
+func (k *KafkaConfig) Validate() error {
+	version, err := sarama.ParseKafkaVersion(k.GetVersion())
+	if err != nil {
+		return eris.Wrapf(err, "invalid KAFKA_VERSION %q", k.Version)
+	}
+
+	switch strings.ToLower(k.AutoOffset) {
+	case "", "earliest", "latest":
+	default:
+		return eris.Errorf("invalid KAFKA_AUTO_OFFSET %q: expected earliest or latest", k.AutoOffset)
+	}
+
+	// sarama поддерживает только eager-ребалансировку, поэтому cooperative-sticky отклоняется,
+	// а не подменяется молча на sticky с остановкой всей группы при каждой ребалансировке
+	switch k.GetRebalanceStrategy() {
+	case "range", "round-robin", "sticky":
+	case "cooperative-sticky":
+		return eris.New("KAFKA_REBALANCE_STRATEGY cooperative-sticky is not supported by the kafka client: " +
+			"use sticky for eager rebalancing with sticky assignment")
+	default:
+		return eris.Errorf("invalid KAFKA_REBALANCE_STRATEGY %q: expected range, round-robin or sticky",
+			k.RebalanceStrategy)
+	}
+
+	if k.GroupInstanceID != "" && !version.IsAtLeast(sarama.V2_3_0_0) {
+		return eris.Errorf("KAFKA_GROUP_INSTANCE_ID requires KAFKA_VERSION 2.3.0 or newer, got %s", version)
+	}
+
+	if k.SessionTimeout < 0 || k.MaxWaitTime < 0 || k.MaxBytes < 0 {
+		return eris.New("KAFKA_SESSION_TIMEOUT, KAFKA_MAX_WAIT_TIME and KAFKA_MAX_BYTES must not be negative")
+	}
+
+	if (k.TLSCertFile == "") != (k.TLSKeyFile == "") {
+		return eris.New("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+	}
+
+	if !k.TLSEnabled && (k.TLSCAFile != "" || k.TLSCertFile != "") {
+		return eris.New("KAFKA_TLS_* files are set but KAFKA_TLS_ENABLED is false")
+	}
+
+	switch k.GetSASLMechanism() {
+	case "":
+	case SASLMechanismPlain, SASLMechanismSCRAMSHA256, SASLMechanismSCRAMSHA512:
+		if k.SASLUser == "" || k.SASLPassword == "" {
+			return eris.Errorf("KAFKA_SASL_USER and KAFKA_SASL_PASSWORD are required for %s", k.GetSASLMechanism())
+		}
+	default:
+		return eris.Errorf("invalid KAFKA_SASL_MECHANISM %q: expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", k.SASLMechanism)
+	}
+
+	switch k.GetProducerMode() {
+	case ProducerModeSync, ProducerModeAsync:
+	default:
+		return eris.Errorf("invalid KAFKA_PRODUCER_MODE %q: expected sync or async", k.ProducerMode)
+	}
+
+	if k.ProducerLinger < 0 || k.ProducerBatchSize < 0 {
+		return eris.New("KAFKA_PRODUCER_LINGER and KAFKA_PRODUCER_BATCH_SIZE must not be negative")
+	}
+
+	codec, err := k.GetProducerCompression()
+	if err != nil {
+		return err
+	}
+
+	if codec == sarama.CompressionZSTD && !version.IsAtLeast(sarama.V2_1_0_0) {
+		return eris.Errorf("KAFKA_PRODUCER_COMPRESSION zstd requires KAFKA_VERSION 2.1.0 or newer, got %s", version)
+	}
+
+	if k.ProducerIdempotent && !version.IsAtLeast(sarama.V0_11_0_0) {
+		return eris.Errorf("KAFKA_PRODUCER_IDEMPOTENT requires KAFKA_VERSION 0.11.0 or newer, got %s", version)
+	}
+
+	return nil
+}
+
+func (k *KafkaConfig) GetProducerMode() string {
+	if k.ProducerMode == "" {
+		return ProducerModeSync
+	}
+
+	return strings.ToLower(k.ProducerMode)
+}
+
+func (k *KafkaConfig) IsAsyncProducer() bool {
+	return k.GetProducerMode() == ProducerModeAsync
+}
+
+// GetProducerCompression возвращает кодек сжатия сообщений producer'а
+func (k *KafkaConfig) GetProducerCompression() (sarama.CompressionCodec, error) {
+	switch strings.ToLower(k.ProducerCompression) {
+	case "", "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	default:
+		return sarama.CompressionNone, eris.Errorf("invalid KAFKA_PRODUCER_COMPRESSION %q: expected none, gzip, snappy, lz4 or zstd",
+			k.ProducerCompression)
+	}
+}
+
+func (k *KafkaConfig) GetProducerBatchSize() int {
+	if k.ProducerBatchSize < 1 {
+		return 1
+	}
+
+	return k.ProducerBatchSize
+}
+
+func (k *KafkaConfig) GetReconnectBackoff() time.Duration {
+	if k.ReconnectBackoff <= 0 {
+		return time.Second
+	}
+
+	return k.ReconnectBackoff
+}
+
+func (k *KafkaConfig) GetReconnectMaxBackoff() time.Duration {
+	if k.ReconnectMaxBackoff < k.GetReconnectBackoff() {
+		return k.GetReconnectBackoff()
+	}
+
+	return k.ReconnectMaxBackoff
+}
+
+func (k *KafkaConfig) GetReconnectAfterFailures() int {
+	if k.ReconnectAfterFailures < 1 {
+		return 1
+	}
+
+	return k.ReconnectAfterFailures
+}
+
+func (k *KafkaConfig) GetVersion() string {
+	if k.Version == "" {
+		return "2.8.0"
+	}
+
+	return k.Version
+}
+
+func (k *KafkaConfig) GetRebalanceStrategy() string {
+	if k.RebalanceStrategy == "" {
+		return "round-robin"
+	}
+
+	return strings.ToLower(k.RebalanceStrategy)
+}
+
+func (k *KafkaConfig) GetSASLMechanism() string {
+	return strings.ToUpper(k.SASLMechanism)
 }
 
 func (k *KafkaConfig) GetBrokers() []string {
@@ -43,3 +301,138 @@ func (k *KafkaConfig) GetGroupID() string {
 
 	return k.GroupID
 }
+
+func (k *KafkaConfig) GetTopicRefreshInterval() time.Duration {
+	if k.TopicRefreshInterval <= 0 {
+		return 30 * time.Second
+	}
+
+	return k.TopicRefreshInterval
+}
+
+func (k *KafkaConfig) GetCommitMode() string {
+	if strings.ToLower(k.CommitMode) == "manual" {
+		return "manual"
+	}
+
+	return "auto"
+}
+
+func (k *KafkaConfig) IsManualCommit() bool {
+	return k.GetCommitMode() == "manual"
+}
+
+func (k *KafkaConfig) GetDeadLetterTopic() string {
+	if k.DeadLetterTopic == "" {
+		return k.GetTopic() + ".dlq"
+	}
+
+	return k.DeadLetterTopic
+}
+
+func (k *KafkaConfig) GetRetryMaxAttempts() int {
+	if k.RetryMaxAttempts < 1 {
+		return 1
+	}
+
+	return k.RetryMaxAttempts
+}
+
+func (k *KafkaConfig) IsBatchMode() bool {
+	return k.BatchSize > 1
+}
+
+func (k *KafkaConfig) GetBatchTimeout() time.Duration {
+	if k.BatchTimeout <= 0 {
+		return 500 * time.Millisecond
+	}
+
+	return k.BatchTimeout
+}
+
+func (k *KafkaConfig) IsParallelMode() bool {
+	return k.Workers > 1
+}
+
+func (k *KafkaConfig) GetWorkerQueueSize() int {
+	if k.WorkerQueueSize < 1 {
+		return 100
+	}
+
+	return k.WorkerQueueSize
+}
+
+func (k *KafkaConfig) GetLagSampleInterval() time.Duration {
+	if k.LagSampleInterval <= 0 {
+		return 15 * time.Second
+	}
+
+	return k.LagSampleInterval
+}
+
+func (k *KafkaConfig) GetLagHistorySize() int {
+	if k.LagHistorySize < 1 {
+		return 120
+	}
+
+	return k.LagHistorySize
+}
+
+func (k *KafkaConfig) GetTopicPartitions() int32 {
+	if k.TopicPartitions < 1 {
+		return 3
+	}
+
+	return k.TopicPartitions
+}
+
+func (k *KafkaConfig) GetTopicReplicationFactor() int16 {
+	if k.TopicReplicationFactor < 1 {
+		return 1
+	}
+
+	return k.TopicReplicationFactor
+}
+
+func (k *KafkaConfig) GetBrowseMaxMessages() int {
+	if k.BrowseMaxMessages < 1 {
+		return 500
+	}
+
+	return k.BrowseMaxMessages
+}
+
+func (k *KafkaConfig) GetBrowseMaxScan() int {
+	if k.BrowseMaxScan < 1 {
+		return 10000
+	}
+
+	return k.BrowseMaxScan
+}
+
+func (k *KafkaConfig) GetBrowseTimeout() time.Duration {
+	if k.BrowseTimeout <= 0 {
+		return 5 * time.Second
+	}
+
+	return k.BrowseTimeout
+}
+
+// GetRetryTopic возвращает имя топика отложенных повторов для топика и задержки,
+// например orders.retry.10s или orders.retry.1m
+func (k *KafkaConfig) GetRetryTopic(topic string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", topic, formatDelay(delay))
+}
+
+func formatDelay(delay time.Duration) string {
+	switch {
+	case delay >= time.Hour && delay%time.Hour == 0:
+		return fmt.Sprintf("%dh", delay/time.Hour)
+	case delay >= time.Minute && delay%time.Minute == 0:
+		return fmt.Sprintf("%dm", delay/time.Minute)
+	case delay >= time.Second && delay%time.Second == 0:
+		return fmt.Sprintf("%ds", delay/time.Second)
+	default:
+		return fmt.Sprintf("%dms", delay/time.Millisecond)
+	}
+}
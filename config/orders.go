@@ -0,0 +1,74 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+type Orders struct {
+	// Версия схемы валидации входящих заказов в каноничном формате
+	SchemaVersion string `envconfig:"ORDER_SCHEMA_VERSION" default:"1"`
+
+	// Проверка бизнес-инвариантов: reject — отклонить заказ, flag — сохранить с пометкой,
+	// correct — исправить суммы и сохранить с пометкой
+	ConsistencyMode string `envconfig:"ORDER_CONSISTENCY_MODE" default:"flag"`
+	// Допустимое расхождение сумм по умолчанию и по валютам (например USD:0.01,RUB:1)
+	ConsistencyTolerance          float64            `envconfig:"ORDER_CONSISTENCY_TOLERANCE" default:"1"`
+	ConsistencyCurrencyTolerances map[string]float64 `envconfig:"ORDER_CONSISTENCY_CURRENCY_TOLERANCES"`
+
+	// Политика при повторном order_uid: first-wins, last-wins, highest-version-wins
+	ConflictPolicy string `envconfig:"ORDER_CONFLICT_POLICY" default:"highest-version-wins"`
+}
+
+// Validate проверяет настройки обработки заказов при старте, чтобы опечатка в режиме
+// не подменялась молча значением по умолчанию
+func (o *Orders) Validate() error {
+	switch o.GetConsistencyMode() {
+	case "reject", "flag", "correct":
+	default:
+		return eris.Errorf("invalid ORDER_CONSISTENCY_MODE %q: expected reject, flag or correct", o.ConsistencyMode)
+	}
+
+	switch o.GetConflictPolicy() {
+	case "first-wins", "last-wins", "highest-version-wins":
+	default:
+		return eris.Errorf("invalid ORDER_CONFLICT_POLICY %q: expected first-wins, last-wins or highest-version-wins",
+			o.ConflictPolicy)
+	}
+
+	return nil
+}
+
+func (o *Orders) GetSchemaVersion() string {
+	if o.SchemaVersion == "" {
+		return "1"
+	}
+
+	return o.SchemaVersion
+}
+
+func (o *Orders) GetConsistencyMode() string {
+	if o.ConsistencyMode == "" {
+		return "flag"
+	}
+
+	return strings.ToLower(o.ConsistencyMode)
+}
+
+// GetConsistencyTolerance возвращает допустимое расхождение сумм для валюты
+func (o *Orders) GetConsistencyTolerance(currency string) float64 {
+	if tolerance, ok := o.ConsistencyCurrencyTolerances[strings.ToUpper(currency)]; ok {
+		return tolerance
+	}
+
+	return o.ConsistencyTolerance
+}
+
+func (o *Orders) GetConflictPolicy() string {
+	if o.ConflictPolicy == "" {
+		return "highest-version-wins"
+	}
+
+	return strings.ToLower(o.ConflictPolicy)
+}
@@ -0,0 +1,70 @@
+package config
+
+import "time"
+
+// Outbox настройки публикации событий о заказах из таблицы outbox_events
+type Outbox struct {
+	// Топик, в который relay публикует события для внешних команд
+	Topic string `envconfig:"OUTBOX_TOPIC" default:"orders.events"`
+
+	// Период опроса таблицы и максимум событий за один проход
+	PollInterval time.Duration `envconfig:"OUTBOX_POLL_INTERVAL" default:"1s"`
+	BatchSize    int           `envconfig:"OUTBOX_BATCH_SIZE" default:"100"`
+
+	// Экспоненциальная пауза перед повторной публикацией события после ошибки
+	RetryBackoff    time.Duration `envconfig:"OUTBOX_RETRY_BACKOFF" default:"1s"`
+	RetryMaxBackoff time.Duration `envconfig:"OUTBOX_RETRY_MAX_BACKOFF" default:"1m"`
+
+	// Срок, на который relay захватывает пачку событий. Пока пачка публикуется, аренда
+	// продлевается. Если экземпляр упал, не успев отметить события, после истечения срока
+	// их опубликует другой
+	Lease time.Duration `envconfig:"OUTBOX_LEASE" default:"1m"`
+}
+
+func (o *Outbox) GetTopic() string {
+	if o.Topic == "" {
+		return "orders.events"
+	}
+
+	return o.Topic
+}
+
+func (o *Outbox) GetPollInterval() time.Duration {
+	if o.PollInterval <= 0 {
+		return time.Second
+	}
+
+	return o.PollInterval
+}
+
+func (o *Outbox) GetBatchSize() int {
+	if o.BatchSize < 1 {
+		return 100
+	}
+
+	return o.BatchSize
+}
+
+func (o *Outbox) GetLease() time.Duration {
+	if o.Lease <= 0 {
+		return time.Minute
+	}
+
+	return o.Lease
+}
+
+// GetRetryDelay возвращает паузу перед следующей попыткой после attempts неудачных
+func (o *Outbox) GetRetryDelay(attempts int) time.Duration {
+	delay := o.RetryBackoff
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	maxDelay := max(o.RetryMaxBackoff, delay)
+
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxDelay)
+}
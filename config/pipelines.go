@@ -0,0 +1,8 @@
+package config
+
+// Pipelines настройки конвейеров обработки сообщений топиков
+type Pipelines struct {
+	// JSON-файл с конвейерами, которые применяются при старте поверх сохраненных в БД.
+	// Пустое значение или отсутствующий файл — только конвейеры из БД
+	File string `envconfig:"PIPELINES_FILE" default:"pipelines.json"`
+}
@@ -99,6 +99,55 @@ func NewDatabase(cfg *config.Config) (*gorm.DB, error) {
 
 	log.Println("Таблица order_items проверена и обновлена")
 
+	err = gormDB.AutoMigrate(&models.OrderStatusHistory{})
+	if err != nil {
+		return nil, eris.Wrapf(err, "ошибка миграции таблицы order_status_history")
+	}
+
+	log.Println("Таблица order_status_history проверена и обновлена")
+
+	err = gormDB.AutoMigrate(&models.OrderProvenance{})
+	if err != nil {
+		return nil, eris.Wrapf(err, "ошибка миграции таблицы order_provenance")
+	}
+
+	log.Println("Таблица order_provenance проверена и обновлена")
+
+	err = gormDB.AutoMigrate(&models.OutboxEvent{})
+	if err != nil {
+		return nil, eris.Wrapf(err, "ошибка миграции таблицы outbox_events")
+	}
+
+	log.Println("Таблица outbox_events проверена и обновлена")
+
+	err = gormDB.AutoMigrate(&models.Pipeline{})
+	if err != nil {
+		return nil, eris.Wrapf(err, "ошибка миграции таблицы pipelines")
+	}
+
+	log.Println("Таблица pipelines проверена и обновлена")
+
+	err = gormDB.AutoMigrate(&models.RoutingRule{})
+	if err != nil {
+		return nil, eris.Wrapf(err, "ошибка миграции таблицы routing_rules")
+	}
+
+	log.Println("Таблица routing_rules проверена и обновлена")
+
+	err = gormDB.AutoMigrate(&models.OrderFragment{})
+	if err != nil {
+		return nil, eris.Wrapf(err, "ошибка миграции таблицы order_fragments")
+	}
+
+	log.Println("Таблица order_fragments проверена и обновлена")
+
+	err = gormDB.AutoMigrate(&models.OrderAssembly{})
+	if err != nil {
+		return nil, eris.Wrapf(err, "ошибка миграции таблицы order_assemblies")
+	}
+
+	log.Println("Таблица order_assemblies проверена и обновлена")
+
 	err = createMissingIndexes(gormDB)
 	if err != nil {
 		log.Printf("Предупреждение: не удалось создать некоторые индексы: %v", err)
@@ -150,6 +199,12 @@ func createMissingIndexes(db *gorm.DB) error {
 		return eris.Wrapf(err, "ошибка создания индекса idx_order_items_nm_id")
 	}
 
+	// Relay читает только неотправленные события, частичный индекс держит выборку короткой
+	err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_outbox_events_pending ON outbox_events(id) WHERE sent_at IS NULL`).Error
+	if err != nil {
+		return eris.Wrapf(err, "ошибка создания индекса idx_outbox_events_pending")
+	}
+
 	log.Println("Индексы проверены и созданы")
 
 	return nil
@@ -1,10 +1,13 @@
 package dependency
 
 import (
+	"context"
 	"errors"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/wire"
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm"
 	"wb/config"
 	"wb/internal/config/database/postgre"
 	"wb/internal/http/controllers"
@@ -20,6 +23,26 @@ func ProvideKafkaConfig(cfg *config.Config) *config.KafkaConfig {
 	return cfg.Kafka
 }
 
+// Провайдер для извлечения настроек outbox из Config
+func ProvideOutboxConfig(cfg *config.Config) *config.Outbox {
+	return cfg.Outbox
+}
+
+// Провайдер для извлечения настроек конвейеров из Config
+func ProvidePipelinesConfig(cfg *config.Config) *config.Pipelines {
+	return cfg.Pipelines
+}
+
+// Провайдер для извлечения настроек сборки заказов из частей из Config
+func ProvideAssemblyConfig(cfg *config.Config) *config.Assembly {
+	return cfg.Assembly
+}
+
+// Провайдер для извлечения настроек обработки заказов из Config
+func ProvideOrdersConfig(cfg *config.Config) *config.Orders {
+	return cfg.Orders
+}
+
 var ProviderSet = wire.NewSet( //nolint:gochecknoglobals
 	config.LoadConfig,
 
@@ -27,18 +50,36 @@ var ProviderSet = wire.NewSet( //nolint:gochecknoglobals
 
 	// Провайдеры для конфигурации
 	ProvideKafkaConfig,
+	ProvideOrdersConfig,
+	ProvideOutboxConfig,
+	ProvidePipelinesConfig,
+	ProvideAssemblyConfig,
 
 	// Репозитории
 	repositories.NewOrderRepository,
+	repositories.NewOutboxRepository,
+	repositories.NewPipelineRepository,
+	repositories.NewRoutingRuleRepository,
+	repositories.NewOrderFragmentRepository,
 
 	// Сервисы
 	services.NewCacheService,
+	services.NewOrderValidator,
+	services.NewOrderRuleEngine,
 	services.NewKafkaService,
 	services.NewFakeDataService,
+	services.NewOutboxRelay,
+	services.NewPipelineService,
+	services.NewOrderRouter,
+	services.NewOrderAssembler,
 
 	// Контроллеры
 	controllers.NewOrderController,
 	controllers.NewKafkaController,
+	controllers.NewOutboxController,
+	controllers.NewPipelineController,
+	controllers.NewRoutingController,
+	controllers.NewAssemblyController,
 
 	// Роутеры
 	routes.NewRouter,
@@ -55,9 +96,15 @@ type App struct {
 	Kafka    *services.KafkaService
 	Cache    *services.CacheService
 	FakeData *services.FakeDataService
+	DB       *gorm.DB
+	Outbox   *services.OutboxRelay
+
+	Pipelines *services.PipelineService
+	Routing   *services.OrderRouter
+	Assembler *services.OrderAssembler
 }
 
-func NewApp(fiberApp *fiber.App, router *routes.Router, cfg *config.Config, kafka *services.KafkaService, cache *services.CacheService, fakeData *services.FakeDataService) *App {
+func NewApp(fiberApp *fiber.App, router *routes.Router, cfg *config.Config, kafka *services.KafkaService, cache *services.CacheService, fakeData *services.FakeDataService, db *gorm.DB, outbox *services.OutboxRelay, pipelines *services.PipelineService, routing *services.OrderRouter, assembler *services.OrderAssembler) *App {
 	return &App{
 		FiberApp: fiberApp,
 		Router:   router,
@@ -65,9 +112,49 @@ func NewApp(fiberApp *fiber.App, router *routes.Router, cfg *config.Config, kafk
 		Kafka:    kafka,
 		Cache:    cache,
 		FakeData: fakeData,
+		DB:       db,
+		Outbox:   outbox,
+
+		Pipelines: pipelines,
+		Routing:   routing,
+		Assembler: assembler,
 	}
 }
 
+// Shutdown останавливает приложение в пределах ctx: сначала HTTP-сервер перестает принимать
+// запросы и дожидается текущих, затем останавливаются outbox relay и проверка просроченных
+// сборок заказов, Kafka завершает обработку и фиксирует offset'ы, последним закрывается
+// пул соединений с БД
+func (a *App) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	if err := a.FiberApp.ShutdownWithContext(ctx); err != nil {
+		errs = append(errs, eris.Wrap(err, "failed to shutdown http server"))
+	}
+
+	// Relay и сборка заказов останавливаются до Kafka, чтобы не публиковать через закрывающийся producer
+	if err := a.Outbox.Stop(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := a.Assembler.Stop(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := a.Kafka.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	sqlDB, err := a.DB.DB()
+	if err != nil {
+		errs = append(errs, eris.Wrap(err, "failed to get database pool"))
+	} else if err := sqlDB.Close(); err != nil {
+		errs = append(errs, eris.Wrap(err, "failed to close database pool"))
+	}
+
+	return errors.Join(errs...)
+}
+
 func NewFiberApp() *fiber.App {
 	app := fiber.New(fiber.Config{
 		AppName:      "WB Test App",
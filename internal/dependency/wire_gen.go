@@ -27,24 +27,47 @@ func InitializeApp() (*App, error) {
 	if err != nil {
 		return nil, err
 	}
-	cacheService := services.NewCacheService(db)
+	orders := ProvideOrdersConfig(configConfig)
+	cacheService := services.NewCacheService(db, orders)
 	orderRepository := repositories.NewOrderRepository(db)
 	order := controllers.NewOrderController(db, cacheService, orderRepository)
 	kafkaConfig := ProvideKafkaConfig(configConfig)
-	kafkaService, err := services.NewKafkaService(kafkaConfig, cacheService)
+	orderValidator := services.NewOrderValidator(orders)
+	orderRuleEngine := services.NewOrderRuleEngine(orders)
+	kafkaService, err := services.NewKafkaService(kafkaConfig, cacheService, orderValidator, orderRuleEngine)
 	if err != nil {
 		return nil, err
 	}
-	kafkaController := controllers.NewKafkaController(kafkaService)
-	router := routes.NewRouter(app, order, kafkaController)
+	pipelines := ProvidePipelinesConfig(configConfig)
+	pipelineRepository := repositories.NewPipelineRepository(db)
+	pipelineService := services.NewPipelineService(pipelines, pipelineRepository, kafkaService)
+	kafkaController := controllers.NewKafkaController(kafkaService, pipelineService)
+	outbox := ProvideOutboxConfig(configConfig)
+	outboxRepository := repositories.NewOutboxRepository(db)
+	outboxRelay := services.NewOutboxRelay(outbox, outboxRepository, kafkaService)
+	outboxController := controllers.NewOutboxController(outboxRelay)
+	pipelineController := controllers.NewPipelineController(pipelineService)
+	routingRuleRepository := repositories.NewRoutingRuleRepository(db)
+	orderRouter := services.NewOrderRouter(routingRuleRepository, kafkaService, outboxRelay)
+	routingController := controllers.NewRoutingController(orderRouter)
+	assembly := ProvideAssemblyConfig(configConfig)
+	orderFragmentRepository := repositories.NewOrderFragmentRepository(db)
+	orderAssembler := services.NewOrderAssembler(assembly, orderFragmentRepository, kafkaService, cacheService)
+	assemblyController := controllers.NewAssemblyController(orderAssembler)
+	router := routes.NewRouter(app, order, kafkaController, outboxController, pipelineController, routingController, assemblyController)
 	fakeDataService := services.NewFakeDataService()
 	dependencyApp := &App{
-		FiberApp: app,
-		Router:   router,
-		Config:   configConfig,
-		Kafka:    kafkaService,
-		Cache:    cacheService,
-		FakeData: fakeDataService,
+		FiberApp:  app,
+		Router:    router,
+		Config:    configConfig,
+		Kafka:     kafkaService,
+		Cache:     cacheService,
+		FakeData:  fakeDataService,
+		DB:        db,
+		Outbox:    outboxRelay,
+		Pipelines: pipelineService,
+		Routing:   orderRouter,
+		Assembler: orderAssembler,
 	}
 	return dependencyApp, nil
 }
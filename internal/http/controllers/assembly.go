@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"wb/internal/services"
+)
+
+type AssemblyController struct {
+	assembler *services.OrderAssembler
+}
+
+func NewAssemblyController(assembler *services.OrderAssembler) *AssemblyController {
+	return &AssemblyController{
+		assembler: assembler,
+	}
+}
+
+// GetAssemblyBacklog возвращает незавершенные сборки заказов из частей
+func (ac *AssemblyController) GetAssemblyBacklog(ctx *fiber.Ctx) error {
+	backlog, err := ac.assembler.Backlog()
+	if err != nil {
+		log.Printf("Ошибка получения незавершенных сборок заказов: %v", err)
+
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка получения незавершенных сборок заказов: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":    false,
+		"assembly": backlog,
+	})
+}
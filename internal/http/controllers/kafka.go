@@ -5,31 +5,26 @@ import (
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"wb/internal/services"
 )
 
 type KafkaController struct {
 	kafkaService *services.KafkaService
+	pipelines    *services.PipelineService
 }
 
-func NewKafkaController(kafkaService *services.KafkaService) *KafkaController {
+func NewKafkaController(kafkaService *services.KafkaService, pipelines *services.PipelineService) *KafkaController {
 	return &KafkaController{
 		kafkaService: kafkaService,
+		pipelines:    pipelines,
 	}
 }
 
 // StartKafkaConsumer запускает потребителя Kafka
 func (kc *KafkaController) StartKafkaConsumer(ctx *fiber.Ctx) error {
-	if err := kc.kafkaService.Connect(); err != nil {
-		log.Printf("Ошибка подключения к Kafka: %v", err)
-
-		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   true,
-			"message": "Ошибка подключения к Kafka: " + err.Error(),
-		})
-	}
-
-	if err := kc.kafkaService.StartConsuming(); err != nil {
+	// Подключение и переподключение выполняет супервизор, ошибки видны в /api/kafka/status
+	if err := kc.kafkaService.Start(); err != nil {
 		log.Printf("Ошибка запуска потребителя Kafka: %v", err)
 
 		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -42,6 +37,7 @@ func (kc *KafkaController) StartKafkaConsumer(ctx *fiber.Ctx) error {
 		"error":   false,
 		"message": "Kafka потребитель успешно запущен",
 		"status":  "running",
+		"state":   kc.kafkaService.State(),
 	})
 }
 
@@ -63,6 +59,65 @@ func (kc *KafkaController) StopKafkaConsumer(ctx *fiber.Ctx) error {
 	})
 }
 
+// PauseKafkaConsumer приостанавливает чтение сообщений, consumer выходит из группы
+func (kc *KafkaController) PauseKafkaConsumer(ctx *fiber.Ctx) error {
+	if err := kc.kafkaService.Pause(); err != nil {
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка приостановки Kafka: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":   false,
+		"message": "Kafka потребитель приостановлен",
+		"status":  "paused",
+	})
+}
+
+// ResumeKafkaConsumer возобновляет чтение сообщений с зафиксированных offset'ов
+func (kc *KafkaController) ResumeKafkaConsumer(ctx *fiber.Ctx) error {
+	if err := kc.kafkaService.Resume(); err != nil {
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка возобновления Kafka: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":   false,
+		"message": "Kafka потребитель возобновлен",
+		"status":  "running",
+	})
+}
+
+// ResetOffsets сбрасывает offset'ы группы для топика; с dry_run только показывает план
+func (kc *KafkaController) ResetOffsets(ctx *fiber.Ctx) error {
+	var request services.OffsetResetRequest
+
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Неверный формат запроса: " + err.Error(),
+		})
+	}
+
+	result, err := kc.kafkaService.ResetOffsets(request)
+	if err != nil {
+		log.Printf("Ошибка сброса offset'ов: %v", err)
+
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка сброса offset'ов: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":  false,
+		"result": result,
+	})
+}
+
 // GetKafkaStatus возвращает статус Kafka сервиса
 func (kc *KafkaController) GetKafkaStatus(ctx *fiber.Ctx) error {
 	status := kc.kafkaService.GetStatus()
@@ -73,12 +128,31 @@ func (kc *KafkaController) GetKafkaStatus(ctx *fiber.Ctx) error {
 	})
 }
 
+// GetConsumerLag возвращает отставание consumer group по партициям топиков подписки
+func (kc *KafkaController) GetConsumerLag(ctx *fiber.Ctx) error {
+	report, err := kc.kafkaService.ConsumerLag()
+	if err != nil {
+		log.Printf("Ошибка получения отставания consumer group: %v", err)
+
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка получения отставания: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error": false,
+		"lag":   report,
+	})
+}
+
 // SendTestMessage отправляет тестовое сообщение в Kafka
 func (kc *KafkaController) SendTestMessage(ctx *fiber.Ctx) error {
 	var request struct {
-		Topic   string          `json:"topic"`
-		Key     string          `json:"key"`
-		Message json.RawMessage `json:"message"`
+		Topic   string            `json:"topic"`
+		Key     string            `json:"key"`
+		Message json.RawMessage   `json:"message"`
+		Headers map[string]string `json:"headers"`
 	}
 
 	if err := ctx.BodyParser(&request); err != nil {
@@ -117,7 +191,16 @@ func (kc *KafkaController) SendTestMessage(ctx *fiber.Ctx) error {
 		request.Message = messageBytes
 	}
 
-	if err := kc.kafkaService.SendMessage(request.Topic, request.Key, request.Message); err != nil {
+	// Correlation и trace ID HTTP-запроса продолжаются в сообщении
+	correlationID := ctx.Get("X-Correlation-ID")
+	if correlationID == "" {
+		correlationID = uuid.NewString()
+	}
+
+	sendCtx := services.WithTraceID(services.WithCorrelationID(ctx.UserContext(), correlationID), ctx.Get("X-Trace-ID"))
+
+	err := kc.kafkaService.SendMessageWithHeaders(sendCtx, request.Topic, request.Key, request.Message, request.Headers)
+	if err != nil {
 		log.Printf("Ошибка отправки сообщения в Kafka: %v", err)
 
 		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -131,10 +214,13 @@ func (kc *KafkaController) SendTestMessage(ctx *fiber.Ctx) error {
 		"message": "Тестовое сообщение успешно отправлено",
 		"topic":   request.Topic,
 		"key":     request.Key,
+
+		"correlation_id": correlationID,
 	})
 }
 
-// RegisterCustomHandler регистрирует пользовательский обработчик для топика
+// RegisterCustomHandler регистрирует обработчик топика типа log или json.
+// Обработчик сохраняется как конвейер из стадий decode и log, см. /api/pipelines
 func (kc *KafkaController) RegisterCustomHandler(ctx *fiber.Ctx) error {
 	var request struct {
 		Topic   string `json:"topic"`
@@ -155,36 +241,54 @@ func (kc *KafkaController) RegisterCustomHandler(ctx *fiber.Ctx) error {
 		})
 	}
 
-	// Регистрируем обработчик в зависимости от типа
+	definition := services.PipelineDefinition{
+		Topic:       request.Topic,
+		Description: "handler_type: " + request.Handler,
+	}
+
 	switch request.Handler {
 	case "log":
-		kc.kafkaService.RegisterHandler(request.Topic, func(message []byte) error {
-			log.Printf("Пользовательский обработчик для топика %s: %s", request.Topic, string(message))
-			return nil
-		})
+		definition.Stages = []services.StageSpec{{Type: services.StageLog}}
 	case "json":
-		kc.kafkaService.RegisterHandler(request.Topic, func(message []byte) error {
-			var data interface{}
-			if err := json.Unmarshal(message, &data); err != nil {
-				log.Printf("Ошибка парсинга JSON из топика %s: %v", request.Topic, err)
-				return err
-			}
-
-			log.Printf("JSON сообщение из топика %s: %+v", request.Topic, data)
+		definition.Stages = []services.StageSpec{{Type: services.StageDecode}, {Type: services.StageLog}}
+	default:
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Неизвестный тип обработчика. Поддерживаемые типы: log, json; остальное настраивается через /api/pipelines",
+		})
+	}
 
-			return nil
+	pipeline, err := kc.pipelines.Apply(definition)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка регистрации обработчика: " + err.Error(),
 		})
-	default:
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":    false,
+		"message":  "Пользовательский обработчик успешно зарегистрирован",
+		"topic":    request.Topic,
+		"handler":  request.Handler,
+		"pipeline": pipeline,
+	})
+}
+
+// UnregisterCustomHandler удаляет конвейер топика, consumer перестает читать этот топик
+func (kc *KafkaController) UnregisterCustomHandler(ctx *fiber.Ctx) error {
+	topic := ctx.Params("topic")
+
+	if err := kc.pipelines.Delete(topic); err != nil {
 		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error":   true,
-			"message": "Неизвестный тип обработчика. Поддерживаемые типы: log, json",
+			"message": err.Error(),
 		})
 	}
 
 	return ctx.JSON(fiber.Map{
 		"error":   false,
-		"message": "Пользовательский обработчик успешно зарегистрирован",
-		"topic":   request.Topic,
-		"handler": request.Handler,
+		"message": "Обработчик успешно удален",
+		"topic":   topic,
 	})
 }
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+
+	"github.com/IBM/sarama"
+	"github.com/gofiber/fiber/v2"
+	"wb/internal/services"
+)
+
+// ListTopics возвращает топики кластера; ?internal=true добавляет служебные топики Kafka
+func (kc *KafkaController) ListTopics(ctx *fiber.Ctx) error {
+	topics, err := kc.kafkaService.ListTopics(ctx.QueryBool("internal"))
+	if err != nil {
+		log.Printf("Ошибка получения списка топиков: %v", err)
+
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка получения списка топиков: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":  false,
+		"count":  len(topics),
+		"topics": topics,
+	})
+}
+
+// DescribeTopic возвращает партиции и конфигурацию топика
+func (kc *KafkaController) DescribeTopic(ctx *fiber.Ctx) error {
+	name := ctx.Params("topic")
+
+	topic, configs, err := kc.kafkaService.DescribeTopic(name)
+	if err != nil {
+		status := fiber.StatusServiceUnavailable
+		if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+			status = fiber.StatusNotFound
+		}
+
+		return ctx.Status(status).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка получения описания топика: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":   false,
+		"topic":   topic,
+		"configs": configs,
+	})
+}
+
+// CreateTopic создает топик; ?validate_only=true только проверяет параметры на брокере
+func (kc *KafkaController) CreateTopic(ctx *fiber.Ctx) error {
+	var spec services.TopicSpec
+
+	if err := ctx.BodyParser(&spec); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Неверный формат запроса: " + err.Error(),
+		})
+	}
+
+	validateOnly := ctx.QueryBool("validate_only")
+
+	if err := kc.kafkaService.CreateTopic(spec, validateOnly); err != nil {
+		log.Printf("Ошибка создания топика %s: %v", spec.Name, err)
+
+		status := fiber.StatusBadRequest
+		switch {
+		case errors.Is(err, sarama.ErrTopicAlreadyExists):
+			status = fiber.StatusConflict
+		case errors.Is(err, services.ErrKafkaNotConnected):
+			status = fiber.StatusServiceUnavailable
+		}
+
+		return ctx.Status(status).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка создания топика: " + err.Error(),
+		})
+	}
+
+	message := "Топик успешно создан"
+	if validateOnly {
+		message = "Параметры топика корректны"
+	}
+
+	return ctx.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"error":         false,
+		"message":       message,
+		"topic":         spec.Name,
+		"validate_only": validateOnly,
+	})
+}
+
+// DeleteTopic удаляет топик, не используемый сервисом
+func (kc *KafkaController) DeleteTopic(ctx *fiber.Ctx) error {
+	name := ctx.Params("topic")
+
+	if err := kc.kafkaService.DeleteTopic(name); err != nil {
+		log.Printf("Ошибка удаления топика %s: %v", name, err)
+
+		status := fiber.StatusBadRequest
+		switch {
+		case errors.Is(err, sarama.ErrUnknownTopicOrPartition):
+			status = fiber.StatusNotFound
+		case errors.Is(err, services.ErrKafkaNotConnected):
+			status = fiber.StatusServiceUnavailable
+		}
+
+		return ctx.Status(status).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка удаления топика: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":   false,
+		"message": "Топик успешно удален",
+		"topic":   name,
+	})
+}
+
+// ListConsumerGroups возвращает consumer group'ы кластера с участниками
+func (kc *KafkaController) ListConsumerGroups(ctx *fiber.Ctx) error {
+	groups, err := kc.kafkaService.ListConsumerGroups()
+	if err != nil {
+		log.Printf("Ошибка получения списка consumer group: %v", err)
+
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка получения списка consumer group: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":  false,
+		"count":  len(groups),
+		"groups": groups,
+	})
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gofiber/fiber/v2"
+	"wb/internal/services"
+)
+
+// BrowseMessages показывает сообщения партиции топика без фиксации offset'ов.
+// Параметры: partition, limit, from_offset или from_timestamp (RFC3339), key, field и value.
+func (kc *KafkaController) BrowseMessages(ctx *fiber.Ctx) error {
+	request := services.BrowseRequest{
+		Topic:     ctx.Params("topic"),
+		Partition: int32(ctx.QueryInt("partition", 0)),
+		Limit:     ctx.QueryInt("limit", 0),
+		Key:       ctx.Query("key"),
+		Field:     ctx.Query("field"),
+		Value:     ctx.Query("value"),
+	}
+
+	if raw := ctx.Query("from_offset"); raw != "" {
+		offset, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || offset < 0 {
+			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Некорректный параметр from_offset: ожидается неотрицательное число",
+			})
+		}
+
+		request.FromOffset = &offset
+	}
+
+	if raw := ctx.Query("from_timestamp"); raw != "" {
+		timestamp, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Некорректный параметр from_timestamp: ожидается время в формате RFC3339",
+			})
+		}
+
+		request.FromTimestamp = &timestamp
+	}
+
+	if request.FromOffset != nil && request.FromTimestamp != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Укажите только один из параметров from_offset и from_timestamp",
+		})
+	}
+
+	result, err := kc.kafkaService.BrowseMessages(request)
+	if err != nil {
+		log.Printf("Ошибка просмотра сообщений топика %s: %v", request.Topic, err)
+
+		status := fiber.StatusBadRequest
+		if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+			status = fiber.StatusNotFound
+		}
+
+		return ctx.Status(status).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка просмотра сообщений: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":  false,
+		"result": result,
+	})
+}
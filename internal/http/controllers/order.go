@@ -1,14 +1,20 @@
 package controllers
 
 import (
+	"errors"
 	"log"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
+	"wb/internal/orm/models"
 	"wb/internal/orm/repositories"
 	"wb/internal/services"
 )
 
+// defaultLatencyWindow окно отчета о задержках, если параметр window не задан
+const defaultLatencyWindow = time.Hour
+
 type Order struct {
 	db        *gorm.DB
 	cache     *services.CacheService
@@ -32,13 +38,16 @@ func (oc *Order) Ping(ctx *fiber.Ctx) error {
 	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{})
 }
 
-// ListOrders возвращает список всех заказов (заглушка)
+// ListOrders возвращает список всех заказов.
+// Параметр consistency (consistent, inconsistent, corrected) фильтрует заказы по результату проверки сумм
 func (oc *Order) ListOrders(ctx *fiber.Ctx) error {
+	consistency := ctx.Query("consistency")
+
 	orders := oc.cache.GetAllOrders()
 	if orders != nil {
 		log.Println("Данные с кэша")
 
-		return ctx.Status(fiber.StatusOK).JSON(orders)
+		return ctx.Status(fiber.StatusOK).JSON(filterByConsistency(orders, consistency))
 	}
 
 	log.Println("В кэше данных нет, проверяем в базе")
@@ -48,7 +57,23 @@ func (oc *Order) ListOrders(ctx *fiber.Ctx) error {
 		return err
 	}
 
-	return ctx.Status(fiber.StatusOK).JSON(orders)
+	return ctx.Status(fiber.StatusOK).JSON(filterByConsistency(orders, consistency))
+}
+
+func filterByConsistency(orders []models.Order, consistency string) []models.Order {
+	if consistency == "" {
+		return orders
+	}
+
+	filtered := make([]models.Order, 0, len(orders))
+
+	for i := range orders {
+		if orders[i].ConsistencyStatus == consistency {
+			filtered = append(filtered, orders[i])
+		}
+	}
+
+	return filtered
 }
 
 // GetOrderByUIDFromDB получает заказ по UID из базы данных
@@ -77,6 +102,100 @@ func (oc *Order) GetOrderByUIDFromDB(ctx *fiber.Ctx) error {
 	return ctx.Status(fiber.StatusOK).JSON(order)
 }
 
+// GetOrderStatus возвращает текущий статус заказа
+func (oc *Order) GetOrderStatus(ctx *fiber.Ctx) error {
+	orderUID := ctx.Params("uid")
+
+	order, ok := oc.cache.GetOrder(orderUID)
+	if !ok {
+		var err error
+
+		order, err = oc.orderRepo.GetOrderByUID(orderUID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Заказ не найден",
+			})
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+		"order_uid":  order.OrderUID,
+		"status":     order.Status,
+		"updated_at": order.UpdatedAt,
+	})
+}
+
+// GetOrderStatusHistory возвращает историю смены статусов заказа
+func (oc *Order) GetOrderStatusHistory(ctx *fiber.Ctx) error {
+	orderUID := ctx.Params("uid")
+
+	history, err := oc.orderRepo.GetStatusHistory(orderUID)
+	if err != nil {
+		return err
+	}
+
+	if len(history) == 0 {
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "История статусов заказа не найдена",
+		})
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+		"order_uid": orderUID,
+		"status":    history[len(history)-1].ToStatus,
+		"history":   history,
+	})
+}
+
+// GetOrderProvenance возвращает сообщения Kafka, из которых сохранялись версии заказа,
+// с временем получения, записи в БД и задержками
+func (oc *Order) GetOrderProvenance(ctx *fiber.Ctx) error {
+	orderUID := ctx.Params("uid")
+
+	provenance, err := oc.orderRepo.GetProvenance(orderUID)
+	if err != nil {
+		return err
+	}
+
+	if len(provenance) == 0 {
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Происхождение заказа не найдено",
+		})
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+		"order_uid":  orderUID,
+		"latest":     provenance[len(provenance)-1],
+		"provenance": provenance,
+	})
+}
+
+// GetOrderLatency возвращает перцентили задержки от date_created до записи в БД
+// за окно window (по умолчанию 1h)
+func (oc *Order) GetOrderLatency(ctx *fiber.Ctx) error {
+	window, err := time.ParseDuration(ctx.Query("window", defaultLatencyWindow.String()))
+	if err != nil || window <= 0 {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Некорректный параметр window",
+			"message": "Ожидается положительная длительность, например 15m или 24h",
+		})
+	}
+
+	stats, err := oc.orderRepo.LatencyStats(time.Now().Add(-window))
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+		"window":  window.String(),
+		"latency": stats,
+	})
+}
+
 // GetCacheStats возвращает статистику кеша
 func (oc *Order) GetCacheStats(ctx *fiber.Ctx) error {
 	stats := oc.cache.GetCacheStats()
@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"wb/internal/services"
+)
+
+type OutboxController struct {
+	relay *services.OutboxRelay
+}
+
+func NewOutboxController(relay *services.OutboxRelay) *OutboxController {
+	return &OutboxController{
+		relay: relay,
+	}
+}
+
+// GetOutboxBacklog возвращает очередь неопубликованных событий о заказах
+func (oc *OutboxController) GetOutboxBacklog(ctx *fiber.Ctx) error {
+	backlog, err := oc.relay.Backlog()
+	if err != nil {
+		log.Printf("Ошибка получения очереди outbox: %v", err)
+
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   true,
+			"message": "Ошибка получения очереди outbox: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":  false,
+		"outbox": backlog,
+	})
+}
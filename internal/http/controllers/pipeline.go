@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"wb/internal/services"
+)
+
+type PipelineController struct {
+	pipelines *services.PipelineService
+}
+
+func NewPipelineController(pipelines *services.PipelineService) *PipelineController {
+	return &PipelineController{
+		pipelines: pipelines,
+	}
+}
+
+// ListPipelines возвращает сохраненные конвейеры со счетчиками активных
+func (pc *PipelineController) ListPipelines(ctx *fiber.Ctx) error {
+	pipelines, err := pc.pipelines.List()
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":     false,
+		"count":     len(pipelines),
+		"pipelines": pipelines,
+	})
+}
+
+// GetPipeline возвращает конвейер топика
+func (pc *PipelineController) GetPipeline(ctx *fiber.Ctx) error {
+	pipeline, err := pc.pipelines.Get(ctx.Params("topic"))
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":    false,
+		"pipeline": pipeline,
+	})
+}
+
+// ApplyPipeline создает или заменяет конвейер топика. Новое определение вступает в силу
+// только целиком и только после сохранения в БД.
+func (pc *PipelineController) ApplyPipeline(ctx *fiber.Ctx) error {
+	var definition services.PipelineDefinition
+
+	if err := ctx.BodyParser(&definition); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Неверный формат запроса: " + err.Error(),
+		})
+	}
+
+	definition.Topic = ctx.Params("topic")
+
+	pipeline, err := pc.pipelines.Apply(definition)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidPipeline) {
+			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Некорректный конвейер: " + err.Error(),
+			})
+		}
+
+		log.Printf("Ошибка применения конвейера топика %s: %v", definition.Topic, err)
+
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":    false,
+		"message":  "Конвейер применен",
+		"pipeline": pipeline,
+	})
+}
+
+// DeletePipeline удаляет конвейер топика
+func (pc *PipelineController) DeletePipeline(ctx *fiber.Ctx) error {
+	topic := ctx.Params("topic")
+
+	if err := pc.pipelines.Delete(topic); err != nil {
+		if errors.Is(err, services.ErrPipelineNotFound) {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   true,
+				"message": "Конвейер для топика " + topic + " не найден",
+			})
+		}
+
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":   false,
+		"message": "Конвейер удален",
+		"topic":   topic,
+	})
+}
+
+// ReloadPipelines повторно применяет конвейеры из файла конфигурации
+func (pc *PipelineController) ReloadPipelines(ctx *fiber.Ctx) error {
+	if err := pc.pipelines.Reload(); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Конвейеры из файла не применены: " + err.Error(),
+		})
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":   false,
+		"message": "Конвейеры из файла применены",
+	})
+}
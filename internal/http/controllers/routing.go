@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"wb/internal/services"
+)
+
+type RoutingController struct {
+	router *services.OrderRouter
+}
+
+func NewRoutingController(router *services.OrderRouter) *RoutingController {
+	return &RoutingController{
+		router: router,
+	}
+}
+
+// dryRunRequest тело запроса пробного прогона: заказ и, необязательно, проверяемое правило
+type dryRunRequest struct {
+	Rule  *services.RoutingRuleDefinition `json:"rule"`
+	Order json.RawMessage                 `json:"order"`
+}
+
+// ListRules возвращает правила маршрутизации в порядке применения со счетчиками
+func (rc *RoutingController) ListRules(ctx *fiber.Ctx) error {
+	rules := rc.router.List()
+
+	return ctx.JSON(fiber.Map{
+		"error": false,
+		"count": len(rules),
+		"rules": rules,
+	})
+}
+
+// ApplyRule создает или заменяет правило маршрутизации
+func (rc *RoutingController) ApplyRule(ctx *fiber.Ctx) error {
+	var definition services.RoutingRuleDefinition
+
+	if err := ctx.BodyParser(&definition); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Неверный формат запроса: " + err.Error(),
+		})
+	}
+
+	definition.Name = ctx.Params("name")
+
+	rule, err := rc.router.Apply(definition)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidRoutingRule) {
+			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": "Некорректное правило: " + err.Error(),
+			})
+		}
+
+		log.Printf("Ошибка применения правила маршрутизации %s: %v", definition.Name, err)
+
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":   false,
+		"message": "Правило применено",
+		"rule":    rule,
+	})
+}
+
+// DeleteRule удаляет правило маршрутизации
+func (rc *RoutingController) DeleteRule(ctx *fiber.Ctx) error {
+	name := ctx.Params("name")
+
+	if err := rc.router.Delete(name); err != nil {
+		if errors.Is(err, services.ErrRoutingRuleNotFound) {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   true,
+				"message": "Правило " + name + " не найдено",
+			})
+		}
+
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":   false,
+		"message": "Правило удалено",
+		"name":    name,
+	})
+}
+
+// DryRun проверяет заказ правилом из запроса или всеми действующими правилами без публикации
+func (rc *RoutingController) DryRun(ctx *fiber.Ctx) error {
+	var request dryRunRequest
+
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Неверный формат запроса: " + err.Error(),
+		})
+	}
+
+	if len(request.Order) == 0 {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   true,
+			"message": "Поле order обязательно",
+		})
+	}
+
+	decisions, err := rc.router.DryRun(request.Rule, request.Order)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidRoutingRule) || errors.Is(err, services.ErrInvalidMessage) {
+			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   true,
+				"message": err.Error(),
+			})
+		}
+
+		return err
+	}
+
+	matched := make([]string, 0, len(decisions))
+	for _, decision := range decisions {
+		if decision.Matched {
+			matched = append(matched, decision.Topic)
+		}
+	}
+
+	return ctx.JSON(fiber.Map{
+		"error":     false,
+		"topics":    matched,
+		"decisions": decisions,
+	})
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+
+	"github.com/rotisserie/eris"
+)
+
+// Результат проверки бизнес-инвариантов заказа
+const (
+	ConsistencyConsistent   = "consistent"
+	ConsistencyInconsistent = "inconsistent"
+	ConsistencyCorrected    = "corrected"
+)
+
+// ConsistencyIssue нарушение бизнес-правила, найденное при приеме заказа
+type ConsistencyIssue struct {
+	Rule     string  `json:"rule"`
+	Field    string  `json:"field"`
+	Expected float64 `json:"expected"`
+	Actual   float64 `json:"actual"`
+	Message  string  `json:"message"`
+}
+
+// ConsistencyIssues список нарушений, хранится в БД как jsonb
+type ConsistencyIssues []ConsistencyIssue
+
+func (c ConsistencyIssues) Value() (driver.Value, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to marshal consistency issues")
+	}
+
+	return string(data), nil
+}
+
+func (c *ConsistencyIssues) Scan(value interface{}) error {
+	var data []byte
+
+	switch typed := value.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case []byte:
+		data = typed
+	case string:
+		data = []byte(typed)
+	default:
+		return eris.Errorf("unsupported consistency issues type %T", value)
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		return eris.Wrap(err, "failed to unmarshal consistency issues")
+	}
+
+	return nil
+}
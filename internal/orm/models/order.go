@@ -24,6 +24,20 @@ type Order struct {
 	UpdatedAt         time.Time      `json:"updated_at"`
 	DeletedAt         gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
 
+	// Версия заказа для разрешения конфликтов при повторной доставке и обновлениях
+	Version int64 `json:"version" gorm:"not null;default:0"`
+
+	// Идентификаторы цепочки из заголовков сообщения, которое последним изменило заказ
+	CorrelationID string `json:"correlation_id,omitempty" gorm:"size:100;index"`
+	TraceID       string `json:"trace_id,omitempty" gorm:"size:100"`
+
+	// Текущий статус жизненного цикла, меняется только по допустимым переходам
+	Status string `json:"status" gorm:"not null;size:20;default:created;index"`
+
+	// Результат проверки бизнес-инвариантов (суммы платежа и товаров)
+	ConsistencyStatus string            `json:"consistency_status" gorm:"not null;size:20;default:consistent;index"`
+	ConsistencyIssues ConsistencyIssues `json:"consistency_issues,omitempty" gorm:"type:jsonb"`
+
 	// Relations
 	Delivery *Delivery   `json:"delivery" gorm:"foreignKey:OrderID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 	Payment  *Payment    `json:"payment" gorm:"foreignKey:OrderID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+// Части заказа, которые публикуются в отдельные топики
+const (
+	FragmentPartOrder    = "order"
+	FragmentPartPayment  = "payment"
+	FragmentPartDelivery = "delivery"
+)
+
+// Итоги сборки заказа
+const (
+	AssemblyOutcomeAssembled = "assembled"
+	AssemblyOutcomeExpired   = "expired"
+)
+
+// OrderFragment часть заказа, ожидающая остальные части. Части одного заказа связаны
+// ключом сборки (order_uid); повторная часть того же вида заменяет прежнюю.
+type OrderFragment struct {
+	ID          uint   `json:"id" gorm:"primaryKey;autoIncrement;type:bigint"`
+	AssemblyKey string `json:"assembly_key" gorm:"not null;size:100;uniqueIndex:idx_order_fragments_key_part"`
+	Part        string `json:"part" gorm:"not null;size:20;uniqueIndex:idx_order_fragments_key_part"`
+	Payload     string `json:"payload" gorm:"type:jsonb;not null"`
+
+	// Координаты и заголовки сообщения, из которого пришла часть
+	Topic         string    `json:"topic" gorm:"not null;size:255"`
+	Partition     int32     `json:"partition" gorm:"not null"`
+	Offset        int64     `json:"offset" gorm:"not null"`
+	MessageKey    string    `json:"message_key" gorm:"size:255"`
+	Headers       string    `json:"headers" gorm:"type:jsonb"`
+	Timestamp     time.Time `json:"timestamp"`
+	CorrelationID string    `json:"correlation_id,omitempty" gorm:"size:100"`
+	TraceID       string    `json:"trace_id,omitempty" gorm:"size:100"`
+
+	// CreatedAt время получения первой версии части: от него отсчитывается ожидание сборки
+	CreatedAt time.Time `json:"created_at" gorm:"not null;index"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (OrderFragment) TableName() string {
+	return "order_fragments"
+}
+
+// OrderAssembly отметка о завершенной сборке: заказ собран или сборка просрочена.
+// Части, пришедшие после этого (опоздавшие или доставленные повторно), отбрасываются
+// по отметке, иначе они открыли бы сборку, которая никогда не завершится.
+type OrderAssembly struct {
+	AssemblyKey string    `json:"assembly_key" gorm:"primaryKey;size:100"`
+	Outcome     string    `json:"outcome" gorm:"not null;size:20"`
+	CompletedAt time.Time `json:"completed_at" gorm:"not null;index"`
+}
+
+func (OrderAssembly) TableName() string {
+	return "order_assemblies"
+}
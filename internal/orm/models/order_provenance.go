@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+// OrderProvenance происхождение сохраненной версии заказа: сообщение Kafka, из которого
+// она пришла, и время прохождения от создания заказа до записи в БД
+type OrderProvenance struct {
+	ID              uint       `json:"id" gorm:"primaryKey;autoIncrement;type:bigint"`
+	OrderID         uint       `json:"order_id" gorm:"not null;index;type:bigint"`
+	OrderUID        string     `json:"order_uid" gorm:"not null;size:100;index"`
+	Result          string     `json:"result" gorm:"not null;size:20"`
+	Topic           string     `json:"topic" gorm:"not null;size:255"`
+	Partition       int32      `json:"partition" gorm:"not null"`
+	Offset          int64      `json:"offset" gorm:"not null"`
+	MessageKey      string     `json:"message_key" gorm:"size:255"`
+	BrokerTimestamp *time.Time `json:"broker_timestamp,omitempty"`
+	CorrelationID   string     `json:"correlation_id,omitempty" gorm:"size:100"`
+	TraceID         string     `json:"trace_id,omitempty" gorm:"size:100"`
+
+	// ReceivedAt момент получения сообщения consumer'ом, PersistedAt — записи в БД
+	ReceivedAt  time.Time `json:"received_at" gorm:"not null"`
+	PersistedAt time.Time `json:"persisted_at" gorm:"not null;index"`
+
+	// Длительности в миллисекундах: обработка сообщения и путь от date_created заказа до записи
+	ProcessingMs int64 `json:"processing_ms" gorm:"not null"`
+	EndToEndMs   int64 `json:"end_to_end_ms" gorm:"not null"`
+
+	Order *Order `json:"-" gorm:"foreignKey:OrderID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+}
+
+func (OrderProvenance) TableName() string {
+	return "order_provenance"
+}
+
+// NewOrderProvenance описывает запись заказа из сообщения source с результатом result
+func NewOrderProvenance(order *Order, source *MessageSource, result string, persistedAt time.Time) *OrderProvenance {
+	provenance := &OrderProvenance{
+		OrderID:       order.ID,
+		OrderUID:      order.OrderUID,
+		Result:        result,
+		Topic:         source.Topic,
+		Partition:     source.Partition,
+		Offset:        source.Offset,
+		MessageKey:    source.Key,
+		CorrelationID: source.CorrelationID,
+		TraceID:       source.TraceID,
+		ReceivedAt:    source.ReceivedAt,
+		PersistedAt:   persistedAt,
+	}
+
+	if !source.Timestamp.IsZero() {
+		timestamp := source.Timestamp
+		provenance.BrokerTimestamp = &timestamp
+	}
+
+	if !source.ReceivedAt.IsZero() {
+		provenance.ProcessingMs = persistedAt.Sub(source.ReceivedAt).Milliseconds()
+	} else {
+		provenance.ReceivedAt = persistedAt
+	}
+
+	if !order.DateCreated.IsZero() {
+		provenance.EndToEndMs = persistedAt.Sub(order.DateCreated).Milliseconds()
+	}
+
+	return provenance
+}
@@ -0,0 +1,80 @@
+package models
+
+import "time"
+
+// Статусы жизненного цикла заказа
+const (
+	OrderStatusCreated   = "created"
+	OrderStatusPaid      = "paid"
+	OrderStatusAssembled = "assembled"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusReturned  = "returned"
+)
+
+// orderStatusTransitions допустимые переходы между статусами.
+// Отменить можно заказ до отгрузки, вернуть — уже отгруженный или доставленный.
+var orderStatusTransitions = map[string][]string{
+	OrderStatusCreated:   {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:      {OrderStatusAssembled, OrderStatusCancelled},
+	OrderStatusAssembled: {OrderStatusShipped, OrderStatusCancelled},
+	OrderStatusShipped:   {OrderStatusDelivered, OrderStatusReturned},
+	OrderStatusDelivered: {OrderStatusReturned},
+	OrderStatusCancelled: {},
+	OrderStatusReturned:  {},
+}
+
+// IsValidOrderStatus проверяет, что статус известен
+func IsValidOrderStatus(status string) bool {
+	_, ok := orderStatusTransitions[status]
+	return ok
+}
+
+// CanTransitionOrderStatus проверяет, разрешен ли переход из статуса from в статус to
+func CanTransitionOrderStatus(from, to string) bool {
+	for _, allowed := range orderStatusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OrderStatusHistory запись о смене статуса заказа вместе с сообщением, которое ее вызвало
+type OrderStatusHistory struct {
+	ID         uint      `json:"id" gorm:"primaryKey;autoIncrement;type:bigint"`
+	OrderID    uint      `json:"order_id" gorm:"not null;index;type:bigint"`
+	OrderUID   string    `json:"order_uid" gorm:"not null;size:100;index"`
+	FromStatus string    `json:"from_status" gorm:"size:20"`
+	ToStatus   string    `json:"to_status" gorm:"not null;size:20"`
+	Topic      string    `json:"topic,omitempty" gorm:"size:255"`
+	Partition  *int32    `json:"partition,omitempty"`
+	Offset     *int64    `json:"offset,omitempty"`
+	ChangedAt  time.Time `json:"changed_at" gorm:"not null"`
+
+	CorrelationID string `json:"correlation_id,omitempty" gorm:"size:100;index"`
+}
+
+func (OrderStatusHistory) TableName() string {
+	return "order_status_history"
+}
+
+// MessageSource координаты сообщения Kafka, из которого пришли данные заказа
+type MessageSource struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+
+	CorrelationID string
+	TraceID       string
+
+	// Ключ и время сообщения у брокера, момент получения consumer'ом
+	Key        string
+	Timestamp  time.Time
+	ReceivedAt time.Time
+
+	// Правило маршрутизации, по которому сообщение опубликовал сам сервис
+	RoutingRule string
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// Типы событий жизненного цикла заказа, публикуемых через outbox
+const (
+	OrderEventPersisted     = "order.persisted"
+	OrderEventStatusChanged = "order.status_changed"
+
+	// OrderEventRouted копия заказа для топика правила маршрутизации: событие пишется
+	// на каждое совпавшее правило и публикуется в Topic, а не в топик событий
+	OrderEventRouted = "order.routed"
+)
+
+// Типы готовых сообщений, которые relay публикует в топик события как есть
+const (
+	OutboxMessageAssemblyAlert      = "assembly.alert"
+	OutboxMessageAssemblyDeadLetter = "assembly.dead_letter"
+)
+
+// OutboxEvent событие, записанное в одной транзакции с изменением заказа.
+// Relay захватывает события в порядке ID, публикует и отмечает отправленные.
+type OutboxEvent struct {
+	ID            uint       `json:"id" gorm:"primaryKey;autoIncrement;type:bigint"`
+	EventType     string     `json:"event_type" gorm:"not null;size:50"`
+	AggregateID   string     `json:"aggregate_id" gorm:"not null;size:100;index"`
+	Payload       string     `json:"payload" gorm:"type:jsonb;not null"`
+	Attempts      int        `json:"attempts" gorm:"not null;default:0"`
+	LastError     string     `json:"last_error,omitempty" gorm:"type:text"`
+	CreatedAt     time.Time  `json:"created_at" gorm:"not null"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"not null"`
+	SentAt        *time.Time `json:"sent_at,omitempty" gorm:"index"`
+
+	// До этого момента событие захвачено relay одного из экземпляров сервиса
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+
+	// Correlation и trace ID сообщения, изменившего заказ: relay передает их в заголовках события
+	CorrelationID string `json:"correlation_id,omitempty" gorm:"size:100"`
+	TraceID       string `json:"trace_id,omitempty" gorm:"size:100"`
+
+	// Топик, ключ и заголовки (JSON-объект) готового сообщения: такое событие публикуется
+	// в Topic вместо топика событий
+	Topic      string `json:"topic,omitempty" gorm:"size:255"`
+	MessageKey string `json:"message_key,omitempty" gorm:"size:255"`
+	Headers    string `json:"headers,omitempty" gorm:"type:text"`
+}
+
+func (OutboxEvent) TableName() string {
+	return "outbox_events"
+}
+
+// OrderEvent тело события о заказе
+type OrderEvent struct {
+	EventType  string    `json:"event_type"`
+	OrderUID   string    `json:"order_uid"`
+	Status     string    `json:"status"`
+	Version    int64     `json:"version"`
+	FromStatus string    `json:"from_status,omitempty"`
+	Result     string    `json:"result,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Order      *Order    `json:"order,omitempty"`
+
+	CorrelationID string `json:"correlation_id,omitempty"`
+	TraceID       string `json:"trace_id,omitempty"`
+
+	// Правило маршрутизации, копию заказа по которому сохранило событие: такой заказ
+	// повторно не маршрутизируется. В событии order.routed правило, по которому публикуется копия
+	RoutingRule string `json:"routing_rule,omitempty"`
+
+	// Топик назначения копии заказа в событии order.routed
+	Topic string `json:"topic,omitempty"`
+}
+
+// NewMessageOutboxEvent записывает в outbox готовое сообщение для топика topic.
+// aggregateID связывает событие с заказом или сборкой, к которой оно относится.
+func NewMessageOutboxEvent(
+	eventType, aggregateID, topic, key string,
+	payload []byte,
+	headers map[string]string,
+) (*OutboxEvent, error) {
+	encodedHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to marshal headers of %s event", eventType)
+	}
+
+	now := time.Now()
+
+	return &OutboxEvent{
+		EventType:     eventType,
+		AggregateID:   aggregateID,
+		Payload:       string(payload),
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		Topic:         topic,
+		MessageKey:    key,
+		Headers:       string(encodedHeaders),
+	}, nil
+}
+
+// NewOrderOutboxEvent сериализует событие о заказе в запись outbox
+func NewOrderOutboxEvent(event OrderEvent) (*OutboxEvent, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to marshal %s event", event.EventType)
+	}
+
+	return &OutboxEvent{
+		EventType:     event.EventType,
+		AggregateID:   event.OrderUID,
+		Payload:       string(payload),
+		CreatedAt:     event.OccurredAt,
+		NextAttemptAt: event.OccurredAt,
+		CorrelationID: event.CorrelationID,
+		TraceID:       event.TraceID,
+	}, nil
+}
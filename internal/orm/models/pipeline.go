@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Источники определения конвейера
+const (
+	PipelineSourceAPI  = "api"
+	PipelineSourceFile = "file"
+)
+
+// Pipeline сохраненный конвейер обработки сообщений топика. Стадии хранятся в JSON
+// в том виде, в каком пришли из API или файла конфигурации. Удаленный конвейер остается
+// записью с DeletedAt, чтобы файл конфигурации не вернул его при следующем запуске.
+type Pipeline struct {
+	ID          uint      `json:"id" gorm:"primaryKey;autoIncrement;type:bigint"`
+	Topic       string    `json:"topic" gorm:"not null;size:255;uniqueIndex"`
+	Description string    `json:"description" gorm:"type:text"`
+	Stages      string    `json:"stages" gorm:"type:jsonb;not null"`
+	Source      string    `json:"source" gorm:"not null;size:20"`
+	Version     int64     `json:"version" gorm:"not null;default:1"`
+	CreatedAt   time.Time `json:"created_at" gorm:"not null"`
+	UpdatedAt   time.Time `json:"updated_at" gorm:"not null"`
+
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func (Pipeline) TableName() string {
+	return "pipelines"
+}
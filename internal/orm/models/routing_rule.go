@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// RoutingRule сохраненное правило маршрутизации заказов в топики. Условие хранится в JSON
+// в том виде, в каком пришло из API.
+type RoutingRule struct {
+	ID          uint      `json:"id" gorm:"primaryKey;autoIncrement;type:bigint"`
+	Name        string    `json:"name" gorm:"not null;size:100;uniqueIndex"`
+	Description string    `json:"description" gorm:"type:text"`
+	Topic       string    `json:"topic" gorm:"not null;size:255"`
+	Priority    int       `json:"priority" gorm:"not null;default:0"`
+	Stop        bool      `json:"stop" gorm:"not null;default:false"`
+	Disabled    bool      `json:"disabled" gorm:"not null;default:false"`
+	Condition   string    `json:"condition" gorm:"type:jsonb;not null"`
+	Version     int64     `json:"version" gorm:"not null;default:1"`
+	CreatedAt   time.Time `json:"created_at" gorm:"not null"`
+	UpdatedAt   time.Time `json:"updated_at" gorm:"not null"`
+}
+
+func (RoutingRule) TableName() string {
+	return "routing_rules"
+}
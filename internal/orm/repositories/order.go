@@ -1,12 +1,59 @@
 package repositories
 
 import (
+	"errors"
 	"log"
+	"time"
 
 	"wb/internal/orm/models"
 
 	"github.com/rotisserie/eris"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrOrderAlreadyExists заказ с таким order_uid уже сохранен
+var ErrOrderAlreadyExists = errors.New("order already exists")
+
+// batchInsertSize максимальное число строк в одном многострочном INSERT
+const batchInsertSize = 500
+
+// ErrIllegalStatusTransition входящий статус недостижим из текущего статуса заказа
+var ErrIllegalStatusTransition = errors.New("illegal order status transition")
+
+// Политики разрешения конфликта при повторном заказе с тем же order_uid
+const (
+	// ConflictFirstWins сохраненный заказ не меняется
+	ConflictFirstWins = "first-wins"
+	// ConflictLastWins последний пришедший заказ заменяет сохраненный
+	ConflictLastWins = "last-wins"
+	// ConflictHighestVersionWins заказ заменяется только более новой версией
+	ConflictHighestVersionWins = "highest-version-wins"
+)
+
+// LatencyStats перцентили задержек по записям order_provenance, в миллисекундах
+type LatencyStats struct {
+	Since           time.Time `json:"since"`
+	Count           int64     `json:"count"`
+	EndToEndP50Ms   float64   `json:"end_to_end_p50_ms"`
+	EndToEndP95Ms   float64   `json:"end_to_end_p95_ms"`
+	EndToEndP99Ms   float64   `json:"end_to_end_p99_ms"`
+	EndToEndMaxMs   int64     `json:"end_to_end_max_ms"`
+	ProcessingP50Ms float64   `json:"processing_p50_ms"`
+	ProcessingP95Ms float64   `json:"processing_p95_ms"`
+	ProcessingP99Ms float64   `json:"processing_p99_ms"`
+	ProcessingMaxMs int64     `json:"processing_max_ms"`
+}
+
+// UpsertResult результат сохранения заказа
+type UpsertResult string
+
+const (
+	UpsertCreated UpsertResult = "created"
+	UpsertUpdated UpsertResult = "updated"
+	UpsertSkipped UpsertResult = "skipped"
+	// UpsertStatusOnly политика сохранила прежние данные заказа, изменился только статус
+	UpsertStatusOnly UpsertResult = "status_only"
 )
 
 // OrderRepository репозиторий для работы с заказами
@@ -50,7 +97,9 @@ func (r *OrderRepository) ListAll() ([]models.Order, error) {
 	return orders, nil
 }
 
-// CreateWithRelations создает заказ со всеми связанными данными
+// CreateWithRelations создает заказ со всеми связанными данными.
+// Вставка идемпотентна: если заказ с таким order_uid уже есть, ничего не меняется
+// и возвращается ErrOrderAlreadyExists, поэтому повторная доставка сообщения безопасна.
 func (r *OrderRepository) CreateWithRelations(order *models.Order) error {
 	log.Printf("Начинаем создание заказа с UID: %s", order.OrderUID)
 
@@ -63,20 +112,527 @@ func (r *OrderRepository) CreateWithRelations(order *models.Order) error {
 		}
 	}()
 
+	if err := r.createOrder(tx, order, nil); err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Ошибка коммита транзакции: %v", err)
+		return eris.Wrap(err, err.Error())
+	}
+
+	log.Printf("Заказ успешно создан и сохранен в базе данных")
+
+	return nil
+}
+
+// UpsertWithRelations сохраняет заказ с учетом политики разрешения конфликтов по order_uid.
+// Новый заказ создается, существующий обновляется вместе с заменой доставки, платежа
+// и товаров в одной транзакции либо остается без изменений, если политика так решила.
+// Смена статуса проверяется по допустимым переходам и записывается в историю вместе
+// с координатами сообщения source (nil, если заказ пришел не из Kafka).
+func (r *OrderRepository) UpsertWithRelations(
+	order *models.Order,
+	policy string,
+	source *models.MessageSource,
+) (UpsertResult, error) {
+	log.Printf("Начинаем сохранение заказа с UID: %s (политика: %s)", order.OrderUID, policy)
+
+	tx := r.db.Begin()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Паника при сохранении заказа: %v", r)
+			tx.Rollback()
+		}
+	}()
+
+	result, err := r.upsert(tx, order, policy, source)
+	if err != nil || result == UpsertSkipped {
+		tx.Rollback()
+
+		return UpsertSkipped, err
+	}
+
+	return r.commit(tx, order, result)
+}
+
+// UpsertWithRelationsTx сохраняет заказ так же, как UpsertWithRelations, но в транзакции tx
+// вызывающего: заказ фиксируется вместе с его изменениями. При ошибке tx нужно откатить.
+func (r *OrderRepository) UpsertWithRelationsTx(
+	tx *gorm.DB,
+	order *models.Order,
+	policy string,
+	source *models.MessageSource,
+) (UpsertResult, error) {
+	log.Printf("Сохранение заказа с UID: %s в транзакции вызывающего (политика: %s)", order.OrderUID, policy)
+
+	return r.upsert(tx, order, policy, source)
+}
+
+// upsert выполняет UpsertWithRelations в транзакции tx, не фиксируя и не откатывая ее
+func (r *OrderRepository) upsert(
+	tx *gorm.DB,
+	order *models.Order,
+	policy string,
+	source *models.MessageSource,
+) (UpsertResult, error) {
+	// Блокируем существующую строку, чтобы параллельные обновления не перетерли друг друга
+	var existing models.Order
+
+	err := tx.Unscoped().
+		Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where("order_uid = ?", order.OrderUID).
+		Limit(1).
+		Find(&existing).Error
+	if err != nil {
+		return UpsertSkipped, eris.Wrap(err, err.Error())
+	}
+
+	if existing.ID == 0 {
+		// Если параллельная транзакция успела вставить заказ, вернется ErrOrderAlreadyExists,
+		// и повторная обработка применит политику к уже сохраненной строке
+		if err := r.createOrder(tx, order, source); err != nil {
+			return UpsertSkipped, err
+		}
+
+		return UpsertCreated, nil
+	}
+
+	allowed := policyAllowsUpdate(policy, &existing, order)
+
+	// Устаревшая версия не меняет ни данные, ни статус, даже если переход был бы недопустим
+	if !allowed && policy != ConflictFirstWins {
+		log.Printf("Заказ %s уже сохранен (версия %d), входящая версия %d пропущена по политике %s",
+			order.OrderUID, existing.Version, order.Version, policy)
+
+		return UpsertSkipped, nil
+	}
+
+	status := order.Status
+	if status == "" {
+		status = existing.Status
+	}
+
+	statusChanged := status != existing.Status
+	if statusChanged && !models.CanTransitionOrderStatus(existing.Status, status) {
+		return UpsertSkipped, eris.Wrapf(ErrIllegalStatusTransition, "order %s: %s -> %s",
+			order.OrderUID, existing.Status, status)
+	}
+
+	result := UpsertUpdated
+
+	switch {
+	case allowed:
+		order.Status = status
+		err = r.replaceOrder(tx, &existing, order)
+	case statusChanged:
+		// Политика сохраняет прежние данные заказа, но статус жизненного цикла все равно меняется
+		result = UpsertStatusOnly
+		err = r.updateStatusOnly(tx, &existing, order, status)
+	default:
+		log.Printf("Заказ %s уже сохранен (версия %d), входящая версия %d пропущена по политике %s",
+			order.OrderUID, existing.Version, order.Version, policy)
+
+		return UpsertSkipped, nil
+	}
+
+	if err == nil && statusChanged {
+		err = r.recordStatusChange(tx, order.ID, order.OrderUID, existing.Status, status, source)
+	}
+
+	if err == nil && allowed {
+		err = enqueueOrderEvent(tx, orderPersistedEvent(order, source, UpsertUpdated))
+	}
+
+	if err == nil && statusChanged {
+		err = enqueueOrderEvent(tx, orderStatusChangedEvent(order, existing.Status))
+	}
+
+	if err == nil {
+		err = r.recordProvenance(tx, order, source, result)
+	}
+
+	if err != nil {
+		return UpsertSkipped, err
+	}
+
+	return result, nil
+}
+
+func (r *OrderRepository) commit(tx *gorm.DB, order *models.Order, result UpsertResult) (UpsertResult, error) {
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Ошибка коммита транзакции: %v", err)
+		return UpsertSkipped, eris.Wrap(err, err.Error())
+	}
+
+	log.Printf("Заказ %s сохранен: %s, статус: %s", order.OrderUID, result, order.Status)
+
+	return result, nil
+}
+
+// ExistingOrderUIDs возвращает те из переданных order_uid, что уже сохранены в БД
+func (r *OrderRepository) ExistingOrderUIDs(orderUIDs []string) (map[string]bool, error) {
+	existing := make(map[string]bool, len(orderUIDs))
+	if len(orderUIDs) == 0 {
+		return existing, nil
+	}
+
+	var found []string
+	if err := r.db.Unscoped().Model(&models.Order{}).
+		Where("order_uid IN ?", orderUIDs).
+		Pluck("order_uid", &found).Error; err != nil {
+		return nil, eris.Wrap(err, "ошибка при поиске сохраненных заказов")
+	}
+
+	for _, orderUID := range found {
+		existing[orderUID] = true
+	}
+
+	return existing, nil
+}
+
+// CreateBatchWithRelationsTx вставляет новые заказы многострочными INSERT в транзакции tx
+// вызывающего. Если хотя бы один order_uid уже сохранен, возвращается ErrOrderAlreadyExists:
+// такие заказы должны идти через UpsertWithRelations. При ошибке tx нужно откатить.
+// sources содержит координаты сообщений в том же порядке, что и orders.
+func (r *OrderRepository) CreateBatchWithRelationsTx(
+	tx *gorm.DB,
+	orders []*models.Order,
+	sources []*models.MessageSource,
+) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	log.Printf("Пакетное создание %d заказов в транзакции вызывающего", len(orders))
+
+	return r.createBatch(tx, orders, sources)
+}
+
+func (r *OrderRepository) createBatch(tx *gorm.DB, orders []*models.Order, sources []*models.MessageSource) error {
+	for _, order := range orders {
+		order.ID = 0
+		if order.Status == "" {
+			order.Status = models.OrderStatusCreated
+		}
+	}
+
+	result := tx.Omit(clause.Associations).
+		Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "order_uid"}}, DoNothing: true}).
+		CreateInBatches(orders, batchInsertSize)
+	if err := result.Error; err != nil {
+		log.Printf("Ошибка пакетного создания заказов: %v", err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	if result.RowsAffected != int64(len(orders)) {
+		return eris.Wrapf(ErrOrderAlreadyExists, "%d of %d orders already exist",
+			int64(len(orders))-result.RowsAffected, len(orders))
+	}
+
+	var (
+		deliveries []*models.Delivery
+		payments   []*models.Payment
+		items      []*models.OrderItem
+		history    []*models.OrderStatusHistory
+		provenance []*models.OrderProvenance
+	)
+
+	now := time.Now()
+
+	for i, order := range orders {
+		if order.Delivery != nil {
+			order.Delivery.ID = 0
+			order.Delivery.OrderID = order.ID
+			deliveries = append(deliveries, order.Delivery)
+		}
+
+		if order.Payment != nil {
+			order.Payment.ID = 0
+			order.Payment.OrderID = order.ID
+			payments = append(payments, order.Payment)
+		}
+
+		for j := range order.Items {
+			order.Items[j].ID = 0
+			order.Items[j].OrderID = order.ID
+			items = append(items, &order.Items[j])
+		}
+
+		entry := &models.OrderStatusHistory{
+			OrderID:   order.ID,
+			OrderUID:  order.OrderUID,
+			ToStatus:  order.Status,
+			ChangedAt: now,
+		}
+
+		if i < len(sources) && sources[i] != nil {
+			entry.Topic = sources[i].Topic
+			entry.Partition = &sources[i].Partition
+			entry.Offset = &sources[i].Offset
+			entry.CorrelationID = sources[i].CorrelationID
+
+			provenance = append(provenance, models.NewOrderProvenance(order, sources[i], string(UpsertCreated), now))
+		}
+
+		history = append(history, entry)
+	}
+
+	for _, rows := range []interface{}{deliveries, payments, items, history, provenance} {
+		if err := tx.CreateInBatches(rows, batchInsertSize).Error; err != nil {
+			log.Printf("Ошибка пакетного создания связанных данных: %v", err)
+
+			return eris.Wrap(err, err.Error())
+		}
+	}
+
+	// События формируются после вставки связей, чтобы в них попали присвоенные ID
+	events := make([]*models.OutboxEvent, 0, len(orders))
+
+	for i, order := range orders {
+		var source *models.MessageSource
+		if i < len(sources) {
+			source = sources[i]
+		}
+
+		event := orderPersistedEvent(order, source, UpsertCreated)
+		event.OccurredAt = now
+
+		row, err := models.NewOrderOutboxEvent(event)
+		if err != nil {
+			return err
+		}
+
+		events = append(events, row)
+	}
+
+	if err := tx.CreateInBatches(events, batchInsertSize).Error; err != nil {
+		log.Printf("Ошибка пакетной записи событий в outbox: %v", err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	return nil
+}
+
+// policyAllowsUpdate решает, должен ли входящий заказ заменить уже сохраненный
+func policyAllowsUpdate(policy string, existing, incoming *models.Order) bool {
+	switch policy {
+	case ConflictFirstWins:
+		return false
+	case ConflictLastWins:
+		return true
+	default:
+		return incoming.Version > existing.Version
+	}
+}
+
+// createOrder вставляет заказ и связанные данные в рамках транзакции
+func (r *OrderRepository) createOrder(tx *gorm.DB, order *models.Order, source *models.MessageSource) error {
 	// Сбрасываем ID для основного заказа, чтобы использовать автоинкремент
 	order.ID = 0
 	log.Printf("Сброшен ID основного заказа, теперь ID = %d", order.ID)
 
-	// Создаем основной заказ
-	if err := tx.Create(order).Error; err != nil {
+	// Заказ без статуса считается только что созданным
+	if order.Status == "" {
+		order.Status = models.OrderStatusCreated
+	}
+
+	// Создаем основной заказ. Связи создаются ниже явно, поэтому gorm их не трогает
+	result := tx.Omit(clause.Associations).
+		Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "order_uid"}}, DoNothing: true}).
+		Create(order)
+	if err := result.Error; err != nil {
 		log.Printf("Ошибка создания основного заказа: %v", err)
-		tx.Rollback()
 
 		return eris.Wrap(err, err.Error())
 	}
 
+	if result.RowsAffected == 0 {
+		log.Printf("Заказ с UID %s уже существует, повторная вставка пропущена", order.OrderUID)
+
+		return eris.Wrapf(ErrOrderAlreadyExists, "order_uid: %s", order.OrderUID)
+	}
+
 	log.Printf("Основной заказ создан с ID: %d", order.ID)
 
+	if err := r.recordStatusChange(tx, order.ID, order.OrderUID, "", order.Status, source); err != nil {
+		return err
+	}
+
+	if err := r.createRelations(tx, order); err != nil {
+		return err
+	}
+
+	if err := r.recordProvenance(tx, order, source, UpsertCreated); err != nil {
+		return err
+	}
+
+	// Событие пишется в той же транзакции: оно опубликуется, только если заказ сохранен
+	return enqueueOrderEvent(tx, orderPersistedEvent(order, source, UpsertCreated))
+}
+
+// replaceOrder обновляет существующий заказ и полностью заменяет его связанные данные
+func (r *OrderRepository) replaceOrder(tx *gorm.DB, existing, order *models.Order) error {
+	order.ID = existing.ID
+	order.CreatedAt = existing.CreatedAt
+	order.DeletedAt = gorm.DeletedAt{}
+
+	if err := tx.Unscoped().Omit(clause.Associations).Save(order).Error; err != nil {
+		log.Printf("Ошибка обновления заказа: %v", err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	for _, relation := range []interface{}{&models.Delivery{}, &models.Payment{}, &models.OrderItem{}} {
+		if err := tx.Where("order_id = ?", order.ID).Delete(relation).Error; err != nil {
+			log.Printf("Ошибка удаления связанных данных заказа: %v", err)
+
+			return eris.Wrap(err, err.Error())
+		}
+	}
+
+	log.Printf("Основной заказ с ID %d обновлен, связанные данные будут пересозданы", order.ID)
+
+	return r.createRelations(tx, order)
+}
+
+// updateStatusOnly меняет только статус сохраненного заказа и подменяет order его актуальной
+// версией из БД, чтобы кеш получил именно то, что сохранено
+func (r *OrderRepository) updateStatusOnly(tx *gorm.DB, existing, order *models.Order, status string) error {
+	err := tx.Unscoped().Model(&models.Order{}).
+		Where("id = ?", existing.ID).
+		Updates(map[string]interface{}{"status": status, "updated_at": time.Now()}).Error
+	if err != nil {
+		log.Printf("Ошибка обновления статуса заказа: %v", err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	var stored models.Order
+
+	err = tx.Unscoped().Preload("Delivery").
+		Preload("Payment").
+		Preload("Items").
+		Where("id = ?", existing.ID).
+		First(&stored).Error
+	if err != nil {
+		return eris.Wrap(err, err.Error())
+	}
+
+	*order = stored
+
+	return nil
+}
+
+// recordStatusChange добавляет запись в историю статусов заказа
+func (r *OrderRepository) recordStatusChange(
+	tx *gorm.DB,
+	orderID uint,
+	orderUID, from, to string,
+	source *models.MessageSource,
+) error {
+	entry := models.OrderStatusHistory{
+		OrderID:    orderID,
+		OrderUID:   orderUID,
+		FromStatus: from,
+		ToStatus:   to,
+		ChangedAt:  time.Now(),
+	}
+
+	if source != nil {
+		entry.Topic = source.Topic
+		entry.Partition = &source.Partition
+		entry.Offset = &source.Offset
+		entry.CorrelationID = source.CorrelationID
+	}
+
+	if err := tx.Create(&entry).Error; err != nil {
+		log.Printf("Ошибка записи истории статусов: %v", err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	return nil
+}
+
+// GetStatusHistory возвращает историю статусов заказа в хронологическом порядке
+func (r *OrderRepository) GetStatusHistory(orderUID string) ([]models.OrderStatusHistory, error) {
+	var history []models.OrderStatusHistory
+	if err := r.db.Where("order_uid = ?", orderUID).
+		Order("changed_at, id").
+		Find(&history).Error; err != nil {
+		return nil, eris.Wrap(err, "ошибка при получении истории статусов")
+	}
+
+	return history, nil
+}
+
+// recordProvenance записывает, из какого сообщения Kafka пришла сохраненная версия заказа.
+// Для заказов не из Kafka (source == nil) запись не создается.
+func (r *OrderRepository) recordProvenance(
+	tx *gorm.DB,
+	order *models.Order,
+	source *models.MessageSource,
+	result UpsertResult,
+) error {
+	if source == nil {
+		return nil
+	}
+
+	provenance := models.NewOrderProvenance(order, source, string(result), time.Now())
+
+	if err := tx.Create(provenance).Error; err != nil {
+		log.Printf("Ошибка записи происхождения заказа: %v", err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	return nil
+}
+
+// GetProvenance возвращает происхождение всех сохраненных версий заказа в хронологическом порядке
+func (r *OrderRepository) GetProvenance(orderUID string) ([]models.OrderProvenance, error) {
+	var provenance []models.OrderProvenance
+	if err := r.db.Where("order_uid = ?", orderUID).
+		Order("persisted_at, id").
+		Find(&provenance).Error; err != nil {
+		return nil, eris.Wrap(err, "ошибка при получении происхождения заказа")
+	}
+
+	return provenance, nil
+}
+
+// LatencyStats возвращает перцентили задержки от date_created заказа до записи в БД
+// и длительности обработки сообщений, сохраненных после since
+func (r *OrderRepository) LatencyStats(since time.Time) (*LatencyStats, error) {
+	stats := &LatencyStats{Since: since}
+
+	err := r.db.Model(&models.OrderProvenance{}).
+		Select(`COUNT(*) AS count,
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY end_to_end_ms), 0) AS end_to_end_p50_ms,
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY end_to_end_ms), 0) AS end_to_end_p95_ms,
+			COALESCE(percentile_cont(0.99) WITHIN GROUP (ORDER BY end_to_end_ms), 0) AS end_to_end_p99_ms,
+			COALESCE(MAX(end_to_end_ms), 0) AS end_to_end_max_ms,
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY processing_ms), 0) AS processing_p50_ms,
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY processing_ms), 0) AS processing_p95_ms,
+			COALESCE(percentile_cont(0.99) WITHIN GROUP (ORDER BY processing_ms), 0) AS processing_p99_ms,
+			COALESCE(MAX(processing_ms), 0) AS processing_max_ms`).
+		Where("persisted_at >= ?", since).
+		Scan(stats).Error
+	if err != nil {
+		return nil, eris.Wrap(err, "ошибка при расчете задержек обработки заказов")
+	}
+
+	return stats, nil
+}
+
+// createRelations создает доставку, платеж и товары заказа
+func (r *OrderRepository) createRelations(tx *gorm.DB, order *models.Order) error {
 	if order.Delivery != nil {
 		// Сбрасываем ID для доставки, чтобы использовать автоинкремент
 		order.Delivery.ID = 0
@@ -85,7 +641,6 @@ func (r *OrderRepository) CreateWithRelations(order *models.Order) error {
 
 		if err := tx.Create(order.Delivery).Error; err != nil {
 			log.Printf("Ошибка создания доставки: %v", err)
-			tx.Rollback()
 
 			return eris.Wrap(err, err.Error())
 		}
@@ -101,7 +656,6 @@ func (r *OrderRepository) CreateWithRelations(order *models.Order) error {
 
 		if err := tx.Create(order.Payment).Error; err != nil {
 			log.Printf("Ошибка создания платежа: %v", err)
-			tx.Rollback()
 
 			return eris.Wrap(err, err.Error())
 		}
@@ -119,7 +673,6 @@ func (r *OrderRepository) CreateWithRelations(order *models.Order) error {
 			order.Items[i].OrderID = order.ID
 			if err := tx.Create(&order.Items[i]).Error; err != nil {
 				log.Printf("Ошибка создания товара %d: %v", i+1, err)
-				tx.Rollback()
 
 				return eris.Wrap(err, err.Error())
 			}
@@ -128,13 +681,6 @@ func (r *OrderRepository) CreateWithRelations(order *models.Order) error {
 		}
 	}
 
-	if err := tx.Commit().Error; err != nil {
-		log.Printf("Ошибка коммита транзакции: %v", err)
-		return eris.Wrap(err, err.Error())
-	}
-
-	log.Printf("Заказ успешно создан и сохранен в базе данных")
-
 	return nil
 }
 
@@ -142,7 +688,7 @@ func (r *OrderRepository) CreateWithRelations(order *models.Order) error {
 func (r *OrderRepository) ClearAll() error {
 	// Используем TRUNCATE для полной очистки таблиц и сброса последовательностей
 	// Это более эффективно чем DELETE и автоматически сбрасывает последовательности
-	if err := r.db.Exec("TRUNCATE TABLE order_items, payments, deliveries, orders RESTART IDENTITY CASCADE").Error; err != nil {
+	if err := r.db.Exec("TRUNCATE TABLE order_fragments, order_assemblies, outbox_events, order_provenance, order_status_history, order_items, payments, deliveries, orders RESTART IDENTITY CASCADE").Error; err != nil {
 		return eris.Wrap(err, err.Error())
 	}
 
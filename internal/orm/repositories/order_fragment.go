@@ -0,0 +1,275 @@
+package repositories
+
+import (
+	"time"
+
+	"wb/internal/orm/models"
+
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// FragmentBacklog состояние незавершенных сборок заказов
+type FragmentBacklog struct {
+	Assemblies    int64            `json:"assemblies"`
+	Fragments     int64            `json:"fragments"`
+	ByPart        map[string]int64 `json:"by_part"`
+	OldestPending *time.Time       `json:"oldest_pending,omitempty"`
+}
+
+// FragmentStatus результат добавления части заказа
+type FragmentStatus string
+
+const (
+	// FragmentPending часть сохранена, сборка ждет остальные части
+	FragmentPending FragmentStatus = "pending"
+	// FragmentAssembled пришли все части, заказ собран
+	FragmentAssembled FragmentStatus = "assembled"
+	// FragmentLate сборка уже завершена, часть отброшена
+	FragmentLate FragmentStatus = "late"
+)
+
+// OrderFragmentRepository репозиторий частей заказов, ожидающих сборки
+type OrderFragmentRepository struct {
+	db *gorm.DB
+}
+
+// NewOrderFragmentRepository создает новый экземпляр репозитория
+func NewOrderFragmentRepository(db *gorm.DB) *OrderFragmentRepository {
+	return &OrderFragmentRepository{db: db}
+}
+
+// Add сохраняет часть заказа и передает assemble все накопленные части того же ключа вместе
+// с транзакцией, в которой собранный заказ сохраняется атомарно с удалением частей.
+// Если assemble вернул true, части удаляются, а сборка отмечается завершенной. Части одного
+// ключа обрабатываются под advisory-блокировкой, поэтому части, пришедшие одновременно из
+// разных топиков или экземпляров сервиса, не теряются и заказ собирается один раз. Часть
+// завершенной сборки не сохраняется. Ошибка assemble откатывает транзакцию вместе
+// с сохранением части.
+func (r *OrderFragmentRepository) Add(
+	fragment *models.OrderFragment,
+	assemble func(tx *gorm.DB, fragments []models.OrderFragment) (bool, error),
+) (FragmentStatus, error) {
+	status := FragmentPending
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockAssemblyKey(tx, fragment.AssemblyKey); err != nil {
+			return err
+		}
+
+		completed, err := assemblyCompleted(tx, fragment.AssemblyKey)
+		if err != nil {
+			return err
+		}
+
+		if completed {
+			status = FragmentLate
+			return nil
+		}
+
+		// Повторная часть того же вида заменяет прежнюю, время ожидания не сбрасывается
+		err = tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "assembly_key"}, {Name: "part"}},
+			DoUpdates: clause.AssignmentColumns([]string{
+				"payload", "topic", "partition", "offset", "message_key", "headers",
+				"timestamp", "correlation_id", "trace_id", "updated_at",
+			}),
+		}).Create(fragment).Error
+		if err != nil {
+			return eris.Wrapf(err, "ошибка сохранения части %s заказа %s", fragment.Part, fragment.AssemblyKey)
+		}
+
+		fragments, err := findFragments(tx, fragment.AssemblyKey)
+		if err != nil {
+			return err
+		}
+
+		complete, err := assemble(tx, fragments)
+		if err != nil || !complete {
+			return err
+		}
+
+		status = FragmentAssembled
+
+		return completeAssembly(tx, fragment.AssemblyKey, models.AssemblyOutcomeAssembled)
+	})
+	if err != nil {
+		return FragmentPending, err
+	}
+
+	return status, nil
+}
+
+// Expired возвращает ключи сборок, первая часть которых получена раньше before
+func (r *OrderFragmentRepository) Expired(before time.Time, limit int) ([]string, error) {
+	var keys []string
+
+	err := r.db.Model(&models.OrderFragment{}).
+		Select("assembly_key").
+		Group("assembly_key").
+		Having("MIN(created_at) < ?", before).
+		Order("MIN(created_at)").
+		Limit(limit).
+		Pluck("assembly_key", &keys).Error
+	if err != nil {
+		return nil, eris.Wrap(err, "ошибка при поиске просроченных сборок заказов")
+	}
+
+	return keys, nil
+}
+
+// Expire передает expire части просроченной сборки, записывает в outbox сообщения, которые
+// он вернул, и удаляет части с отметкой о просрочке в одной транзакции: сообщения публикует
+// relay уже после фиксации. Возвращает false, если за это время сборка завершилась или ее
+// уже обработал другой экземпляр сервиса. Ошибка expire откатывает транзакцию: части
+// остаются до следующей проверки.
+func (r *OrderFragmentRepository) Expire(
+	key string,
+	before time.Time,
+	expire func(fragments []models.OrderFragment) ([]*models.OutboxEvent, error),
+) (bool, error) {
+	expired := false
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockAssemblyKey(tx, key); err != nil {
+			return err
+		}
+
+		fragments, err := findFragments(tx, key)
+		if err != nil || len(fragments) == 0 {
+			return err
+		}
+
+		first := fragments[0].CreatedAt
+		for _, fragment := range fragments[1:] {
+			if fragment.CreatedAt.Before(first) {
+				first = fragment.CreatedAt
+			}
+		}
+
+		if !first.Before(before) {
+			return nil
+		}
+
+		events, err := expire(fragments)
+		if err != nil {
+			return err
+		}
+
+		if len(events) > 0 {
+			if err := tx.Create(events).Error; err != nil {
+				return eris.Wrapf(err, "ошибка записи в outbox сообщений о просроченной сборке %s", key)
+			}
+		}
+
+		expired = true
+
+		return completeAssembly(tx, key, models.AssemblyOutcomeExpired)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return expired, nil
+}
+
+// PurgeCompleted удаляет отметки о сборках, завершенных раньше before
+func (r *OrderFragmentRepository) PurgeCompleted(before time.Time) (int64, error) {
+	result := r.db.Where("completed_at < ?", before).Delete(&models.OrderAssembly{})
+	if err := result.Error; err != nil {
+		return 0, eris.Wrap(err, "ошибка при удалении отметок о завершенных сборках")
+	}
+
+	return result.RowsAffected, nil
+}
+
+// Backlog возвращает число незавершенных сборок и накопленных частей
+func (r *OrderFragmentRepository) Backlog() (*FragmentBacklog, error) {
+	backlog := &FragmentBacklog{ByPart: make(map[string]int64)}
+
+	var byPart []struct {
+		Part  string
+		Count int64
+	}
+
+	err := r.db.Model(&models.OrderFragment{}).
+		Select("part, COUNT(*) AS count").
+		Group("part").
+		Scan(&byPart).Error
+	if err != nil {
+		return nil, eris.Wrap(err, "ошибка при подсчете частей заказов")
+	}
+
+	for _, row := range byPart {
+		backlog.ByPart[row.Part] = row.Count
+		backlog.Fragments += row.Count
+	}
+
+	err = r.db.Model(&models.OrderFragment{}).
+		Distinct("assembly_key").
+		Count(&backlog.Assemblies).Error
+	if err != nil {
+		return nil, eris.Wrap(err, "ошибка при подсчете сборок заказов")
+	}
+
+	var oldest models.OrderFragment
+
+	result := r.db.Order("created_at").Limit(1).Find(&oldest)
+	if result.Error != nil {
+		return nil, eris.Wrap(result.Error, "ошибка при получении самой старой части заказа")
+	}
+
+	if result.RowsAffected > 0 {
+		backlog.OldestPending = &oldest.CreatedAt
+	}
+
+	return backlog, nil
+}
+
+// lockAssemblyKey блокирует ключ сборки до конца транзакции
+func lockAssemblyKey(tx *gorm.DB, key string) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", key).Error; err != nil {
+		return eris.Wrapf(err, "ошибка блокировки сборки заказа %s", key)
+	}
+
+	return nil
+}
+
+func findFragments(tx *gorm.DB, key string) ([]models.OrderFragment, error) {
+	var fragments []models.OrderFragment
+
+	if err := tx.Where("assembly_key = ?", key).Order("id").Find(&fragments).Error; err != nil {
+		return nil, eris.Wrapf(err, "ошибка при получении частей заказа %s", key)
+	}
+
+	return fragments, nil
+}
+
+func assemblyCompleted(tx *gorm.DB, key string) (bool, error) {
+	var count int64
+
+	if err := tx.Model(&models.OrderAssembly{}).Where("assembly_key = ?", key).Count(&count).Error; err != nil {
+		return false, eris.Wrapf(err, "ошибка при проверке сборки заказа %s", key)
+	}
+
+	return count > 0, nil
+}
+
+// completeAssembly удаляет части сборки и оставляет отметку о ее завершении
+func completeAssembly(tx *gorm.DB, key, outcome string) error {
+	if err := tx.Where("assembly_key = ?", key).Delete(&models.OrderFragment{}).Error; err != nil {
+		return eris.Wrapf(err, "ошибка при удалении частей заказа %s", key)
+	}
+
+	err := tx.Create(&models.OrderAssembly{
+		AssemblyKey: key,
+		Outcome:     outcome,
+		CompletedAt: time.Now(),
+	}).Error
+	if err != nil {
+		return eris.Wrapf(err, "ошибка при отметке сборки заказа %s", key)
+	}
+
+	return nil
+}
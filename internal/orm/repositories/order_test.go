@@ -0,0 +1,114 @@
+package repositories
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rotisserie/eris"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"wb/internal/orm/models"
+)
+
+// Запросы, которые репозиторий выполняет при сохранении заказа
+var (
+	selectOrderForUpdate = regexp.QuoteMeta(`SELECT * FROM "orders" WHERE order_uid = $1`) + `.*FOR UPDATE`
+	insertOrderDoNothing = regexp.QuoteMeta(`INSERT INTO "orders"`) + `.*` + regexp.QuoteMeta(`ON CONFLICT ("order_uid") DO NOTHING`)
+)
+
+func newMockRepository(t *testing.T) (*OrderRepository, sqlmock.Sqlmock) {
+	t.Helper()
+
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+
+	t.Cleanup(func() { sqlDB.Close() })
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+
+	return NewOrderRepository(db), mock
+}
+
+func TestCreateWithRelationsReturnsErrOrderAlreadyExistsOnConflict(t *testing.T) {
+	repo, mock := newMockRepository(t)
+
+	// ON CONFLICT DO NOTHING не возвращает строку: заказ уже вставлен
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertOrderDoNothing).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	err := repo.CreateWithRelations(&models.Order{OrderUID: "b563feb7b2b84b6test"})
+	if !eris.Is(err, ErrOrderAlreadyExists) {
+		t.Fatalf("err = %v, want ErrOrderAlreadyExists", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsertWithRelationsSkipsRedeliveredOrder(t *testing.T) {
+	repo, mock := newMockRepository(t)
+
+	// Заказ той же версии уже сохранен: повторная доставка ничего не пишет
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectOrderForUpdate).
+		WithArgs("b563feb7b2b84b6test", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_uid", "status", "version"}).
+			AddRow(1, "b563feb7b2b84b6test", models.OrderStatusCreated, 1))
+	mock.ExpectRollback()
+
+	result, err := repo.UpsertWithRelations(&models.Order{
+		OrderUID: "b563feb7b2b84b6test",
+		Status:   models.OrderStatusCreated,
+		Version:  1,
+	}, ConflictHighestVersionWins, nil)
+	if err != nil {
+		t.Fatalf("UpsertWithRelations: %v", err)
+	}
+
+	if result != UpsertSkipped {
+		t.Fatalf("result = %s, want %s", result, UpsertSkipped)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsertWithRelationsReturnsErrOrderAlreadyExistsWhenConcurrentInsertWins(t *testing.T) {
+	repo, mock := newMockRepository(t)
+
+	// Строки еще не было, но параллельная транзакция вставила заказ раньше
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectOrderForUpdate).
+		WithArgs("b563feb7b2b84b6test", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(insertOrderDoNothing).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	result, err := repo.UpsertWithRelations(&models.Order{OrderUID: "b563feb7b2b84b6test", Version: 1},
+		ConflictHighestVersionWins, nil)
+	if !eris.Is(err, ErrOrderAlreadyExists) {
+		t.Fatalf("err = %v, want ErrOrderAlreadyExists", err)
+	}
+
+	if result != UpsertSkipped {
+		t.Fatalf("result = %s, want %s", result, UpsertSkipped)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,330 @@
+package repositories
+
+import (
+	"log"
+	"time"
+
+	"wb/internal/orm/models"
+
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OutboxBacklog состояние очереди неотправленных событий
+type OutboxBacklog struct {
+	Pending       int64                `json:"pending"`
+	Failing       int64                `json:"failing"`
+	OldestPending *time.Time           `json:"oldest_pending,omitempty"`
+	LastSentAt    *time.Time           `json:"last_sent_at,omitempty"`
+	ByEventType   map[string]int64     `json:"by_event_type"`
+	Head          []models.OutboxEvent `json:"head"`
+}
+
+// OutboxRepository репозиторий событий outbox
+type OutboxRepository struct {
+	db *gorm.DB
+}
+
+// NewOutboxRepository создает новый экземпляр репозитория
+func NewOutboxRepository(db *gorm.DB) *OutboxRepository {
+	return &OutboxRepository{db: db}
+}
+
+// PublishPending захватывает неотправленные события по возрастанию ID, передает их publish
+// и отмечает отправленные. Захват занимает короткую транзакцию: события получают аренду
+// на lease, и публикация идет уже без открытой транзакции и блокировок строк. Пока аренда
+// другого экземпляра не истекла, проход ничего не захватывает, поэтому порядок событий
+// сохраняется. На первой ошибке проход останавливается: событие получает время следующей
+// попытки, а захваченные за ним освобождаются и ждут, чтобы не нарушить порядок.
+// Когда до конца аренды остается меньше половины срока, она продлевается для еще не
+// опубликованных событий: медленная пачка не переходит к другому экземпляру посреди прохода.
+// События, которые вернул publish, записываются в одной транзакции с отметкой об отправке.
+func (r *OutboxRepository) PublishPending(
+	limit int,
+	lease time.Duration,
+	publish func(event *models.OutboxEvent) ([]*models.OutboxEvent, error),
+	retryDelay func(attempts int) time.Duration,
+) (int, error) {
+	events, lockedUntil, err := r.claim(limit, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+
+	for i := range events {
+		event := &events[i]
+
+		if time.Until(lockedUntil) < lease/2 {
+			renewed, err := r.renew(events[i:], lockedUntil, lease)
+			if err != nil {
+				return sent, err
+			}
+
+			// Аренда истекла, и события уже захватил другой экземпляр
+			if renewed.IsZero() {
+				log.Printf("Аренда событий outbox истекла до публикации события %d, проход остановлен", event.ID)
+				return sent, nil
+			}
+
+			lockedUntil = renewed
+		}
+
+		followUps, publishErr := publish(event)
+		if publishErr != nil {
+			event.Attempts++
+
+			err = r.db.Model(event).Updates(map[string]interface{}{
+				"attempts":        event.Attempts,
+				"last_error":      publishErr.Error(),
+				"next_attempt_at": time.Now().Add(retryDelay(event.Attempts)),
+				"locked_until":    nil,
+			}).Error
+			if err != nil {
+				return sent, eris.Wrap(err, "ошибка при сохранении попытки публикации")
+			}
+
+			return sent, r.release(events[i+1:])
+		}
+
+		err = r.db.Transaction(func(tx *gorm.DB) error {
+			if len(followUps) > 0 {
+				if err := tx.Create(followUps).Error; err != nil {
+					return err
+				}
+			}
+
+			return tx.Model(event).Updates(map[string]interface{}{
+				"sent_at":      time.Now(),
+				"locked_until": nil,
+			}).Error
+		})
+		if err != nil {
+			// Событие опубликуется повторно после истечения аренды
+			return sent, eris.Wrap(err, "ошибка при отметке события отправленным")
+		}
+
+		sent++
+	}
+
+	return sent, nil
+}
+
+// claim захватывает до limit первых неотправленных событий на lease и возвращает срок аренды.
+// Захваты экземпляров сериализуются advisory-блокировкой, а строки, заблокированные чужой
+// транзакцией, пропускаются
+func (r *OutboxRepository) claim(limit int, lease time.Duration) ([]models.OutboxEvent, time.Time, error) {
+	var (
+		events      []models.OutboxEvent
+		lockedUntil time.Time
+	)
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", models.OutboxEvent{}.TableName()).Error; err != nil {
+			return eris.Wrap(err, "ошибка при блокировке outbox")
+		}
+
+		now := time.Now()
+
+		// Очередь публикует другой экземпляр
+		var leased int64
+
+		err := tx.Model(&models.OutboxEvent{}).
+			Where("sent_at IS NULL AND locked_until > ?", now).
+			Count(&leased).Error
+		if err != nil {
+			return eris.Wrap(err, "ошибка при проверке захваченных событий outbox")
+		}
+
+		if leased > 0 {
+			return nil
+		}
+
+		err = tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked}).
+			Where("sent_at IS NULL").
+			Order("id").
+			Limit(limit).
+			Find(&events).Error
+		if err != nil {
+			return eris.Wrap(err, "ошибка при выборке событий outbox")
+		}
+
+		// Событие ждет повторной попытки: следующие за ним тоже ждут
+		for i := range events {
+			if events[i].NextAttemptAt.After(now) {
+				events = events[:i]
+				break
+			}
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		// Postgres хранит время с точностью до микросекунд: по этому значению аренда продлевается
+		lockedUntil = now.Add(lease).Truncate(time.Microsecond)
+
+		err = tx.Model(&models.OutboxEvent{}).
+			Where("id IN ?", eventIDs(events)).
+			Update("locked_until", lockedUntil).Error
+		if err != nil {
+			return eris.Wrap(err, "ошибка при захвате событий outbox")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return events, lockedUntil, nil
+}
+
+// renew продлевает аренду событий, если ее не перехватил другой экземпляр.
+// Возвращает новый срок аренды или нулевое время, если аренда потеряна.
+func (r *OutboxRepository) renew(events []models.OutboxEvent, lockedUntil time.Time, lease time.Duration) (time.Time, error) {
+	renewed := time.Now().Add(lease).Truncate(time.Microsecond)
+
+	result := r.db.Model(&models.OutboxEvent{}).
+		Where("id IN ? AND sent_at IS NULL AND locked_until = ?", eventIDs(events), lockedUntil).
+		Update("locked_until", renewed)
+	if result.Error != nil {
+		return time.Time{}, eris.Wrap(result.Error, "ошибка при продлении аренды событий outbox")
+	}
+
+	if result.RowsAffected < int64(len(events)) {
+		return time.Time{}, nil
+	}
+
+	return renewed, nil
+}
+
+// release снимает аренду с захваченных, но не опубликованных событий
+func (r *OutboxRepository) release(events []models.OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	err := r.db.Model(&models.OutboxEvent{}).
+		Where("id IN ?", eventIDs(events)).
+		Update("locked_until", nil).Error
+	if err != nil {
+		return eris.Wrap(err, "ошибка при освобождении событий outbox")
+	}
+
+	return nil
+}
+
+func eventIDs(events []models.OutboxEvent) []uint {
+	ids := make([]uint, len(events))
+	for i := range events {
+		ids[i] = events[i].ID
+	}
+
+	return ids
+}
+
+// Backlog возвращает число неотправленных событий, возраст самого старого
+// и первые события очереди
+func (r *OutboxRepository) Backlog(headSize int) (*OutboxBacklog, error) {
+	backlog := &OutboxBacklog{ByEventType: make(map[string]int64)}
+
+	var byType []struct {
+		EventType string
+		Count     int64
+	}
+
+	err := r.db.Model(&models.OutboxEvent{}).
+		Select("event_type, COUNT(*) AS count").
+		Where("sent_at IS NULL").
+		Group("event_type").
+		Scan(&byType).Error
+	if err != nil {
+		return nil, eris.Wrap(err, "ошибка при подсчете событий outbox")
+	}
+
+	for _, row := range byType {
+		backlog.ByEventType[row.EventType] = row.Count
+		backlog.Pending += row.Count
+	}
+
+	err = r.db.Model(&models.OutboxEvent{}).
+		Where("sent_at IS NULL AND attempts > 0").
+		Count(&backlog.Failing).Error
+	if err != nil {
+		return nil, eris.Wrap(err, "ошибка при подсчете событий outbox с ошибками")
+	}
+
+	if err := r.db.Where("sent_at IS NULL").Order("id").Limit(headSize).Find(&backlog.Head).Error; err != nil {
+		return nil, eris.Wrap(err, "ошибка при получении очереди outbox")
+	}
+
+	if len(backlog.Head) > 0 {
+		backlog.OldestPending = &backlog.Head[0].CreatedAt
+	}
+
+	var lastSent models.OutboxEvent
+
+	err = r.db.Where("sent_at IS NOT NULL").Order("sent_at DESC").Limit(1).Find(&lastSent).Error
+	if err != nil {
+		return nil, eris.Wrap(err, "ошибка при получении последнего отправленного события")
+	}
+
+	backlog.LastSentAt = lastSent.SentAt
+
+	return backlog, nil
+}
+
+// enqueueOrderEvent записывает событие о заказе в outbox в рамках транзакции изменения заказа
+func enqueueOrderEvent(tx *gorm.DB, event models.OrderEvent) error {
+	event.OccurredAt = time.Now()
+
+	row, err := models.NewOrderOutboxEvent(event)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Create(row).Error; err != nil {
+		log.Printf("Ошибка записи события в outbox: %v", err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	return nil
+}
+
+// orderPersistedEvent событие о сохранении заказа с его полным содержимым
+func orderPersistedEvent(order *models.Order, source *models.MessageSource, result UpsertResult) models.OrderEvent {
+	event := models.OrderEvent{
+		EventType: models.OrderEventPersisted,
+		OrderUID:  order.OrderUID,
+		Status:    order.Status,
+		Version:   order.Version,
+		Result:    string(result),
+		Order:     order,
+
+		CorrelationID: order.CorrelationID,
+		TraceID:       order.TraceID,
+	}
+
+	if source != nil {
+		event.RoutingRule = source.RoutingRule
+	}
+
+	return event
+}
+
+// orderStatusChangedEvent событие о смене статуса заказа
+func orderStatusChangedEvent(order *models.Order, from string) models.OrderEvent {
+	return models.OrderEvent{
+		EventType:  models.OrderEventStatusChanged,
+		OrderUID:   order.OrderUID,
+		Status:     order.Status,
+		Version:    order.Version,
+		FromStatus: from,
+
+		CorrelationID: order.CorrelationID,
+		TraceID:       order.TraceID,
+	}
+}
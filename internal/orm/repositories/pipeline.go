@@ -0,0 +1,193 @@
+package repositories
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"time"
+
+	"wb/internal/orm/models"
+
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PipelineRepository репозиторий конвейеров обработки сообщений
+type PipelineRepository struct {
+	db *gorm.DB
+}
+
+// NewPipelineRepository создает новый экземпляр репозитория
+func NewPipelineRepository(db *gorm.DB) *PipelineRepository {
+	return &PipelineRepository{db: db}
+}
+
+// List возвращает все неудаленные конвейеры, отсортированные по топику
+func (r *PipelineRepository) List() ([]models.Pipeline, error) {
+	var pipelines []models.Pipeline
+	if err := r.db.Where("deleted_at IS NULL").Order("topic").Find(&pipelines).Error; err != nil {
+		return nil, eris.Wrap(err, "ошибка при получении списка конвейеров")
+	}
+
+	return pipelines, nil
+}
+
+// Get возвращает конвейер топика
+func (r *PipelineRepository) Get(topic string) (*models.Pipeline, error) {
+	pipeline := models.Pipeline{}
+
+	if err := r.db.Where("topic = ? AND deleted_at IS NULL", topic).First(&pipeline).Error; err != nil {
+		return nil, eris.Wrap(err, err.Error())
+	}
+
+	return &pipeline, nil
+}
+
+// Save создает конвейер топика или заменяет существующий, увеличивая его версию.
+// Удаленный конвейер при этом восстанавливается.
+func (r *PipelineRepository) Save(pipeline *models.Pipeline) error {
+	return r.SaveAll([]*models.Pipeline{pipeline})
+}
+
+// SaveAll сохраняет конвейеры в одной транзакции: либо все, либо ни один
+func (r *PipelineRepository) SaveAll(pipelines []*models.Pipeline) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		for _, pipeline := range pipelines {
+			if err := savePipeline(tx, pipeline); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("Ошибка сохранения конвейеров: %v", err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	return nil
+}
+
+// SaveFromFile сохраняет конвейеры из файла конфигурации в одной транзакции. Конвейер
+// пропускается, если его определение не изменилось или его последним изменял или удалял API:
+// так повторный запуск не увеличивает версии и не затирает правки API. Возвращает
+// конвейеры, сохраненные в этот раз.
+func (r *PipelineRepository) SaveFromFile(pipelines []*models.Pipeline) ([]*models.Pipeline, error) {
+	var saved []*models.Pipeline
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		for _, pipeline := range pipelines {
+			existing, err := findPipeline(tx, pipeline.Topic)
+			if err != nil {
+				return err
+			}
+
+			if existing.ID != 0 {
+				if existing.Source == models.PipelineSourceAPI {
+					log.Printf("Конвейер топика %s из файла пропущен: он изменен или удален через API", pipeline.Topic)
+					continue
+				}
+
+				if existing.DeletedAt == nil && samePipeline(&existing, pipeline) {
+					continue
+				}
+			}
+
+			if err := writePipeline(tx, &existing, pipeline); err != nil {
+				return err
+			}
+
+			saved = append(saved, pipeline)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("Ошибка сохранения конвейеров из файла: %v", err)
+
+		return nil, eris.Wrap(err, err.Error())
+	}
+
+	return saved, nil
+}
+
+// Delete удаляет конвейер топика, оставляя запись об удалении от имени API.
+// Возвращает false, если конвейера не было.
+func (r *PipelineRepository) Delete(topic string) (bool, error) {
+	result := r.db.Model(&models.Pipeline{}).
+		Where("topic = ? AND deleted_at IS NULL", topic).
+		Updates(map[string]interface{}{
+			"source":     models.PipelineSourceAPI,
+			"deleted_at": time.Now(),
+		})
+	if err := result.Error; err != nil {
+		return false, eris.Wrap(err, "ошибка при удалении конвейера")
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+func savePipeline(tx *gorm.DB, pipeline *models.Pipeline) error {
+	existing, err := findPipeline(tx, pipeline.Topic)
+	if err != nil {
+		return err
+	}
+
+	return writePipeline(tx, &existing, pipeline)
+}
+
+// findPipeline блокирует запись конвейера топика, в том числе удаленного
+func findPipeline(tx *gorm.DB, topic string) (models.Pipeline, error) {
+	var existing models.Pipeline
+
+	err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where("topic = ?", topic).
+		Limit(1).
+		Find(&existing).Error
+
+	return existing, err
+}
+
+// writePipeline создает конвейер или заменяет существующую запись, увеличивая версию
+func writePipeline(tx *gorm.DB, existing *models.Pipeline, pipeline *models.Pipeline) error {
+	now := time.Now()
+	pipeline.UpdatedAt = now
+
+	if existing.ID == 0 {
+		pipeline.ID = 0
+		pipeline.Version = 1
+		pipeline.CreatedAt = now
+
+		return tx.Create(pipeline).Error
+	}
+
+	pipeline.ID = existing.ID
+	pipeline.Version = existing.Version + 1
+	pipeline.CreatedAt = existing.CreatedAt
+
+	return tx.Model(existing).Updates(map[string]interface{}{
+		"description": pipeline.Description,
+		"stages":      pipeline.Stages,
+		"source":      pipeline.Source,
+		"version":     pipeline.Version,
+		"updated_at":  pipeline.UpdatedAt,
+		"deleted_at":  nil,
+	}).Error
+}
+
+// samePipeline сравнивает определения конвейеров. Стадии сравниваются как JSON:
+// jsonb в БД не сохраняет исходные пробелы и порядок ключей.
+func samePipeline(existing *models.Pipeline, pipeline *models.Pipeline) bool {
+	if existing.Description != pipeline.Description {
+		return false
+	}
+
+	var stored, stages interface{}
+	if json.Unmarshal([]byte(existing.Stages), &stored) != nil || json.Unmarshal([]byte(pipeline.Stages), &stages) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(stored, stages)
+}
@@ -0,0 +1,90 @@
+package repositories
+
+import (
+	"log"
+	"time"
+
+	"wb/internal/orm/models"
+
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RoutingRuleRepository репозиторий правил маршрутизации заказов
+type RoutingRuleRepository struct {
+	db *gorm.DB
+}
+
+// NewRoutingRuleRepository создает новый экземпляр репозитория
+func NewRoutingRuleRepository(db *gorm.DB) *RoutingRuleRepository {
+	return &RoutingRuleRepository{db: db}
+}
+
+// List возвращает правила в порядке применения: по приоритету, затем по имени
+func (r *RoutingRuleRepository) List() ([]models.RoutingRule, error) {
+	var rules []models.RoutingRule
+	if err := r.db.Order("priority, name").Find(&rules).Error; err != nil {
+		return nil, eris.Wrap(err, "ошибка при получении правил маршрутизации")
+	}
+
+	return rules, nil
+}
+
+// Save создает правило или заменяет существующее с тем же именем, увеличивая его версию
+func (r *RoutingRuleRepository) Save(rule *models.RoutingRule) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var existing models.RoutingRule
+
+		err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where("name = ?", rule.Name).
+			Limit(1).
+			Find(&existing).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		rule.UpdatedAt = now
+
+		if existing.ID == 0 {
+			rule.ID = 0
+			rule.Version = 1
+			rule.CreatedAt = now
+
+			return tx.Create(rule).Error
+		}
+
+		rule.ID = existing.ID
+		rule.Version = existing.Version + 1
+		rule.CreatedAt = existing.CreatedAt
+
+		return tx.Model(&existing).Updates(map[string]interface{}{
+			"description": rule.Description,
+			"topic":       rule.Topic,
+			"priority":    rule.Priority,
+			"stop":        rule.Stop,
+			"disabled":    rule.Disabled,
+			"condition":   rule.Condition,
+			"version":     rule.Version,
+			"updated_at":  rule.UpdatedAt,
+		}).Error
+	})
+	if err != nil {
+		log.Printf("Ошибка сохранения правила маршрутизации %s: %v", rule.Name, err)
+
+		return eris.Wrap(err, err.Error())
+	}
+
+	return nil
+}
+
+// Delete удаляет правило. Возвращает false, если правила не было.
+func (r *RoutingRuleRepository) Delete(name string) (bool, error) {
+	result := r.db.Where("name = ?", name).Delete(&models.RoutingRule{})
+	if err := result.Error; err != nil {
+		return false, eris.Wrap(err, "ошибка при удалении правила маршрутизации")
+	}
+
+	return result.RowsAffected > 0, nil
+}
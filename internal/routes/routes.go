@@ -9,13 +9,37 @@ type Router struct {
 	app             *fiber.App
 	orderController *controllers.Order
 	kafkaController *controllers.KafkaController
+
+	outboxController *controllers.OutboxController
+
+	pipelineController *controllers.PipelineController
+
+	routingController *controllers.RoutingController
+
+	assemblyController *controllers.AssemblyController
 }
 
-func NewRouter(app *fiber.App, orderController *controllers.Order, kafkaController *controllers.KafkaController) *Router {
+func NewRouter(
+	app *fiber.App,
+	orderController *controllers.Order,
+	kafkaController *controllers.KafkaController,
+	outboxController *controllers.OutboxController,
+	pipelineController *controllers.PipelineController,
+	routingController *controllers.RoutingController,
+	assemblyController *controllers.AssemblyController,
+) *Router {
 	router := &Router{
 		app:             app,
 		orderController: orderController,
 		kafkaController: kafkaController,
+
+		outboxController: outboxController,
+
+		pipelineController: pipelineController,
+
+		routingController: routingController,
+
+		assemblyController: assemblyController,
 	}
 
 	router.setupRoutes()
@@ -46,8 +70,13 @@ func (r *Router) setupRoutes() {
 
 	// Маршруты для заказов
 	orders := api.Group("/orders")
-	orders.Get("/", r.orderController.ListOrders)                  // GET /api/orders
-	orders.Get("/uid/:uid", r.orderController.GetOrderByUIDFromDB) // GET /api/orders/uid/abc123
+	orders.Get("/", r.orderController.ListOrders)                                   // GET /api/orders
+	orders.Get("/uid/:uid", r.orderController.GetOrderByUIDFromDB)                  // GET /api/orders/uid/abc123
+	orders.Get("/uid/:uid/status", r.orderController.GetOrderStatus)                // GET /api/orders/uid/abc123/status
+	orders.Get("/uid/:uid/status/history", r.orderController.GetOrderStatusHistory) // GET /api/orders/uid/abc123/status/history
+
+	orders.Get("/uid/:uid/provenance", r.orderController.GetOrderProvenance) // GET /api/orders/uid/abc123/provenance
+	orders.Get("/latency", r.orderController.GetOrderLatency)                // GET /api/orders/latency?window=1h
 
 	// Маршруты для кеша
 	cache := api.Group("/cache")
@@ -65,11 +94,50 @@ func (r *Router) setupRoutes() {
 
 	// Маршруты для Kafka
 	kafka := api.Group("/kafka")
-	kafka.Post("/start", r.kafkaController.StartKafkaConsumer)      // POST /api/kafka/start
-	kafka.Post("/stop", r.kafkaController.StopKafkaConsumer)        // POST /api/kafka/stop
-	kafka.Get("/status", r.kafkaController.GetKafkaStatus)          // GET /api/kafka/status
-	kafka.Post("/send", r.kafkaController.SendTestMessage)          // POST /api/kafka/send
-	kafka.Post("/handler", r.kafkaController.RegisterCustomHandler) // POST /api/kafka/handler
+	kafka.Post("/start", r.kafkaController.StartKafkaConsumer)                 // POST /api/kafka/start
+	kafka.Post("/stop", r.kafkaController.StopKafkaConsumer)                   // POST /api/kafka/stop
+	kafka.Post("/pause", r.kafkaController.PauseKafkaConsumer)                 // POST /api/kafka/pause
+	kafka.Post("/resume", r.kafkaController.ResumeKafkaConsumer)               // POST /api/kafka/resume
+	kafka.Post("/offsets/reset", r.kafkaController.ResetOffsets)               // POST /api/kafka/offsets/reset
+	kafka.Get("/status", r.kafkaController.GetKafkaStatus)                     // GET /api/kafka/status
+	kafka.Get("/lag", r.kafkaController.GetConsumerLag)                        // GET /api/kafka/lag
+	kafka.Post("/send", r.kafkaController.SendTestMessage)                     // POST /api/kafka/send
+	kafka.Post("/handler", r.kafkaController.RegisterCustomHandler)            // POST /api/kafka/handler
+	kafka.Delete("/handler/:topic", r.kafkaController.UnregisterCustomHandler) // DELETE /api/kafka/handler/payments
+
+	// Администрирование кластера Kafka
+	admin := kafka.Group("/admin")
+	admin.Get("/topics", r.kafkaController.ListTopics)            // GET /api/kafka/admin/topics
+	admin.Post("/topics", r.kafkaController.CreateTopic)          // POST /api/kafka/admin/topics
+	admin.Get("/topics/:topic", r.kafkaController.DescribeTopic)  // GET /api/kafka/admin/topics/orders
+	admin.Delete("/topics/:topic", r.kafkaController.DeleteTopic) // DELETE /api/kafka/admin/topics/payments
+	admin.Get("/groups", r.kafkaController.ListConsumerGroups)    // GET /api/kafka/admin/groups
+
+	// Просмотр сообщений топика без участия consumer group сервиса
+	admin.Get("/topics/:topic/messages", r.kafkaController.BrowseMessages) // GET /api/kafka/admin/topics/orders/messages?limit=20
+
+	// Очередь событий о заказах, ожидающих публикации
+	outbox := api.Group("/outbox")
+	outbox.Get("/", r.outboxController.GetOutboxBacklog) // GET /api/outbox
+
+	// Конвейеры обработки сообщений топиков
+	pipelines := api.Group("/pipelines")
+	pipelines.Get("/", r.pipelineController.ListPipelines)           // GET /api/pipelines
+	pipelines.Post("/reload", r.pipelineController.ReloadPipelines)  // POST /api/pipelines/reload
+	pipelines.Get("/:topic", r.pipelineController.GetPipeline)       // GET /api/pipelines/payments
+	pipelines.Put("/:topic", r.pipelineController.ApplyPipeline)     // PUT /api/pipelines/payments
+	pipelines.Delete("/:topic", r.pipelineController.DeletePipeline) // DELETE /api/pipelines/payments
+
+	// Маршрутизация заказов в топики по содержимому
+	routing := api.Group("/routing")
+	routing.Get("/rules", r.routingController.ListRules)           // GET /api/routing/rules
+	routing.Put("/rules/:name", r.routingController.ApplyRule)     // PUT /api/routing/rules/premium
+	routing.Delete("/rules/:name", r.routingController.DeleteRule) // DELETE /api/routing/rules/premium
+	routing.Post("/dry-run", r.routingController.DryRun)           // POST /api/routing/dry-run
+
+	// Сборка заказов из частей, приходящих в отдельные топики
+	assembly := api.Group("/assembly")
+	assembly.Get("/", r.assemblyController.GetAssemblyBacklog) // GET /api/assembly
 }
 
 // SetupRoutes настраивает маршруты для переданного приложения
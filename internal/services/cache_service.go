@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+	"wb/config"
 	"wb/internal/orm/models"
 	"wb/internal/orm/repositories"
 )
@@ -14,12 +15,14 @@ type CacheService struct {
 	orders map[string]*models.Order
 	mu     sync.RWMutex
 	db     *gorm.DB
+	cfg    *config.Orders
 }
 
-func NewCacheService(db *gorm.DB) *CacheService {
+func NewCacheService(db *gorm.DB, cfg *config.Orders) *CacheService {
 	service := &CacheService{
 		orders: make(map[string]*models.Order),
 		db:     db,
+		cfg:    cfg,
 	}
 
 	// Восстанавливаем кеш из БД при старте
@@ -112,23 +115,137 @@ func (cs *CacheService) RestoreFromDB() {
 	log.Printf("Кеш восстановлен из БД: %d заказов", len(cs.orders))
 }
 
-// SaveOrderToDB сохраняет заказ в базу данных и обновляет кеш
+// SaveOrderToDB сохраняет заказ в базу данных и обновляет кеш.
+// Повторный order_uid разрешается политикой ORDER_CONFLICT_POLICY, кеш меняется только
+// если заказ в БД действительно был создан или обновлен.
 func (cs *CacheService) SaveOrderToDB(order *models.Order) error {
+	_, err := cs.SaveOrderFromMessage(order, nil)
+
+	return err
+}
+
+// SaveOrderFromMessage сохраняет заказ, пришедший из Kafka: координаты сообщения
+// попадают в историю статусов заказа. Результат показывает, был ли заказ создан,
+// обновлен или пропущен политикой конфликтов.
+func (cs *CacheService) SaveOrderFromMessage(
+	order *models.Order,
+	source *models.MessageSource,
+) (repositories.UpsertResult, error) {
 	// Сохраняем в БД cо всеми связями через репозиторий
 	repo := repositories.NewOrderRepository(cs.db)
 
-	err := repo.CreateWithRelations(order)
+	result, err := repo.UpsertWithRelations(order, cs.cfg.GetConflictPolicy(), source)
 	if err != nil {
 		log.Printf("Ошибка при сохранении заказа и связей в БД: %v", err)
-		return err
+		return result, err
+	}
+
+	if result == repositories.UpsertSkipped {
+		// Повторная доставка или устаревшая версия: в БД остается прежний заказ
+		log.Printf("Заказ %s уже сохранен в БД, кеш не изменен", order.OrderUID)
+
+		return result, nil
 	}
 
 	// Обновляем кеш
 	cs.SetOrder(order)
 
-	log.Printf("Заказ %s сохранен в БД и добавлен в кеш", order.OrderUID)
+	log.Printf("Заказ %s сохранен в БД (%s) и добавлен в кеш", order.OrderUID, result)
+
+	return result, nil
+}
+
+// SaveOrderInTx сохраняет заказ из Kafka в транзакции tx вызывающего. Кеш не меняется:
+// после фиксации tx вызывающий добавляет созданный или обновленный заказ через SetOrder.
+func (cs *CacheService) SaveOrderInTx(
+	tx *gorm.DB,
+	order *models.Order,
+	source *models.MessageSource,
+) (repositories.UpsertResult, error) {
+	repo := repositories.NewOrderRepository(cs.db)
+
+	result, err := repo.UpsertWithRelationsTx(tx, order, cs.cfg.GetConflictPolicy(), source)
+	if err != nil {
+		log.Printf("Ошибка при сохранении заказа и связей в БД: %v", err)
+		return result, err
+	}
+
+	return result, nil
+}
+
+// SaveOrdersBatch сохраняет пакет заказов из Kafka в одной транзакции. Новые заказы пишутся
+// многострочными INSERT, а уже сохраненные и повторяющиеся внутри пакета order_uid проходят
+// обычный путь с политикой конфликтов в порядке следования сообщений. Ошибка откатывает
+// весь пакет, поэтому повторная обработка видит те же новые заказы. Кеш обновляется после
+// фиксации. sources содержит координаты сообщений, а возвращаемые результаты идут в том же
+// порядке, что и orders.
+func (cs *CacheService) SaveOrdersBatch(
+	orders []*models.Order,
+	sources []*models.MessageSource,
+) ([]repositories.UpsertResult, error) {
+	repo := repositories.NewOrderRepository(cs.db)
+
+	orderUIDs := make([]string, 0, len(orders))
+	for _, order := range orders {
+		orderUIDs = append(orderUIDs, order.OrderUID)
+	}
+
+	existing, err := repo.ExistingOrderUIDs(orderUIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		fresh        []*models.Order
+		freshSources []*models.MessageSource
+		rest         []int
+	)
+
+	seen := make(map[string]bool, len(orders))
+	results := make([]repositories.UpsertResult, len(orders))
+
+	for i, order := range orders {
+		if existing[order.OrderUID] || seen[order.OrderUID] {
+			rest = append(rest, i)
+			continue
+		}
+
+		seen[order.OrderUID] = true
+		results[i] = repositories.UpsertCreated
+		fresh = append(fresh, order)
+		freshSources = append(freshSources, sources[i])
+	}
+
+	err = cs.db.Transaction(func(tx *gorm.DB) error {
+		if err := repo.CreateBatchWithRelationsTx(tx, fresh, freshSources); err != nil {
+			return err
+		}
+
+		for _, i := range rest {
+			result, err := repo.UpsertWithRelationsTx(tx, orders[i], cs.cfg.GetConflictPolicy(), sources[i])
+			if err != nil {
+				return err
+			}
+
+			results[i] = result
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("Ошибка при пакетном сохранении заказов в БД: %v", err)
+		return nil, err
+	}
+
+	for i, order := range orders {
+		if results[i] != repositories.UpsertSkipped {
+			cs.SetOrder(order)
+		}
+	}
+
+	log.Printf("Пакет сохранен: новых заказов %d, обновлений %d", len(fresh), len(rest))
 
-	return nil
+	return results, nil
 }
 
 // GetCacheStats возвращает статистику кеша
@@ -2,6 +2,7 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -12,6 +13,9 @@ import (
 	"wb/internal/orm/models"
 )
 
+// fakeOrderSendTimeout сколько ждать подтверждения брокера для фейкового заказа
+const fakeOrderSendTimeout = 10 * time.Second
+
 type FakeDataService struct {
 	kafkaService *KafkaService
 	orderCounter int
@@ -124,10 +128,12 @@ func (fds *FakeDataService) SendFakeOrderToKafka() error {
 		return fmt.Errorf("ошибка при маршалинге заказа: %w", err)
 	}
 
-	// Отправляем в Kafka
-	err = fds.kafkaService.SendMessage("orders", order.OrderUID, orderJSON)
-	if err != nil {
-		return fmt.Errorf("ошибка при отправке в Kafka: %w", err)
+	// Ждем подтверждения брокера не дольше fakeOrderSendTimeout, чтобы вызывающий узнал об ошибке
+	ctx, cancel := context.WithTimeout(context.Background(), fakeOrderSendTimeout)
+	defer cancel()
+
+	if _, err := fds.kafkaService.SendMessageAsync(ctx, "orders", order.OrderUID, orderJSON, nil).Wait(ctx); err != nil {
+		return eris.Wrapf(err, "failed to send fake order %s", order.OrderUID)
 	}
 
 	log.Printf("Фейковый заказ %s отправлен в Kafka", order.OrderUID)
@@ -0,0 +1,469 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+)
+
+// ErrKafkaNotConnected клиент Kafka еще не подключен или уже закрыт
+var ErrKafkaNotConnected = errors.New("kafka client is not connected")
+
+// TopicSpec параметры создаваемого топика. Нулевые партиции и фактор репликации
+// берутся из KAFKA_TOPIC_PARTITIONS и KAFKA_TOPIC_REPLICATION_FACTOR.
+type TopicSpec struct {
+	Name              string            `json:"name"`
+	Partitions        int32             `json:"partitions"`
+	ReplicationFactor int16             `json:"replication_factor"`
+	Configs           map[string]string `json:"configs"`
+}
+
+// TopicPartitionInfo лидер и реплики партиции топика
+type TopicPartitionInfo struct {
+	ID              int32   `json:"id"`
+	Leader          int32   `json:"leader"`
+	Replicas        []int32 `json:"replicas"`
+	InSyncReplicas  []int32 `json:"isr"`
+	OfflineReplicas []int32 `json:"offline_replicas,omitempty"`
+}
+
+// TopicInfo описание топика кластера
+type TopicInfo struct {
+	Name              string               `json:"name"`
+	Internal          bool                 `json:"internal"`
+	PartitionCount    int                  `json:"partition_count"`
+	ReplicationFactor int                  `json:"replication_factor"`
+	Subscribed        bool                 `json:"subscribed"`
+	Partitions        []TopicPartitionInfo `json:"partitions,omitempty"`
+}
+
+// TopicConfigEntry параметр конфигурации топика
+type TopicConfigEntry struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Source    string `json:"source"`
+	Default   bool   `json:"default"`
+	ReadOnly  bool   `json:"read_only"`
+	Sensitive bool   `json:"sensitive"`
+}
+
+// ConsumerGroupMember участник consumer group и назначенные ему партиции
+type ConsumerGroupMember struct {
+	MemberID        string             `json:"member_id"`
+	GroupInstanceID string             `json:"group_instance_id,omitempty"`
+	ClientID        string             `json:"client_id"`
+	ClientHost      string             `json:"client_host"`
+	Assignment      map[string][]int32 `json:"assignment"`
+}
+
+// ConsumerGroupInfo описание consumer group
+type ConsumerGroupInfo struct {
+	GroupID      string                `json:"group_id"`
+	State        string                `json:"state"`
+	ProtocolType string                `json:"protocol_type"`
+	Protocol     string                `json:"protocol"`
+	Members      []ConsumerGroupMember `json:"members"`
+	Error        string                `json:"error,omitempty"`
+}
+
+// clusterAdmin создает администратора кластера поверх общего клиента. Его не закрывают:
+// Close закрыл бы и клиент consumer group
+func (k *KafkaService) clusterAdmin() (sarama.ClusterAdmin, sarama.Client, error) {
+	k.mu.RLock()
+	client := k.client
+	k.mu.RUnlock()
+
+	if client == nil || client.Closed() {
+		return nil, nil, eris.Wrap(ErrKafkaNotConnected, "клиент Kafka не подключен, сначала вызовите Start()")
+	}
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return nil, nil, eris.Wrap(err, "failed to create cluster admin")
+	}
+
+	return admin, client, nil
+}
+
+// ListTopics возвращает топики кластера с партициями и репликами, отсортированные по имени.
+// Служебные топики Kafka показываются только с internal = true.
+func (k *KafkaService) ListTopics(internal bool) ([]TopicInfo, error) {
+	admin, _, err := k.clusterAdmin()
+	if err != nil {
+		return nil, err
+	}
+
+	details, err := admin.ListTopics()
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to list topics")
+	}
+
+	names := make([]string, 0, len(details))
+	for name := range details {
+		if internal || !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return k.describeTopics(admin, names)
+}
+
+// DescribeTopic возвращает партиции, реплики и конфигурацию топика
+func (k *KafkaService) DescribeTopic(name string) (*TopicInfo, []TopicConfigEntry, error) {
+	admin, _, err := k.clusterAdmin()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	topics, err := k.describeTopics(admin, []string{name})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := admin.DescribeConfig(sarama.ConfigResource{Type: sarama.TopicResource, Name: name})
+	if err != nil {
+		return nil, nil, eris.Wrapf(err, "failed to describe config of topic %s", name)
+	}
+
+	configs := make([]TopicConfigEntry, 0, len(entries))
+	for _, entry := range entries {
+		config := TopicConfigEntry{
+			Name:      entry.Name,
+			Value:     entry.Value,
+			Source:    entry.Source.String(),
+			Default:   entry.Default,
+			ReadOnly:  entry.ReadOnly,
+			Sensitive: entry.Sensitive,
+		}
+
+		if entry.Sensitive {
+			config.Value = ""
+		}
+
+		configs = append(configs, config)
+	}
+
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Name < configs[j].Name })
+
+	return &topics[0], configs, nil
+}
+
+// CreateTopic создает топик. validateOnly только проверяет параметры на брокере.
+func (k *KafkaService) CreateTopic(spec TopicSpec, validateOnly bool) error {
+	spec.Name = strings.TrimSpace(spec.Name)
+	if spec.Name == "" {
+		return eris.New("имя топика не указано")
+	}
+
+	if spec.Partitions < 0 || spec.ReplicationFactor < 0 {
+		return eris.New("число партиций и фактор репликации не могут быть отрицательными")
+	}
+
+	admin, client, err := k.clusterAdmin()
+	if err != nil {
+		return err
+	}
+
+	if err := admin.CreateTopic(spec.Name, k.topicDetail(spec), validateOnly); err != nil {
+		return eris.Wrapf(err, "failed to create topic %s", spec.Name)
+	}
+
+	if validateOnly {
+		return nil
+	}
+
+	log.Printf("Создан топик %s", spec.Name)
+
+	if err := client.RefreshMetadata(spec.Name); err != nil {
+		log.Printf("Не удалось обновить метаданные топика %s: %v", spec.Name, err)
+	}
+
+	k.refreshSubscription("создан топик: " + spec.Name)
+
+	return nil
+}
+
+// DeleteTopic удаляет топик. Топики, которые consumer сейчас читает, и DLQ удалить нельзя:
+// сначала нужно снять обработчик или изменить конфигурацию
+func (k *KafkaService) DeleteTopic(name string) error {
+	if k.isProtectedTopic(name) {
+		return eris.Errorf("топик %s используется сервисом и не может быть удален", name)
+	}
+
+	admin, _, err := k.clusterAdmin()
+	if err != nil {
+		return err
+	}
+
+	if err := admin.DeleteTopic(name); err != nil {
+		return eris.Wrapf(err, "failed to delete topic %s", name)
+	}
+
+	log.Printf("Удален топик %s", name)
+
+	k.refreshSubscription("удален топик: " + name)
+
+	return nil
+}
+
+// ListConsumerGroups возвращает consumer group'ы кластера с участниками и их партициями
+func (k *KafkaService) ListConsumerGroups() ([]ConsumerGroupInfo, error) {
+	admin, _, err := k.clusterAdmin()
+	if err != nil {
+		return nil, err
+	}
+
+	listed, err := admin.ListConsumerGroups()
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to list consumer groups")
+	}
+
+	if len(listed) == 0 {
+		return []ConsumerGroupInfo{}, nil
+	}
+
+	groupIDs := make([]string, 0, len(listed))
+	for groupID := range listed {
+		groupIDs = append(groupIDs, groupID)
+	}
+
+	descriptions, err := admin.DescribeConsumerGroups(groupIDs)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to describe consumer groups")
+	}
+
+	groups := make([]ConsumerGroupInfo, 0, len(descriptions))
+	for _, description := range descriptions {
+		groups = append(groups, consumerGroupInfo(description))
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].GroupID < groups[j].GroupID })
+
+	return groups, nil
+}
+
+// declareOutputTopics добавляет топики, в которые публикуют встроенные сервисы,
+// к создаваемым при подключении
+func (k *KafkaService) declareOutputTopics(topics ...string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, topic := range topics {
+		k.outputTopics[topic] = true
+	}
+}
+
+// ensureTopics создает недостающие топики при подключении до входа в consumer group.
+// Топики повторов создаются всегда, когда заданы KAFKA_RETRY_DELAYS: сервис на них подписан
+// и перекладывает в них сообщения. Топики подписки, DLQ и топики публикации встроенных
+// сервисов создаются, только если включен KAFKA_AUTO_CREATE_TOPICS.
+func (k *KafkaService) ensureTopics(client sarama.Client) error {
+	var topics []string
+
+	if k.config.AutoCreateTopics {
+		topics = k.subscriptionTopics()
+		if k.config.DeadLetterEnabled {
+			topics = append(topics, k.config.GetDeadLetterTopic())
+		}
+
+		k.mu.RLock()
+		for topic := range k.outputTopics {
+			topics = append(topics, topic)
+		}
+		k.mu.RUnlock()
+	} else {
+		for _, topic := range k.baseTopics() {
+			topics = append(topics, k.retryTopics(topic)...)
+		}
+	}
+
+	if len(topics) == 0 {
+		return nil
+	}
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return eris.Wrap(err, "failed to create cluster admin")
+	}
+
+	existing, err := admin.ListTopics()
+	if err != nil {
+		return eris.Wrap(err, "failed to list topics")
+	}
+
+	var created []string
+
+	for _, topic := range topics {
+		if _, ok := existing[topic]; ok {
+			continue
+		}
+
+		// Топик может встретиться в списке несколько раз, например DLQ и топик публикации
+		existing[topic] = sarama.TopicDetail{}
+
+		err := admin.CreateTopic(topic, k.topicDetail(TopicSpec{Name: topic}), false)
+		if errors.Is(err, sarama.ErrTopicAlreadyExists) {
+			continue
+		}
+
+		if err != nil {
+			return eris.Wrapf(err, "failed to create topic %s", topic)
+		}
+
+		created = append(created, topic)
+	}
+
+	if len(created) == 0 {
+		return nil
+	}
+
+	log.Printf("Созданы недостающие топики: %s", strings.Join(created, ", "))
+
+	if err := client.RefreshMetadata(created...); err != nil {
+		log.Printf("Не удалось обновить метаданные созданных топиков: %v", err)
+	}
+
+	return nil
+}
+
+func (k *KafkaService) topicDetail(spec TopicSpec) *sarama.TopicDetail {
+	detail := &sarama.TopicDetail{
+		NumPartitions:     spec.Partitions,
+		ReplicationFactor: spec.ReplicationFactor,
+	}
+
+	if detail.NumPartitions == 0 {
+		detail.NumPartitions = k.config.GetTopicPartitions()
+	}
+
+	if detail.ReplicationFactor == 0 {
+		detail.ReplicationFactor = k.config.GetTopicReplicationFactor()
+	}
+
+	if len(spec.Configs) > 0 {
+		detail.ConfigEntries = make(map[string]*string, len(spec.Configs))
+
+		for name, value := range spec.Configs {
+			value := value
+			detail.ConfigEntries[name] = &value
+		}
+	}
+
+	return detail
+}
+
+// describeTopics возвращает описание топиков в порядке names
+func (k *KafkaService) describeTopics(admin sarama.ClusterAdmin, names []string) ([]TopicInfo, error) {
+	if len(names) == 0 {
+		return []TopicInfo{}, nil
+	}
+
+	metadata, err := admin.DescribeTopics(names)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to describe topics")
+	}
+
+	subscribed := make(map[string]bool)
+	for _, topic := range k.subscriptionTopics() {
+		subscribed[topic] = true
+	}
+
+	topics := make([]TopicInfo, 0, len(metadata))
+
+	for _, topic := range metadata {
+		if !errors.Is(topic.Err, sarama.ErrNoError) {
+			return nil, eris.Wrapf(topic.Err, "failed to describe topic %s", topic.Name)
+		}
+
+		info := TopicInfo{
+			Name:           topic.Name,
+			Internal:       topic.IsInternal,
+			PartitionCount: len(topic.Partitions),
+			Subscribed:     subscribed[topic.Name],
+			Partitions:     make([]TopicPartitionInfo, 0, len(topic.Partitions)),
+		}
+
+		for _, partition := range topic.Partitions {
+			info.Partitions = append(info.Partitions, TopicPartitionInfo{
+				ID:              partition.ID,
+				Leader:          partition.Leader,
+				Replicas:        partition.Replicas,
+				InSyncReplicas:  partition.Isr,
+				OfflineReplicas: partition.OfflineReplicas,
+			})
+
+			if len(partition.Replicas) > info.ReplicationFactor {
+				info.ReplicationFactor = len(partition.Replicas)
+			}
+		}
+
+		sort.Slice(info.Partitions, func(i, j int) bool { return info.Partitions[i].ID < info.Partitions[j].ID })
+
+		topics = append(topics, info)
+	}
+
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+
+	return topics, nil
+}
+
+// isProtectedTopic сообщает, читает ли сервис топик или пишет в него служебные сообщения
+func (k *KafkaService) isProtectedTopic(name string) bool {
+	if name == k.config.GetTopic() || name == k.config.GetDeadLetterTopic() {
+		return true
+	}
+
+	for _, topic := range k.subscriptionTopics() {
+		if topic == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func consumerGroupInfo(description *sarama.GroupDescription) ConsumerGroupInfo {
+	group := ConsumerGroupInfo{
+		GroupID:      description.GroupId,
+		State:        description.State,
+		ProtocolType: description.ProtocolType,
+		Protocol:     description.Protocol,
+		Members:      make([]ConsumerGroupMember, 0, len(description.Members)),
+	}
+
+	if !errors.Is(description.Err, sarama.ErrNoError) {
+		group.Error = description.Err.Error()
+	}
+
+	for memberID, member := range description.Members {
+		info := ConsumerGroupMember{
+			MemberID:   memberID,
+			ClientID:   member.ClientId,
+			ClientHost: member.ClientHost,
+			Assignment: map[string][]int32{},
+		}
+
+		if member.GroupInstanceId != nil {
+			info.GroupInstanceID = *member.GroupInstanceId
+		}
+
+		// Назначение разбирается только для обычных consumer group'ов
+		if description.ProtocolType == "consumer" {
+			if assignment, err := member.GetMemberAssignment(); err == nil && assignment != nil {
+				info.Assignment = assignment.Topics
+			}
+		}
+
+		group.Members = append(group.Members, info)
+	}
+
+	sort.Slice(group.Members, func(i, j int) bool { return group.Members[i].MemberID < group.Members[j].MemberID })
+
+	return group
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// BatchHandler обрабатывает пакет сообщений одного топика целиком: либо все сообщения
+// сохранены, либо возвращается ошибка и пакет будет разделен
+type BatchHandler func(ctx context.Context, messages []*sarama.ConsumerMessage) error
+
+// batchStats счетчики пакетной обработки
+type batchStats struct {
+	mu        sync.Mutex
+	batches   uint64
+	messages  uint64
+	splits    uint64
+	fallbacks uint64
+	lastSize  int
+	lastTook  time.Duration
+}
+
+func newBatchStats() *batchStats {
+	return &batchStats{}
+}
+
+func (s *batchStats) recordBatch(size int, took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batches++
+	s.messages += uint64(size)
+	s.lastSize = size
+	s.lastTook = took
+}
+
+func (s *batchStats) recordSplit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.splits++
+}
+
+func (s *batchStats) recordFallback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fallbacks++
+}
+
+func (s *batchStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return map[string]interface{}{
+		"batches":      s.batches,
+		"messages":     s.messages,
+		"splits":       s.splits,
+		"fallbacks":    s.fallbacks,
+		"last_size":    s.lastSize,
+		"last_took_ms": s.lastTook.Milliseconds(),
+	}
+}
+
+// RegisterBatchHandler регистрирует пакетный обработчик топика. Он используется вместо
+// обычного обработчика, если включен пакетный режим (KAFKA_BATCH_SIZE > 1)
+func (k *KafkaService) RegisterBatchHandler(topic string, handler BatchHandler) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.batchHandlers[topic] = handler
+}
+
+// batchHandler возвращает пакетный обработчик топика, если пакетный режим включен.
+// Топики повторов читаются по одному сообщению: их сообщения ждут своего времени.
+func (k *KafkaService) batchHandler(topic string) (BatchHandler, bool) {
+	if !k.config.IsBatchMode() {
+		return nil, false
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	handler, ok := k.batchHandlers[topic]
+
+	return handler, ok
+}
+
+// consumeBatches читает claim пакетами до KAFKA_BATCH_SIZE сообщений или KAFKA_BATCH_TIMEOUT
+// ожидания и подтверждает offset только после обработки всего пакета
+func (k *KafkaService) consumeBatches(
+	session sarama.ConsumerGroupSession,
+	claim sarama.ConsumerGroupClaim,
+	handler BatchHandler,
+) error {
+	batch := make([]*sarama.ConsumerMessage, 0, k.config.BatchSize)
+
+	var timeout <-chan time.Time
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		started := time.Now()
+
+		if err := k.processBatch(session.Context(), handler, batch); err != nil {
+			log.Printf("Пакет из топика %s, partition: %d, offsets %d-%d не подтвержден: %v",
+				claim.Topic(), claim.Partition(), batch[0].Offset, batch[len(batch)-1].Offset, err)
+
+			return err
+		}
+
+		k.batches.recordBatch(len(batch), time.Since(started))
+
+		// Сообщения одного claim идут по возрастанию offset, достаточно отметить последнее
+		session.MarkMessage(batch[len(batch)-1], "")
+
+		if k.config.IsManualCommit() {
+			session.Commit()
+		}
+
+		batch = batch[:0]
+		timeout = nil
+
+		return nil
+	}
+
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return flush()
+			}
+
+			k.lag.recordMessage(message)
+
+			batch = append(batch, message)
+			if len(batch) == 1 {
+				timeout = time.After(k.config.GetBatchTimeout())
+			}
+
+			if len(batch) >= k.config.BatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+
+		case <-timeout:
+			if err := flush(); err != nil {
+				return err
+			}
+
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// processBatch передает пакет обработчику. При ошибке пакет делится пополам, пока
+// сбойное сообщение не останется одно: его обрабатывает обычный путь с повторами и DLQ.
+// Возвращает ошибку только если сообщения пакета нельзя подтверждать.
+func (k *KafkaService) processBatch(ctx context.Context, handler BatchHandler, batch []*sarama.ConsumerMessage) error {
+	if len(batch) == 1 {
+		k.batches.recordFallback()
+
+		return k.processMessage(ctx, batch[0])
+	}
+
+	err := handler(ctx, batch)
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	k.batches.recordSplit()
+	log.Printf("Ошибка обработки пакета из %d сообщений, делим пакет: %v", len(batch), err)
+
+	middle := len(batch) / 2
+	if err := k.processBatch(ctx, handler, batch[:middle]); err != nil {
+		return err
+	}
+
+	return k.processBatch(ctx, handler, batch[middle:])
+}
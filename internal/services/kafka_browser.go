@@ -0,0 +1,270 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+)
+
+// defaultBrowseLimit число сообщений в ответе, если limit не задан
+const defaultBrowseLimit = 20
+
+// BrowseRequest параметры просмотра сообщений партиции. Без FromOffset и FromTimestamp
+// возвращаются последние Limit сообщений (с фильтром — последние совпавшие среди
+// KAFKA_BROWSE_MAX_SCAN последних), иначе первые Limit сообщений начиная с указанной позиции.
+type BrowseRequest struct {
+	Topic         string
+	Partition     int32
+	Limit         int
+	FromOffset    *int64
+	FromTimestamp *time.Time
+
+	// Фильтры: точное совпадение ключа и значения поля JSON по пути через точку
+	// (например, delivery.city)
+	Key   string
+	Field string
+	Value string
+}
+
+// BrowsedMessage сообщение топика в ответе просмотра. Тело в формате JSON возвращается
+// как есть в Payload, остальное — строкой в Raw.
+type BrowsedMessage struct {
+	Partition int32             `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Key       string            `json:"key"`
+	Timestamp time.Time         `json:"timestamp"`
+	Headers   map[string]string `json:"headers"`
+	Size      int               `json:"size"`
+	Payload   json.RawMessage   `json:"payload,omitempty"`
+	Raw       string            `json:"raw,omitempty"`
+}
+
+// BrowseResult результат просмотра партиции
+type BrowseResult struct {
+	Topic        string           `json:"topic"`
+	Partition    int32            `json:"partition"`
+	OldestOffset int64            `json:"oldest_offset"`
+	NewestOffset int64            `json:"newest_offset"`
+	StartOffset  int64            `json:"start_offset"`
+	NextOffset   int64            `json:"next_offset"`
+	Scanned      int              `json:"scanned"`
+	Truncated    bool             `json:"truncated"`
+	TimedOut     bool             `json:"timed_out"`
+	Messages     []BrowsedMessage `json:"messages"`
+}
+
+// BrowseMessages читает сообщения партиции отдельным клиентом без consumer group:
+// offset'ы не фиксируются, и чтение не влияет на группу сервиса
+func (k *KafkaService) BrowseMessages(request BrowseRequest) (*BrowseResult, error) {
+	if request.Topic == "" {
+		return nil, eris.New("топик не указан")
+	}
+
+	if request.Field != "" && request.Value == "" {
+		return nil, eris.New("для фильтра по полю нужно указать value")
+	}
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = defaultBrowseLimit
+	}
+
+	if limit > k.config.GetBrowseMaxMessages() {
+		limit = k.config.GetBrowseMaxMessages()
+	}
+
+	saramaConfig, err := newSaramaConfig(k.config)
+	if err != nil {
+		return nil, err
+	}
+
+	saramaConfig.ClientID += "-browser"
+	saramaConfig.Consumer.Return.Errors = true
+
+	client, err := sarama.NewClient(k.config.GetBrokers(), saramaConfig)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to create browser client")
+	}
+	defer client.Close()
+
+	oldest, err := client.GetOffset(request.Topic, request.Partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to get oldest offset of %s/%d", request.Topic, request.Partition)
+	}
+
+	newest, err := client.GetOffset(request.Topic, request.Partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to get newest offset of %s/%d", request.Topic, request.Partition)
+	}
+
+	filtered := request.Key != "" || request.Field != ""
+	tail := request.FromOffset == nil && request.FromTimestamp == nil
+
+	var start int64
+
+	switch {
+	case request.FromOffset != nil:
+		start = *request.FromOffset
+	case request.FromTimestamp != nil:
+		// Брокер возвращает первый offset с временем не раньше заданного или -1, если таких нет
+		start, err = client.GetOffset(request.Topic, request.Partition, request.FromTimestamp.UnixMilli())
+		if err != nil {
+			return nil, eris.Wrapf(err, "failed to get offset by timestamp of %s/%d", request.Topic, request.Partition)
+		}
+
+		if start < 0 {
+			start = newest
+		}
+	case filtered:
+		start = newest - int64(k.config.GetBrowseMaxScan())
+	default:
+		start = newest - int64(limit)
+	}
+
+	if start < oldest {
+		start = oldest
+	}
+
+	if start > newest {
+		start = newest
+	}
+
+	result := &BrowseResult{
+		Topic:        request.Topic,
+		Partition:    request.Partition,
+		OldestOffset: oldest,
+		NewestOffset: newest,
+		StartOffset:  start,
+		NextOffset:   start,
+		Messages:     []BrowsedMessage{},
+	}
+
+	if start >= newest {
+		return result, nil
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to create browser consumer")
+	}
+	defer consumer.Close()
+
+	partitionConsumer, err := consumer.ConsumePartition(request.Topic, request.Partition, start)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to consume %s/%d", request.Topic, request.Partition)
+	}
+	defer partitionConsumer.AsyncClose()
+
+	deadline := time.NewTimer(k.config.GetBrowseTimeout())
+	defer deadline.Stop()
+
+	for {
+		select {
+		case message := <-partitionConsumer.Messages():
+			result.Scanned++
+			result.NextOffset = message.Offset + 1
+
+			if browseMatches(request, message) {
+				result.Messages = append(result.Messages, browsedMessage(message))
+			}
+
+			// В режиме хвоста остаются последние limit совпавших сообщений
+			if tail && len(result.Messages) > limit {
+				result.Messages = result.Messages[1:]
+			}
+
+			if message.Offset >= newest-1 {
+				return result, nil
+			}
+
+			if !tail && len(result.Messages) >= limit {
+				result.Truncated = true
+				return result, nil
+			}
+
+			if result.Scanned >= k.config.GetBrowseMaxScan() {
+				result.Truncated = true
+				return result, nil
+			}
+
+		case consumerErr := <-partitionConsumer.Errors():
+			return nil, eris.Wrapf(consumerErr.Err, "failed to read %s/%d", request.Topic, request.Partition)
+
+		case <-deadline.C:
+			// Отдаем прочитанное: конец партиции мог быть пропущен из-за сжатия лога
+			// или управляющих записей транзакций
+			result.TimedOut = true
+			return result, nil
+		}
+	}
+}
+
+func browseMatches(request BrowseRequest, message *sarama.ConsumerMessage) bool {
+	if request.Key != "" && string(message.Key) != request.Key {
+		return false
+	}
+
+	if request.Field == "" {
+		return true
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(message.Value))
+	decoder.UseNumber()
+
+	var payload interface{}
+	if err := decoder.Decode(&payload); err != nil {
+		return false
+	}
+
+	value, ok := jsonField(payload, request.Field)
+
+	return ok && fmt.Sprint(value) == request.Value
+}
+
+// jsonField возвращает значение по пути через точку; индексы массивов не поддерживаются
+func jsonField(payload interface{}, path string) (interface{}, bool) {
+	current := payload
+
+	for _, part := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if current, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+func browsedMessage(message *sarama.ConsumerMessage) BrowsedMessage {
+	browsed := BrowsedMessage{
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Key:       string(message.Key),
+		Timestamp: message.Timestamp,
+		Headers:   make(map[string]string, len(message.Headers)),
+		Size:      len(message.Value),
+	}
+
+	for _, header := range message.Headers {
+		if header != nil {
+			browsed.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+
+	if json.Valid(message.Value) {
+		browsed.Payload = json.RawMessage(message.Value)
+	} else {
+		browsed.Raw = string(message.Value)
+	}
+
+	return browsed
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+	"github.com/xdg-go/scram"
+	"wb/config"
+)
+
+// newSaramaConfig собирает конфигурацию sarama из KafkaConfig: версия, таймауты,
+// ребалансировка, TLS и SASL общие для consumer group, producer и клиента
+func newSaramaConfig(cfg *config.KafkaConfig) (*sarama.Config, error) {
+	saramaConfig := sarama.NewConfig()
+	if cfg.ClientID != "" {
+		saramaConfig.ClientID = cfg.ClientID
+	}
+
+	version, err := sarama.ParseKafkaVersion(cfg.GetVersion())
+	if err != nil {
+		return nil, eris.Wrapf(err, "invalid kafka version %q", cfg.Version)
+	}
+
+	saramaConfig.Version = version
+
+	switch cfg.GetRebalanceStrategy() {
+	case "range":
+		saramaConfig.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRange()}
+	case "sticky":
+		saramaConfig.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategySticky()}
+	default:
+		saramaConfig.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRoundRobin()}
+	}
+
+	if cfg.GroupInstanceID != "" {
+		saramaConfig.Consumer.Group.InstanceId = cfg.GroupInstanceID
+	}
+
+	if strings.ToLower(cfg.AutoOffset) == "latest" {
+		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+	} else {
+		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+
+	if cfg.SessionTimeout > 0 {
+		saramaConfig.Consumer.Group.Session.Timeout = cfg.SessionTimeout
+		// Heartbeat должен быть заметно меньше таймаута сессии, обычно не больше трети
+		if heartbeat := cfg.SessionTimeout / 3; heartbeat < saramaConfig.Consumer.Group.Heartbeat.Interval {
+			saramaConfig.Consumer.Group.Heartbeat.Interval = heartbeat
+		}
+	}
+
+	if cfg.MaxWaitTime > 0 {
+		saramaConfig.Consumer.MaxWaitTime = cfg.MaxWaitTime
+	}
+
+	if cfg.MaxBytes > 0 {
+		saramaConfig.Consumer.Fetch.Max = int32(cfg.MaxBytes)
+		if saramaConfig.Consumer.Fetch.Default > saramaConfig.Consumer.Fetch.Max {
+			saramaConfig.Consumer.Fetch.Default = saramaConfig.Consumer.Fetch.Max
+		}
+	}
+
+	// В ручном режиме offset фиксируется только после сохранения заказа
+	saramaConfig.Consumer.Offsets.AutoCommit.Enable = !cfg.IsManualCommit()
+	saramaConfig.Consumer.Offsets.AutoCommit.Interval = 1 * time.Second
+
+	// Ошибки consumer group читает супервизор: по ним видно, что соединение деградировало
+	saramaConfig.Consumer.Return.Errors = true
+
+	saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	saramaConfig.Producer.Retry.Max = 3
+	saramaConfig.Producer.Return.Successes = true
+	saramaConfig.Producer.Return.Errors = true
+
+	codec, err := cfg.GetProducerCompression()
+	if err != nil {
+		return nil, err
+	}
+
+	saramaConfig.Producer.Compression = codec
+
+	// Пакеты копит только асинхронный producer: синхронный отправляет каждое сообщение сразу.
+	// Без linger пакет по числу сообщений мог бы ждать добора бесконечно
+	if cfg.IsAsyncProducer() && cfg.ProducerLinger > 0 {
+		saramaConfig.Producer.Flush.Frequency = cfg.ProducerLinger
+		saramaConfig.Producer.Flush.Messages = cfg.GetProducerBatchSize()
+	}
+
+	// Идемпотентный producer не дублирует сообщения при повторах, но требует
+	// подтверждения всех реплик и не больше одного запроса в полете на брокер
+	if cfg.ProducerIdempotent {
+		saramaConfig.Producer.Idempotent = true
+		saramaConfig.Net.MaxOpenRequests = 1
+	}
+
+	if cfg.TLSEnabled {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
+
+	if mechanism := cfg.GetSASLMechanism(); mechanism != "" {
+		saramaConfig.Net.SASL.Enable = true
+		saramaConfig.Net.SASL.User = cfg.SASLUser
+		saramaConfig.Net.SASL.Password = cfg.SASLPassword
+		saramaConfig.Net.SASL.Handshake = true
+
+		switch mechanism {
+		case config.SASLMechanismSCRAMSHA256:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hashGenerator: scram.SHA256}
+			}
+		case config.SASLMechanismSCRAMSHA512:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hashGenerator: scram.SHA512}
+			}
+		default:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		}
+	}
+
+	if err := saramaConfig.Validate(); err != nil {
+		return nil, eris.Wrap(err, "invalid sarama configuration")
+	}
+
+	return saramaConfig, nil
+}
+
+// newTLSConfig загружает CA и клиентский сертификат из файлов
+func newTLSConfig(cfg *config.KafkaConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify, //nolint:gosec // явно включается через KAFKA_TLS_INSECURE_SKIP_VERIFY
+	}
+
+	if cfg.TLSCAFile != "" {
+		caPEM, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, eris.Wrapf(err, "failed to read kafka CA file %s", cfg.TLSCAFile)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, eris.Errorf("no certificates found in kafka CA file %s", cfg.TLSCAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to load kafka client certificate")
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// scramClient адаптирует SCRAM-клиент xdg-go/scram (RFC 5802) к интерфейсу sarama.SCRAMClient
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return eris.Wrap(err, "failed to create SCRAM client")
+	}
+
+	c.conversation = client.NewConversation()
+
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	response, err := c.conversation.Step(challenge)
+	if err != nil {
+		return "", eris.Wrap(err, "SCRAM exchange failed")
+	}
+
+	return response, nil
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+)
+
+// Заголовки, которыми помечается сообщение при пересылке в DLQ или топик повторов
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderError             = "x-error"
+	HeaderAttemptCount      = "x-attempt-count"
+	HeaderFailedAt          = "x-failed-at"
+
+	// HeaderOriginalTimestamp время исходного сообщения в миллисекундах: по нему определяется
+	// версия заказа без x-order-version, иначе пересланная копия получила бы более новое время брокера
+	HeaderOriginalTimestamp = "x-original-timestamp"
+)
+
+// deadLetterStats счетчики dead letter очереди
+type deadLetterStats struct {
+	mu        sync.Mutex
+	published uint64
+	failed    uint64
+	dropped   uint64
+	byTopic   map[string]uint64
+	lastError string
+	lastAt    time.Time
+}
+
+func newDeadLetterStats() *deadLetterStats {
+	return &deadLetterStats{
+		byTopic: make(map[string]uint64),
+	}
+}
+
+func (s *deadLetterStats) recordPublished(topic string, cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.published++
+	s.byTopic[topic]++
+	s.lastError = cause.Error()
+	s.lastAt = time.Now()
+}
+
+func (s *deadLetterStats) recordFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed++
+}
+
+func (s *deadLetterStats) recordDropped(cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropped++
+	s.lastError = cause.Error()
+	s.lastAt = time.Now()
+}
+
+func (s *deadLetterStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byTopic := make(map[string]uint64, len(s.byTopic))
+	for topic, count := range s.byTopic {
+		byTopic[topic] = count
+	}
+
+	stats := map[string]interface{}{
+		"published":  s.published,
+		"failed":     s.failed,
+		"dropped":    s.dropped,
+		"by_topic":   byTopic,
+		"last_error": s.lastError,
+	}
+
+	if !s.lastAt.IsZero() {
+		stats["last_at"] = s.lastAt.Format(time.RFC3339)
+	}
+
+	return stats
+}
+
+// sendToDeadLetter публикует необработанное сообщение в dead letter топик.
+// Возвращает ошибку, если сообщение не удалось сохранить ни в одном месте,
+// в этом случае его нельзя подтверждать.
+func (k *KafkaService) sendToDeadLetter(ctx context.Context, message *sarama.ConsumerMessage, cause error, attempts int) error {
+	if !k.config.DeadLetterEnabled {
+		k.deadLetters.recordDropped(cause)
+
+		return nil
+	}
+
+	// Для ошибок валидации прикладываем машиночитаемый список нарушений
+	var extra []sarama.RecordHeader
+	if header, ok := validationHeader(cause); ok {
+		extra = append(extra, header)
+	}
+
+	err := k.forwardFailedMessage(ctx, k.config.GetDeadLetterTopic(), message, cause, attempts, extra...)
+	if err != nil {
+		k.deadLetters.recordFailed()
+
+		return eris.Wrapf(err, "failed to send message to dead letter topic %s", k.config.GetDeadLetterTopic())
+	}
+
+	k.deadLetters.recordPublished(originalTopic(message), cause)
+
+	return nil
+}
+
+// forwardFailedMessage публикует копию сообщения в служебный топик (DLQ или топик повторов).
+// Correlation и trace ID переносятся из ctx, поэтому повторы и DLQ остаются в той же цепочке
+func (k *KafkaService) forwardFailedMessage(
+	ctx context.Context,
+	topic string,
+	message *sarama.ConsumerMessage,
+	cause error,
+	attempts int,
+	extra ...sarama.RecordHeader,
+) error {
+	if _, err := k.sendAndWait(ctx, failedMessageCopy(topic, message, cause, attempts, extra...)); err != nil {
+		return eris.Wrapf(err, "failed to forward message to topic %s", topic)
+	}
+
+	return nil
+}
+
+// failedMessageCopy готовит копию сообщения для служебного топика, сохраняя заголовки
+// producer'а (формат, версию схемы и заказа) и добавляя после них исходные координаты
+// сообщения и причину ошибки
+func failedMessageCopy(
+	topic string,
+	message *sarama.ConsumerMessage,
+	cause error,
+	attempts int,
+	extra ...sarama.RecordHeader,
+) *sarama.ProducerMessage {
+	// Если сообщение уже пересылалось, сохраняем координаты самого первого сообщения
+	partition := headerValue(message.Headers, HeaderOriginalPartition)
+	if partition == "" {
+		partition = strconv.FormatInt(int64(message.Partition), 10)
+	}
+
+	offset := headerValue(message.Headers, HeaderOriginalOffset)
+	if offset == "" {
+		offset = strconv.FormatInt(message.Offset, 10)
+	}
+
+	if timestamp := originalTimestamp(message); timestamp != "" {
+		extra = append(extra, sarama.RecordHeader{Key: []byte(HeaderOriginalTimestamp), Value: []byte(timestamp)})
+	}
+
+	diagnostics := append([]sarama.RecordHeader{
+		{Key: []byte(HeaderOriginalTopic), Value: []byte(originalTopic(message))},
+		{Key: []byte(HeaderOriginalPartition), Value: []byte(partition)},
+		{Key: []byte(HeaderOriginalOffset), Value: []byte(offset)},
+		{Key: []byte(HeaderError), Value: []byte(cause.Error())},
+		{Key: []byte(HeaderAttemptCount), Value: []byte(strconv.Itoa(attempts))},
+		{Key: []byte(HeaderFailedAt), Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	}, extra...)
+
+	forwarded := &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: append(preservedHeaders(message.Headers, diagnostics), diagnostics...),
+	}
+
+	if message.Key != nil {
+		forwarded.Key = sarama.ByteEncoder(message.Key)
+	}
+
+	return forwarded
+}
+
+// preservedHeaders возвращает заголовки исходного сообщения, которые переносятся при пересылке.
+// Служебные заголовки прошлых пересылок отбрасываются: новые значения задаются в diagnostics,
+// а устаревший уровень повтора или список нарушений не должны попасть в следующий топик
+func preservedHeaders(headers []*sarama.RecordHeader, diagnostics []sarama.RecordHeader) []sarama.RecordHeader {
+	replaced := make(map[string]bool, len(diagnostics))
+	for _, header := range diagnostics {
+		replaced[string(header.Key)] = true
+	}
+
+	preserved := make([]sarama.RecordHeader, 0, len(headers))
+
+	for _, header := range headers {
+		if header == nil {
+			continue
+		}
+
+		switch key := string(header.Key); {
+		case replaced[key], key == HeaderRetryTier, key == HeaderRetryNotBefore, key == HeaderValidationErrors:
+			continue
+		}
+
+		preserved = append(preserved, *header)
+	}
+
+	return preserved
+}
+
+// originalTopic возвращает топик, в который сообщение было опубликовано изначально
+func originalTopic(message *sarama.ConsumerMessage) string {
+	if topic := headerValue(message.Headers, HeaderOriginalTopic); topic != "" {
+		return topic
+	}
+
+	return message.Topic
+}
+
+// originalTimestamp возвращает время самого первого сообщения в миллисекундах
+// или пустую строку, если брокер его не передал
+func originalTimestamp(message *sarama.ConsumerMessage) string {
+	if timestamp := headerValue(message.Headers, HeaderOriginalTimestamp); timestamp != "" {
+		return timestamp
+	}
+
+	if message.Timestamp.IsZero() {
+		return ""
+	}
+
+	return strconv.FormatInt(message.Timestamp.UnixMilli(), 10)
+}
+
+// previousAttempts возвращает число попыток обработки, сделанных до пересылки сообщения
+func previousAttempts(message *sarama.ConsumerMessage) int {
+	attempts, err := strconv.Atoi(headerValue(message.Headers, HeaderAttemptCount))
+	if err != nil {
+		return 0
+	}
+
+	return attempts
+}
+
+// headerValue возвращает значение заголовка сообщения или пустую строку
+func headerValue(headers []*sarama.RecordHeader, key string) string {
+	for _, header := range headers {
+		if header != nil && string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+)
+
+// Заголовки сквозной трассировки сообщений
+const (
+	HeaderCorrelationID = "x-correlation-id"
+	HeaderTraceID       = "x-trace-id"
+	// HeaderTraceParent W3C Trace Context, из него берется trace ID, если нет x-trace-id
+	HeaderTraceParent = "traceparent"
+)
+
+type contextKey string
+
+const (
+	correlationIDKey contextKey = "correlation_id"
+	traceIDKey       contextKey = "trace_id"
+	metadataKey      contextKey = "message_metadata"
+)
+
+// MessageMetadata сведения о сообщении Kafka, которые получает обработчик
+type MessageMetadata struct {
+	// Topic исходный топик: для сообщений из топиков повторов — топик, куда сообщение
+	// было опубликовано изначально
+	Topic         string            `json:"topic"`
+	SourceTopic   string            `json:"source_topic"`
+	Partition     int32             `json:"partition"`
+	Offset        int64             `json:"offset"`
+	Key           string            `json:"key"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Headers       map[string]string `json:"headers"`
+	CorrelationID string            `json:"correlation_id"`
+	TraceID       string            `json:"trace_id"`
+	ReceivedAt    time.Time         `json:"received_at"`
+}
+
+// String возвращает координаты сообщения и его идентификаторы для логов
+func (m MessageMetadata) String() string {
+	return fmt.Sprintf("%s/%d@%d correlation_id=%s trace_id=%s",
+		m.SourceTopic, m.Partition, m.Offset, m.CorrelationID, m.TraceID)
+}
+
+// newMessageMetadata извлекает метаданные из сообщения. Если producer не передал
+// correlation ID, он создается, чтобы сообщение можно было проследить дальше по цепочке.
+func newMessageMetadata(message *sarama.ConsumerMessage) MessageMetadata {
+	headers := make(map[string]string, len(message.Headers))
+	for _, header := range message.Headers {
+		if header != nil {
+			headers[string(header.Key)] = string(header.Value)
+		}
+	}
+
+	meta := MessageMetadata{
+		Topic:         originalTopic(message),
+		SourceTopic:   message.Topic,
+		Partition:     message.Partition,
+		Offset:        message.Offset,
+		Key:           string(message.Key),
+		Timestamp:     message.Timestamp,
+		Headers:       headers,
+		CorrelationID: headers[HeaderCorrelationID],
+		TraceID:       headers[HeaderTraceID],
+		ReceivedAt:    time.Now(),
+	}
+
+	if meta.TraceID == "" {
+		meta.TraceID = traceIDFromTraceParent(headers[HeaderTraceParent])
+	}
+
+	if meta.CorrelationID == "" {
+		meta.CorrelationID = uuid.NewString()
+	}
+
+	return meta
+}
+
+// withMessageMetadata кладет метаданные сообщения и его идентификаторы в контекст
+func withMessageMetadata(ctx context.Context, meta MessageMetadata) context.Context {
+	ctx = context.WithValue(ctx, metadataKey, meta)
+	ctx = WithCorrelationID(ctx, meta.CorrelationID)
+
+	return WithTraceID(ctx, meta.TraceID)
+}
+
+// MessageMetadataFromContext возвращает метаданные сообщения, которое сейчас обрабатывается
+func MessageMetadataFromContext(ctx context.Context) (MessageMetadata, bool) {
+	meta, ok := ctx.Value(metadataKey).(MessageMetadata)
+
+	return meta, ok
+}
+
+// WithCorrelationID задает correlation ID для сообщений, отправляемых с этим контекстом
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	if correlationID == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, correlationIDKey, correlationID)
+}
+
+// CorrelationIDFromContext возвращает correlation ID из контекста или пустую строку
+func CorrelationIDFromContext(ctx context.Context) string {
+	correlationID, _ := ctx.Value(correlationIDKey).(string)
+
+	return correlationID
+}
+
+// WithTraceID задает trace ID для сообщений, отправляемых с этим контекстом
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	if traceID == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, traceIDKey, traceID)
+}
+
+// TraceIDFromContext возвращает trace ID из контекста или пустую строку
+func TraceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey).(string)
+
+	return traceID
+}
+
+// injectTraceHeaders добавляет в исходящее сообщение correlation и trace ID из контекста.
+// Заголовки, заданные вызывающим явно, не перезаписываются; без correlation ID в контексте
+// создается новый.
+func injectTraceHeaders(ctx context.Context, msg *sarama.ProducerMessage) {
+	if producerHeaderValue(msg.Headers, HeaderCorrelationID) == "" {
+		correlationID := CorrelationIDFromContext(ctx)
+		if correlationID == "" {
+			correlationID = uuid.NewString()
+		}
+
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(HeaderCorrelationID),
+			Value: []byte(correlationID),
+		})
+	}
+
+	if traceID := TraceIDFromContext(ctx); traceID != "" && producerHeaderValue(msg.Headers, HeaderTraceID) == "" {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(HeaderTraceID),
+			Value: []byte(traceID),
+		})
+	}
+}
+
+// recordHeaders переводит заголовки из map в формат sarama в стабильном порядке ключей
+func recordHeaders(headers map[string]string) []sarama.RecordHeader {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	records := make([]sarama.RecordHeader, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, sarama.RecordHeader{Key: []byte(key), Value: []byte(headers[key])})
+	}
+
+	return records
+}
+
+func producerHeaderValue(headers []sarama.RecordHeader, key string) string {
+	for _, header := range headers {
+		if string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+
+	return ""
+}
+
+// traceIDFromTraceParent извлекает trace ID из заголовка W3C traceparent
+// (version-traceid-parentid-flags)
+func traceIDFromTraceParent(traceParent string) string {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return ""
+	}
+
+	return parts[1]
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+)
+
+// PartitionLag состояние партиции для consumer group
+type PartitionLag struct {
+	Topic              string     `json:"topic"`
+	Partition          int32      `json:"partition"`
+	CommittedOffset    int64      `json:"committed_offset"`
+	HighWaterMark      int64      `json:"high_water_mark"`
+	Lag                int64      `json:"lag"`
+	LastConsumedOffset int64      `json:"last_consumed_offset"`
+	LastMessageAt      *time.Time `json:"last_message_at,omitempty"`
+	LastError          string     `json:"last_error,omitempty"`
+	LastErrorAt        *time.Time `json:"last_error_at,omitempty"`
+}
+
+// LagReport отставание consumer group по всем топикам подписки
+type LagReport struct {
+	GroupID     string           `json:"group_id"`
+	TotalLag    int64            `json:"total_lag"`
+	Topics      map[string]int64 `json:"topics"`
+	Partitions  []PartitionLag   `json:"partitions"`
+	Errors      []string         `json:"errors,omitempty"`
+	CollectedAt time.Time        `json:"collected_at"`
+}
+
+// LagSample точка временного ряда отставания
+type LagSample struct {
+	At       time.Time        `json:"at"`
+	TotalLag int64            `json:"total_lag"`
+	Topics   map[string]int64 `json:"topics"`
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// partitionActivity последнее прочитанное сообщение и последняя ошибка по партиции
+type partitionActivity struct {
+	lastOffset    int64
+	lastMessageAt time.Time
+	lastError     string
+	lastErrorAt   time.Time
+}
+
+// lagTracker собирает активность партиций и хранит историю отставания в кольцевом буфере
+type lagTracker struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionActivity
+	history    []LagSample
+	next       int
+	filled     bool
+	lastError  string
+}
+
+func newLagTracker(size int) *lagTracker {
+	return &lagTracker{
+		partitions: make(map[partitionKey]*partitionActivity),
+		history:    make([]LagSample, size),
+	}
+}
+
+func (t *lagTracker) activity(message *sarama.ConsumerMessage) *partitionActivity {
+	key := partitionKey{topic: message.Topic, partition: message.Partition}
+
+	activity, ok := t.partitions[key]
+	if !ok {
+		activity = &partitionActivity{lastOffset: -1}
+		t.partitions[key] = activity
+	}
+
+	return activity
+}
+
+func (t *lagTracker) recordMessage(message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	activity := t.activity(message)
+	activity.lastOffset = message.Offset
+	activity.lastMessageAt = message.Timestamp
+}
+
+func (t *lagTracker) recordError(message *sarama.ConsumerMessage, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	activity := t.activity(message)
+	activity.lastError = err.Error()
+	activity.lastErrorAt = time.Now()
+}
+
+func (t *lagTracker) fill(lag *PartitionLag) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lag.LastConsumedOffset = -1
+
+	activity, ok := t.partitions[partitionKey{topic: lag.Topic, partition: lag.Partition}]
+	if !ok {
+		return
+	}
+
+	lag.LastConsumedOffset = activity.lastOffset
+
+	if !activity.lastMessageAt.IsZero() {
+		at := activity.lastMessageAt
+		lag.LastMessageAt = &at
+	}
+
+	if activity.lastError != "" {
+		at := activity.lastErrorAt
+		lag.LastError = activity.lastError
+		lag.LastErrorAt = &at
+	}
+}
+
+func (t *lagTracker) recordSample(report *LagReport, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.lastError = err.Error()
+		return
+	}
+
+	t.lastError = ""
+	t.history[t.next] = LagSample{At: report.CollectedAt, TotalLag: report.TotalLag, Topics: report.Topics}
+	t.next = (t.next + 1) % len(t.history)
+
+	if t.next == 0 {
+		t.filled = true
+	}
+}
+
+func (t *lagTracker) snapshot() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var history []LagSample
+	if t.filled {
+		history = append(history, t.history[t.next:]...)
+	}
+
+	history = append(history, t.history[:t.next]...)
+
+	return map[string]interface{}{
+		"history":    history,
+		"last_error": t.lastError,
+	}
+}
+
+// ConsumerLag считает отставание consumer group по топикам текущей подписки:
+// зафиксированный offset группы, high-water mark и разницу между ними по каждой партиции
+func (k *KafkaService) ConsumerLag() (*LagReport, error) {
+	k.mu.RLock()
+	client := k.client
+	topics := append([]string(nil), k.subscription.topics...)
+	k.mu.RUnlock()
+
+	if client == nil || client.Closed() {
+		return nil, eris.New("клиент Kafka не подключен, сначала вызовите Start()")
+	}
+
+	if len(topics) == 0 {
+		topics = k.subscriptionTopics()
+	}
+
+	// Администратор создается поверх общего клиента и не закрывается отдельно:
+	// его Close закрыл бы и клиент consumer group
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to create cluster admin")
+	}
+
+	report := &LagReport{
+		GroupID:     k.config.GetGroupID(),
+		Topics:      make(map[string]int64),
+		CollectedAt: time.Now(),
+	}
+
+	topicPartitions := make(map[string][]int32, len(topics))
+
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			report.Errors = append(report.Errors, topic+": "+err.Error())
+			continue
+		}
+
+		topicPartitions[topic] = partitions
+	}
+
+	committed, err := admin.ListConsumerGroupOffsets(k.config.GetGroupID(), topicPartitions)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to fetch offsets of group %s", k.config.GetGroupID())
+	}
+
+	for topic, partitions := range topicPartitions {
+		for _, partition := range partitions {
+			highWaterMark, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				report.Errors = append(report.Errors, topic+": "+err.Error())
+				continue
+			}
+
+			lag := PartitionLag{
+				Topic:           topic,
+				Partition:       partition,
+				CommittedOffset: -1,
+				HighWaterMark:   highWaterMark,
+			}
+
+			if block := committed.GetBlock(topic, partition); block != nil && block.Err == sarama.ErrNoError {
+				lag.CommittedOffset = block.Offset
+			}
+
+			// Без зафиксированного offset группа прочитает партицию с самого старого сообщения
+			from := lag.CommittedOffset
+			if from < 0 {
+				if from, err = client.GetOffset(topic, partition, sarama.OffsetOldest); err != nil {
+					from = 0
+				}
+			}
+
+			if lag.Lag = highWaterMark - from; lag.Lag < 0 {
+				lag.Lag = 0
+			}
+
+			k.lag.fill(&lag)
+
+			report.Partitions = append(report.Partitions, lag)
+			report.Topics[topic] += lag.Lag
+			report.TotalLag += lag.Lag
+		}
+	}
+
+	sort.Slice(report.Partitions, func(i, j int) bool {
+		if report.Partitions[i].Topic != report.Partitions[j].Topic {
+			return report.Partitions[i].Topic < report.Partitions[j].Topic
+		}
+
+		return report.Partitions[i].Partition < report.Partitions[j].Partition
+	})
+
+	return report, nil
+}
+
+// sampleLag периодически записывает отставание группы во временной ряд
+func (k *KafkaService) sampleLag(ctx context.Context) {
+	ticker := time.NewTicker(k.config.GetLagSampleInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := k.ConsumerLag()
+			if err != nil {
+				log.Printf("Не удалось получить отставание consumer group: %v", err)
+			}
+
+			k.lag.recordSample(report, err)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package services
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+)
+
+// Способы сброса offset'ов consumer group
+const (
+	OffsetResetEarliest  = "earliest"
+	OffsetResetLatest    = "latest"
+	OffsetResetOffset    = "offset"
+	OffsetResetTimestamp = "timestamp"
+)
+
+// OffsetResetRequest параметры сброса offset'ов группы для топика.
+// Пустой список партиций означает все партиции топика.
+type OffsetResetRequest struct {
+	Topic      string    `json:"topic"`
+	Partitions []int32   `json:"partitions"`
+	Strategy   string    `json:"strategy"`
+	Offset     int64     `json:"offset"`
+	Timestamp  time.Time `json:"timestamp"`
+	DryRun     bool      `json:"dry_run"`
+}
+
+// PartitionOffsetReset текущий и новый offset партиции
+type PartitionOffsetReset struct {
+	Partition     int32 `json:"partition"`
+	CurrentOffset int64 `json:"current_offset"`
+	TargetOffset  int64 `json:"target_offset"`
+}
+
+// OffsetResetResult результат (или план при dry_run) сброса offset'ов
+type OffsetResetResult struct {
+	GroupID    string                 `json:"group_id"`
+	Topic      string                 `json:"topic"`
+	Strategy   string                 `json:"strategy"`
+	DryRun     bool                   `json:"dry_run"`
+	Applied    bool                   `json:"applied"`
+	Partitions []PartitionOffsetReset `json:"partitions"`
+}
+
+// Pause останавливает чтение сообщений и выводит consumer из группы, сохраняя подключение
+// к Kafka. Пока consumer на паузе, offset'ы группы можно сбросить через ResetOffsets.
+func (k *KafkaService) Pause() error {
+	k.mu.Lock()
+
+	if !k.isRunning {
+		k.mu.Unlock()
+		return eris.New("consumer не запущен")
+	}
+
+	if k.paused {
+		k.mu.Unlock()
+		return eris.New("consumer уже на паузе")
+	}
+
+	if k.loopCancel == nil {
+		k.mu.Unlock()
+		return eris.Errorf("нет подключения к Kafka, состояние: %s", k.supervisor.current())
+	}
+
+	k.paused = true
+	cancel := k.loopCancel
+	done := k.loopDone
+	consumer := k.consumer
+	k.mu.Unlock()
+
+	cancel()
+	<-done
+
+	k.supervisor.set(KafkaStatePaused, nil)
+
+	// Закрытие consumer group отправляет LeaveGroup: без активных участников группа
+	// принимает новые offset'ы
+	if err := consumer.Close(); err != nil {
+		log.Printf("Ошибка при закрытии consumer: %v", err)
+	}
+
+	log.Println("Потребление сообщений Kafka приостановлено")
+
+	return nil
+}
+
+// Resume заново входит в группу и продолжает чтение с зафиксированных offset'ов
+func (k *KafkaService) Resume() error {
+	k.mu.Lock()
+
+	if !k.paused {
+		k.mu.Unlock()
+		return eris.New("consumer не на паузе")
+	}
+
+	if k.client == nil || k.client.Closed() {
+		k.mu.Unlock()
+		return eris.New("клиент Kafka не подключен")
+	}
+
+	consumer, err := sarama.NewConsumerGroupFromClient(k.config.GetGroupID(), k.client)
+	if err != nil {
+		k.mu.Unlock()
+		return eris.Wrapf(err, "failed to create consumer group")
+	}
+
+	k.consumer = consumer
+	k.paused = false
+	ctx := k.ctx
+	k.mu.Unlock()
+
+	k.startConsumeLoop(ctx)
+	k.supervisor.set(KafkaStateConsuming, nil)
+
+	log.Println("Потребление сообщений Kafka возобновлено")
+
+	return nil
+}
+
+// ResetOffsets переводит offset'ы группы для топика на начало, конец, заданный offset
+// или первое сообщение не раньше заданного времени. Применить сброс можно только на паузе,
+// dry_run лишь показывает offset'ы, которые были бы установлены.
+func (k *KafkaService) ResetOffsets(request OffsetResetRequest) (*OffsetResetResult, error) {
+	k.mu.RLock()
+	client := k.client
+	paused := k.paused
+	k.mu.RUnlock()
+
+	if client == nil || client.Closed() {
+		return nil, eris.New("клиент Kafka не подключен, сначала вызовите Start()")
+	}
+
+	if request.Topic == "" {
+		return nil, eris.New("топик не указан")
+	}
+
+	if !request.DryRun && !paused {
+		return nil, eris.New("сброс offset'ов возможен только на паузе, сначала вызовите /api/kafka/pause")
+	}
+
+	partitions := request.Partitions
+	if len(partitions) == 0 {
+		all, err := client.Partitions(request.Topic)
+		if err != nil {
+			return nil, eris.Wrapf(err, "failed to get partitions of topic %s", request.Topic)
+		}
+
+		partitions = all
+	}
+
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to create cluster admin")
+	}
+
+	committed, err := admin.ListConsumerGroupOffsets(k.config.GetGroupID(), map[string][]int32{request.Topic: partitions})
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to fetch offsets of group %s", k.config.GetGroupID())
+	}
+
+	result := &OffsetResetResult{
+		GroupID:  k.config.GetGroupID(),
+		Topic:    request.Topic,
+		Strategy: request.Strategy,
+		DryRun:   request.DryRun,
+	}
+
+	for _, partition := range partitions {
+		target, err := k.resetTarget(client, request, partition)
+		if err != nil {
+			return nil, err
+		}
+
+		current := int64(-1)
+		if block := committed.GetBlock(request.Topic, partition); block != nil && block.Err == sarama.ErrNoError {
+			current = block.Offset
+		}
+
+		result.Partitions = append(result.Partitions, PartitionOffsetReset{
+			Partition:     partition,
+			CurrentOffset: current,
+			TargetOffset:  target,
+		})
+	}
+
+	if request.DryRun {
+		return result, nil
+	}
+
+	if err := k.commitOffsets(client, request.Topic, result.Partitions); err != nil {
+		return nil, err
+	}
+
+	result.Applied = true
+
+	log.Printf("Offset'ы группы %s для топика %s сброшены (%s)", result.GroupID, request.Topic, request.Strategy)
+
+	return result, nil
+}
+
+// resetTarget вычисляет новый offset партиции в пределах доступных сообщений
+func (k *KafkaService) resetTarget(client sarama.Client, request OffsetResetRequest, partition int32) (int64, error) {
+	oldest, err := client.GetOffset(request.Topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, eris.Wrapf(err, "failed to get oldest offset of %s/%d", request.Topic, partition)
+	}
+
+	newest, err := client.GetOffset(request.Topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, eris.Wrapf(err, "failed to get newest offset of %s/%d", request.Topic, partition)
+	}
+
+	switch request.Strategy {
+	case OffsetResetEarliest:
+		return oldest, nil
+	case OffsetResetLatest:
+		return newest, nil
+	case OffsetResetOffset:
+		return min(max(request.Offset, oldest), newest), nil
+	case OffsetResetTimestamp:
+		if request.Timestamp.IsZero() {
+			return 0, eris.New("не указано время для сброса по timestamp")
+		}
+
+		// Kafka возвращает первый offset с временем не раньше заданного или -1, если таких нет
+		offset, err := client.GetOffset(request.Topic, partition, request.Timestamp.UnixMilli())
+		if err != nil {
+			return 0, eris.Wrapf(err, "failed to find offset by time for %s/%d", request.Topic, partition)
+		}
+
+		if offset < 0 {
+			return newest, nil
+		}
+
+		return offset, nil
+	default:
+		return 0, eris.Errorf("неизвестный способ сброса %q, поддерживаются: earliest, latest, offset, timestamp", request.Strategy)
+	}
+}
+
+// commitOffsets фиксирует новые offset'ы через offset manager группы и проверяет, что брокер их принял
+func (k *KafkaService) commitOffsets(client sarama.Client, topic string, resets []PartitionOffsetReset) error {
+	manager, err := sarama.NewOffsetManagerFromClient(k.config.GetGroupID(), client)
+	if err != nil {
+		return eris.Wrap(err, "failed to create offset manager")
+	}
+
+	managed := make([]sarama.PartitionOffsetManager, 0, len(resets))
+
+	for _, reset := range resets {
+		partitionManager, err := manager.ManagePartition(topic, reset.Partition)
+		if err != nil {
+			for _, pom := range managed {
+				pom.AsyncClose()
+			}
+
+			manager.Close()
+
+			return eris.Wrapf(err, "failed to manage partition %s/%d", topic, reset.Partition)
+		}
+
+		// ResetOffset сдвигает offset только назад, MarkOffset — только вперед
+		partitionManager.ResetOffset(reset.TargetOffset, "")
+		partitionManager.MarkOffset(reset.TargetOffset, "")
+
+		managed = append(managed, partitionManager)
+	}
+
+	manager.Commit()
+
+	for _, pom := range managed {
+		pom.AsyncClose()
+	}
+
+	if err := manager.Close(); err != nil {
+		return eris.Wrap(err, "failed to close offset manager")
+	}
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return eris.Wrap(err, "failed to create cluster admin")
+	}
+
+	partitions := make([]int32, 0, len(resets))
+	for _, reset := range resets {
+		partitions = append(partitions, reset.Partition)
+	}
+
+	committed, err := admin.ListConsumerGroupOffsets(k.config.GetGroupID(), map[string][]int32{topic: partitions})
+	if err != nil {
+		return eris.Wrap(err, "failed to verify committed offsets")
+	}
+
+	for _, reset := range resets {
+		block := committed.GetBlock(topic, reset.Partition)
+		if block == nil || block.Offset != reset.TargetOffset {
+			return eris.Errorf("брокер не принял offset %d для %s/%d: в группе остались активные участники?",
+				reset.TargetOffset, topic, reset.Partition)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+)
+
+// DeliveryResult результат доставки сообщения брокеру
+type DeliveryResult struct {
+	Topic     string        `json:"topic"`
+	Partition int32         `json:"partition"`
+	Offset    int64         `json:"offset"`
+	Latency   time.Duration `json:"latency"`
+	Err       error         `json:"-"`
+
+	CorrelationID string `json:"correlation_id"`
+}
+
+// DeliveryFuture завершается, когда брокер подтвердил сообщение или producer вернул ошибку
+type DeliveryFuture struct {
+	started time.Time
+	done    chan struct{}
+	result  DeliveryResult
+}
+
+func newDeliveryFuture(msg *sarama.ProducerMessage) *DeliveryFuture {
+	return &DeliveryFuture{
+		started: time.Now(),
+		done:    make(chan struct{}),
+		result: DeliveryResult{
+			Topic:         msg.Topic,
+			Partition:     -1,
+			Offset:        -1,
+			CorrelationID: producerHeaderValue(msg.Headers, HeaderCorrelationID),
+		},
+	}
+}
+
+func (f *DeliveryFuture) resolve(partition int32, offset int64, err error) {
+	f.result.Partition = partition
+	f.result.Offset = offset
+	f.result.Latency = time.Since(f.started)
+	f.result.Err = err
+
+	close(f.done)
+}
+
+// Done закрывается после завершения доставки
+func (f *DeliveryFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait ждет завершения доставки или отмены ctx
+func (f *DeliveryFuture) Wait(ctx context.Context) (DeliveryResult, error) {
+	select {
+	case <-f.done:
+		return f.result, f.result.Err
+	case <-ctx.Done():
+		return f.result, eris.Wrap(ctx.Err(), "ожидание доставки прервано")
+	}
+}
+
+// producerStats счетчики отправленных сообщений
+type producerStats struct {
+	mu           sync.Mutex
+	sent         uint64
+	succeeded    uint64
+	failed       uint64
+	totalLatency time.Duration
+	lastError    string
+	lastErrorAt  time.Time
+}
+
+func newProducerStats() *producerStats {
+	return &producerStats{}
+}
+
+func (s *producerStats) recordSent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent++
+}
+
+func (s *producerStats) recordDelivered(result DeliveryResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if result.Err != nil {
+		s.failed++
+		s.lastError = result.Err.Error()
+		s.lastErrorAt = time.Now()
+
+		return
+	}
+
+	s.succeeded++
+	s.totalLatency += result.Latency
+}
+
+func (s *producerStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"sent":       s.sent,
+		"succeeded":  s.succeeded,
+		"failed":     s.failed,
+		"in_flight":  s.sent - s.succeeded - s.failed,
+		"last_error": s.lastError,
+	}
+
+	if s.succeeded > 0 {
+		stats["avg_latency"] = (s.totalLatency / time.Duration(s.succeeded)).String()
+	}
+
+	if !s.lastErrorAt.IsZero() {
+		stats["last_error_at"] = s.lastErrorAt
+	}
+
+	return stats
+}
+
+// SendMessageAsync отправляет сообщение с заголовками и сразу возвращает future доставки.
+// В синхронном режиме producer'а future возвращается уже завершенным.
+func (k *KafkaService) SendMessageAsync(
+	ctx context.Context,
+	topic, key string,
+	message []byte,
+	headers map[string]string,
+) *DeliveryFuture {
+	return k.publish(ctx, &sarama.ProducerMessage{
+		Topic:   topic,
+		Key:     sarama.StringEncoder(key),
+		Value:   sarama.ByteEncoder(message),
+		Headers: recordHeaders(headers),
+	})
+}
+
+// publish передает сообщение producer'у текущего режима, добавив correlation и trace ID из ctx.
+// Producer читается под k.producerMu, поэтому teardown не закроет его, пока сообщение не принято
+// в очередь или не подтверждено брокером. k.mu на время отправки не берется. Если ctx отменен
+// раньше, чем асинхронный producer принял сообщение, future завершается ошибкой отмены.
+func (k *KafkaService) publish(ctx context.Context, msg *sarama.ProducerMessage) *DeliveryFuture {
+	injectTraceHeaders(ctx, msg)
+
+	future := newDeliveryFuture(msg)
+
+	k.producerMu.RLock()
+	defer k.producerMu.RUnlock()
+
+	switch {
+	case ctx.Err() != nil:
+		future.resolve(-1, -1, eris.Wrap(ctx.Err(), "отправка прервана"))
+	case k.asyncProducer != nil:
+		msg.Metadata = future
+
+		k.producerStats.recordSent()
+
+		select {
+		case k.asyncProducer.Input() <- msg:
+		case <-ctx.Done():
+			future.resolve(-1, -1, eris.Wrap(ctx.Err(), "отправка прервана"))
+			k.producerStats.recordDelivered(future.result)
+		}
+	case k.producer != nil:
+		k.producerStats.recordSent()
+
+		partition, offset, err := k.producer.SendMessage(msg)
+		future.resolve(partition, offset, err)
+
+		k.producerStats.recordDelivered(future.result)
+	default:
+		future.resolve(-1, -1, eris.New("producer не инициализирован"))
+	}
+
+	return future
+}
+
+// hasProducer сообщает, что producer подключен
+func (k *KafkaService) hasProducer() bool {
+	k.producerMu.RLock()
+	defer k.producerMu.RUnlock()
+
+	return k.producer != nil || k.asyncProducer != nil
+}
+
+// sendAndWait отправляет сообщение и ждет подтверждения брокера в любом режиме producer'а.
+// ctx задает идентификаторы цепочки и прерывает ожидание: при остановке сервиса отправка
+// завершается ошибкой, и сообщение обрабатывается повторно
+func (k *KafkaService) sendAndWait(ctx context.Context, msg *sarama.ProducerMessage) (DeliveryResult, error) {
+	return k.publish(ctx, msg).Wait(ctx)
+}
+
+// newProducer создает синхронный или асинхронный producer по KAFKA_PRODUCER_MODE.
+// Для асинхронного запускается разбор подтверждений, done закрывается после его завершения.
+func (k *KafkaService) newProducer(saramaConfig *sarama.Config) (sarama.SyncProducer, sarama.AsyncProducer, chan struct{}, error) {
+	if !k.config.IsAsyncProducer() {
+		producer, err := sarama.NewSyncProducer(k.config.GetBrokers(), saramaConfig)
+		if err != nil {
+			return nil, nil, nil, eris.Wrapf(err, "failed to create producer")
+		}
+
+		return producer, nil, nil, nil
+	}
+
+	producer, err := sarama.NewAsyncProducer(k.config.GetBrokers(), saramaConfig)
+	if err != nil {
+		return nil, nil, nil, eris.Wrapf(err, "failed to create async producer")
+	}
+
+	done := make(chan struct{})
+
+	go k.dispatchDeliveries(producer, done)
+
+	return nil, producer, done, nil
+}
+
+// dispatchDeliveries завершает future по подтверждениям и ошибкам асинхронного producer'а
+// до закрытия обоих каналов
+func (k *KafkaService) dispatchDeliveries(producer sarama.AsyncProducer, done chan<- struct{}) {
+	defer close(done)
+
+	successes, errs := producer.Successes(), producer.Errors()
+
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+
+			k.resolveDelivery(msg, nil)
+
+		case producerErr, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			log.Printf("Ошибка доставки сообщения в топик %s: %v", producerErr.Msg.Topic, producerErr.Err)
+			k.resolveDelivery(producerErr.Msg, producerErr.Err)
+		}
+	}
+}
+
+func (k *KafkaService) resolveDelivery(msg *sarama.ProducerMessage, err error) {
+	future, ok := msg.Metadata.(*DeliveryFuture)
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		err = eris.Wrapf(err, "failed to send message to topic %s", msg.Topic)
+	}
+
+	future.resolve(msg.Partition, msg.Offset, err)
+	k.producerStats.recordDelivered(future.result)
+}
+
+// closeProducer закрывает producer. Асинхронный отправляет накопленные пакеты,
+// после чего дожидаемся подтверждений по всем сообщениям
+func closeProducer(syncProducer sarama.SyncProducer, asyncProducer sarama.AsyncProducer, done <-chan struct{}) {
+	if syncProducer != nil {
+		if err := syncProducer.Close(); err != nil {
+			log.Printf("Ошибка при закрытии producer: %v", err)
+		}
+	}
+
+	if asyncProducer != nil {
+		asyncProducer.AsyncClose()
+		<-done
+	}
+}
+
+// producerStatus описывает настройки и счетчики producer'а для GetStatus
+func (k *KafkaService) producerStatus() map[string]interface{} {
+	compression, _ := k.config.GetProducerCompression()
+
+	return map[string]interface{}{
+		"mode":        k.config.GetProducerMode(),
+		"compression": compression.String(),
+		"idempotent":  k.config.ProducerIdempotent,
+		"linger":      k.config.ProducerLinger.String(),
+		"batch_size":  k.config.GetProducerBatchSize(),
+		"stats":       k.producerStats.snapshot(),
+	}
+}
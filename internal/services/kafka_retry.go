@@ -0,0 +1,245 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rotisserie/eris"
+	"wb/internal/orm/repositories"
+)
+
+// Заголовки топиков отложенных повторов
+const (
+	HeaderRetryTier      = "x-retry-tier"
+	HeaderRetryNotBefore = "x-retry-not-before"
+)
+
+// ErrInvalidMessage постоянная ошибка: сообщение некорректно и повторная обработка не поможет
+var ErrInvalidMessage = errors.New("invalid message")
+
+// retryStats счетчики повторной обработки
+type retryStats struct {
+	mu                sync.Mutex
+	inProcessRetries  uint64
+	permanentFailures uint64
+	byTier            map[string]uint64
+}
+
+func newRetryStats() *retryStats {
+	return &retryStats{
+		byTier: make(map[string]uint64),
+	}
+}
+
+func (s *retryStats) recordInProcessRetry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inProcessRetries++
+}
+
+func (s *retryStats) recordPermanentFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.permanentFailures++
+}
+
+func (s *retryStats) recordRouted(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.byTier[topic]++
+}
+
+func (s *retryStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byTier := make(map[string]uint64, len(s.byTier))
+	for topic, count := range s.byTier {
+		byTier[topic] = count
+	}
+
+	return map[string]interface{}{
+		"in_process_retries": s.inProcessRetries,
+		"permanent_failures": s.permanentFailures,
+		"routed_by_tier":     byTier,
+	}
+}
+
+// IsPermanentError определяет, что ошибку нельзя исправить повторной обработкой:
+// некорректный JSON, невалидные данные и нарушения ограничений БД
+func IsPermanentError(err error) bool {
+	if errors.Is(err, ErrInvalidMessage) || errors.Is(err, repositories.ErrIllegalStatusTransition) {
+		return true
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return true
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// 22 — data exception, 23 — integrity constraint violation
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+	}
+
+	return false
+}
+
+// retryTopics возвращает топики отложенных повторов для топика в порядке возрастания задержки
+func (k *KafkaService) retryTopics(topic string) []string {
+	topics := make([]string, 0, len(k.config.RetryDelays))
+	for _, delay := range k.config.RetryDelays {
+		topics = append(topics, k.config.GetRetryTopic(topic, delay))
+	}
+
+	return topics
+}
+
+// processMessage обрабатывает сообщение с повторами и маршрутизацией ошибок.
+// Возвращает ошибку только если сообщение нельзя подтверждать.
+func (k *KafkaService) processMessage(ctx context.Context, message *sarama.ConsumerMessage) error {
+	tier := retryTier(message)
+	if tier >= 0 {
+		if err := waitUntilDue(ctx, message); err != nil {
+			return err
+		}
+	}
+
+	// Метаданные и идентификаторы цепочки общие для всех попыток и пересылок сообщения
+	meta := newMessageMetadata(message)
+	ctx = withMessageMetadata(ctx, meta)
+	topic := meta.Topic
+
+	attempts, err := k.handleWithRetry(ctx, meta, message)
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return eris.Wrap(ctx.Err(), "обработка прервана")
+	}
+
+	attempts += previousAttempts(message)
+
+	k.lag.recordError(message, err)
+
+	log.Printf("Ошибка обработки сообщения из топика %s (попыток: %d) [%s]: %v", topic, attempts, meta, err)
+
+	if IsPermanentError(err) {
+		k.retries.recordPermanentFailure()
+
+		return k.sendToDeadLetter(ctx, message, err, attempts)
+	}
+
+	nextTier := tier + 1
+	if nextTier >= len(k.config.RetryDelays) {
+		return k.sendToDeadLetter(ctx, message, err, attempts)
+	}
+
+	return k.sendToRetryTopic(ctx, message, err, attempts, nextTier)
+}
+
+// handleWithRetry вызывает обработчик, повторяя временные ошибки с экспоненциальной паузой.
+// Возвращает число сделанных попыток и последнюю ошибку.
+func (k *KafkaService) handleWithRetry(
+	ctx context.Context,
+	meta MessageMetadata,
+	message *sarama.ConsumerMessage,
+) (int, error) {
+	backoff := k.config.RetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := k.handleMessage(ctx, meta, message)
+		if err == nil || IsPermanentError(err) || attempt >= k.config.GetRetryMaxAttempts() {
+			return attempt, err
+		}
+
+		k.retries.recordInProcessRetry()
+		log.Printf("Временная ошибка обработки (попытка %d), повтор через %v [%s]: %v", attempt, backoff, meta, err)
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if k.config.RetryMaxBackoff > 0 && backoff > k.config.RetryMaxBackoff {
+			backoff = k.config.RetryMaxBackoff
+		}
+	}
+}
+
+// sendToRetryTopic откладывает сообщение в топик повторов указанного уровня
+func (k *KafkaService) sendToRetryTopic(
+	ctx context.Context,
+	message *sarama.ConsumerMessage,
+	cause error,
+	attempts int,
+	tier int,
+) error {
+	delay := k.config.RetryDelays[tier]
+	topic := k.config.GetRetryTopic(originalTopic(message), delay)
+	notBefore := time.Now().Add(delay)
+
+	err := k.forwardFailedMessage(ctx, topic, message, cause, attempts,
+		sarama.RecordHeader{Key: []byte(HeaderRetryTier), Value: []byte(strconv.Itoa(tier))},
+		sarama.RecordHeader{Key: []byte(HeaderRetryNotBefore), Value: []byte(strconv.FormatInt(notBefore.UnixMilli(), 10))},
+	)
+	if err != nil {
+		return err
+	}
+
+	k.retries.recordRouted(topic)
+	log.Printf("Сообщение отложено в топик %s до %s", topic, notBefore.Format(time.RFC3339))
+
+	return nil
+}
+
+// retryTier возвращает уровень повтора сообщения или -1 для исходного топика
+func retryTier(message *sarama.ConsumerMessage) int {
+	tier, err := strconv.Atoi(headerValue(message.Headers, HeaderRetryTier))
+	if err != nil {
+		return -1
+	}
+
+	return tier
+}
+
+// waitUntilDue ждет наступления времени повтора. В топике повторов все сообщения
+// имеют одинаковую задержку, поэтому ожидание не нарушает порядок обработки.
+func waitUntilDue(ctx context.Context, message *sarama.ConsumerMessage) error {
+	notBefore, err := strconv.ParseInt(headerValue(message.Headers, HeaderRetryNotBefore), 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	wait := time.Until(time.UnixMilli(notBefore))
+	if wait <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return eris.Wrap(ctx.Err(), "ожидание повтора прервано")
+	case <-time.After(wait):
+		return nil
+	}
+}
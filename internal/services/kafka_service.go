@@ -2,22 +2,21 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"log"
-	"strings"
 	"sync"
-	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/rotisserie/eris"
 	"wb/config"
 	"wb/internal/orm/models"
+	"wb/internal/orm/repositories"
 )
 
 const delayToRepeat = 5
 
 type KafkaService struct {
 	config    *config.KafkaConfig
+	client    sarama.Client
 	consumer  sarama.ConsumerGroup
 	producer  sarama.SyncProducer
 	isRunning bool
@@ -25,32 +24,77 @@ type KafkaService struct {
 	handlers  map[string]MessageHandler
 	ctx       context.Context
 	cancel    context.CancelFunc
-	cache     *CacheService
+	cache     orderStore
+	validator *OrderValidator
+	rules     *OrderRuleEngine
+
+	batchHandlers map[string]BatchHandler
+	subscription  subscriptionState
+	loopCancel    context.CancelFunc
+	loopDone      chan struct{}
+	paused        bool
+
+	// reservedTopics топики встроенных обработчиков и их владельцы: конвейеры для них
+	// не создаются, а обработчики не снимаются
+	reservedTopics map[string]string
+	// outputTopics топики, в которые сервис только публикует: создаются вместе с топиками подписки
+	outputTopics map[string]bool
+
+	supervisor     *supervisorState
+	supervisorDone chan struct{}
+	lost           chan error
+	connectedHooks []func()
+
+	// producerMu защищает producer, asyncProducer и producerDone отдельно от k.mu: отправка
+	// держит его на чтение все время обращения к брокеру, а teardown берет на запись,
+	// чтобы закрыть producer только после завершения начатых отправок
+	producerMu    sync.RWMutex
+	asyncProducer sarama.AsyncProducer
+	producerDone  chan struct{}
+	producerStats *producerStats
+
+	deadLetters *deadLetterStats
+	retries     *retryStats
+	batches     *batchStats
+	workerPool  *workerPoolStats
+	lag         *lagTracker
 }
 
-type MessageHandler func(message []byte) error
-
-type OrderMessage struct {
-	OrderID   string                 `json:"order_id"`
-	UserID    string                 `json:"user_id"`
-	Status    string                 `json:"status"`
-	Items     []models.OrderItem     `json:"items"`
-	Payment   models.Payment         `json:"payment"`
-	Delivery  models.Delivery        `json:"delivery"`
-	CreatedAt time.Time              `json:"created_at"`
-	UpdatedAt time.Time              `json:"updated_at"`
-	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+// orderStore сохраняет заказы из Kafka. Реализуется CacheService
+type orderStore interface {
+	SaveOrderFromMessage(order *models.Order, source *models.MessageSource) (repositories.UpsertResult, error)
+	SaveOrdersBatch(orders []*models.Order, sources []*models.MessageSource) ([]repositories.UpsertResult, error)
 }
 
-func NewKafkaService(cfg *config.KafkaConfig, cache *CacheService) (*KafkaService, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+// MessageHandler обрабатывает сообщение Kafka. Контекст несет correlation и trace ID сообщения,
+// поэтому сообщения, отправленные обработчиком с этим контекстом, продолжают ту же цепочку
+type MessageHandler func(ctx context.Context, meta MessageMetadata, message *sarama.ConsumerMessage) error
 
+func NewKafkaService(
+	cfg *config.KafkaConfig,
+	cache *CacheService,
+	validator *OrderValidator,
+	rules *OrderRuleEngine,
+) (*KafkaService, error) {
 	service := &KafkaService{
-		config:   cfg,
-		handlers: make(map[string]MessageHandler),
-		ctx:      ctx,
-		cancel:   cancel,
-		cache:    cache,
+		config:    cfg,
+		handlers:  make(map[string]MessageHandler),
+		cache:     cache,
+		validator: validator,
+		rules:     rules,
+
+		batchHandlers:  make(map[string]BatchHandler),
+		reservedTopics: make(map[string]string),
+		outputTopics:   make(map[string]bool),
+
+		supervisor:    newSupervisorState(),
+		producerStats: newProducerStats(),
+
+		deadLetters: newDeadLetterStats(),
+		retries:     newRetryStats(),
+		batches:     newBatchStats(),
+		workerPool:  newWorkerPoolStats(),
+		lag:         newLagTracker(cfg.GetLagHistorySize()),
 	}
 
 	// Инициализируем обработчики по умолчанию
@@ -61,228 +105,162 @@ func NewKafkaService(cfg *config.KafkaConfig, cache *CacheService) (*KafkaServic
 
 func (k *KafkaService) registerDefaultHandlers() {
 	// Обработчик для сообщений о заказах
-	k.RegisterHandler("orders", func(message []byte) error {
-		var orderMsg OrderMessage
-		if err := json.Unmarshal(message, &orderMsg); err != nil {
-			return eris.Wrapf(err, "failed to unmarshal order message")
+	k.RegisterHandler("orders", func(ctx context.Context, meta MessageMetadata, message *sarama.ConsumerMessage) error {
+		order, err := k.prepareOrder(meta, message)
+		if err != nil {
+			return err
 		}
 
-		// Базовая валидация
-		if strings.TrimSpace(orderMsg.OrderID) == "" {
-			return eris.New("order_id is required")
+		// Сохраняем в БД и обновляем кеш
+		result, err := k.cache.SaveOrderFromMessage(order, messageSource(meta))
+		if err != nil {
+			log.Printf("Ошибка при сохранении заказа [%s]: %v", meta, err)
+			return err
 		}
 
-		log.Printf("Получено сообщение о заказе: %s, статус: %s", orderMsg.OrderID, orderMsg.Status)
+		log.Printf("Заказ %s успешно обработан и сохранен (%s) [%s]", order.OrderUID, result, meta)
 
-		// Преобразуем сообщение в модель Order и сохраняем в БД
-		order := &models.Order{
-			OrderUID:    orderMsg.OrderID,
-			TrackNumber: orderMsg.OrderID, // Используем OrderID как TrackNumber
-			CustomerID:  orderMsg.UserID,
-			TotalAmount: 0, // Будет рассчитано из Items
-		}
+		return nil
+	})
 
-		// Копируем Items и считаем сумму
-		var total int64
-
-		for _, item := range orderMsg.Items {
-			order.Items = append(order.Items, models.OrderItem{
-				ChrtID:      item.ChrtID,
-				TrackNumber: item.TrackNumber,
-				Price:       item.Price,
-				Rid:         item.Rid,
-				Name:        item.Name,
-				Sale:        item.Sale,
-				Size:        item.Size,
-				TotalPrice:  item.TotalPrice,
-				NmID:        item.NmID,
-				Brand:       item.Brand,
-				Status:      item.Status,
-			})
-
-			if item.TotalPrice > 0 {
-				total += int64(item.TotalPrice)
-			} else {
-				total += int64(item.Price)
-			}
-		}
+	// Пакетный обработчик заказов: новые заказы пишутся в БД одной транзакцией
+	k.RegisterBatchHandler("orders", func(ctx context.Context, messages []*sarama.ConsumerMessage) error {
+		orders := make([]*models.Order, 0, len(messages))
+		sources := make([]*models.MessageSource, 0, len(messages))
 
-		order.TotalAmount = float64(int(total))
-
-		// Копируем Payment
-		order.Payment = &models.Payment{
-			Transaction:  orderMsg.Payment.Transaction,
-			RequestID:    orderMsg.Payment.RequestID,
-			Currency:     orderMsg.Payment.Currency,
-			Provider:     orderMsg.Payment.Provider,
-			Amount:       orderMsg.Payment.Amount,
-			PaymentDt:    orderMsg.Payment.PaymentDt,
-			Bank:         orderMsg.Payment.Bank,
-			DeliveryCost: orderMsg.Payment.DeliveryCost,
-			GoodsTotal:   orderMsg.Payment.GoodsTotal,
-			CustomFee:    orderMsg.Payment.CustomFee,
-		}
+		for _, message := range messages {
+			meta := newMessageMetadata(message)
+
+			order, err := k.prepareOrder(meta, message)
+			if err != nil {
+				return err
+			}
 
-		// Копируем Delivery
-		order.Delivery = &models.Delivery{
-			Name:    orderMsg.Delivery.Name,
-			Phone:   orderMsg.Delivery.Phone,
-			Zip:     orderMsg.Delivery.Zip,
-			City:    orderMsg.Delivery.City,
-			Address: orderMsg.Delivery.Address,
-			Region:  orderMsg.Delivery.Region,
-			Email:   orderMsg.Delivery.Email,
+			orders = append(orders, order)
+			sources = append(sources, messageSource(meta))
 		}
 
-		// Сохраняем в БД и обновляем кеш
-		if err := k.cache.SaveOrderToDB(order); err != nil {
-			log.Printf("Ошибка при сохранении заказа: %v", err)
+		if _, err := k.cache.SaveOrdersBatch(orders, sources); err != nil {
 			return err
 		}
 
-		log.Printf("Заказ %s успешно обработан и сохранен", orderMsg.OrderID)
-
 		return nil
 	})
 }
 
-func (k *KafkaService) RegisterHandler(topic string, handler MessageHandler) {
-	k.mu.Lock()
-	defer k.mu.Unlock()
-
-	k.handlers[topic] = handler
-}
-
-func (k *KafkaService) Connect() error {
-	// Настройка конфигурации для consumer
-	consumerConfig := sarama.NewConfig()
-	// Версия брокера из конфигурации, по умолчанию 2.8.0
-	consumerConfig.Version = sarama.V2_8_0_0
-	if k.config.Version != "" {
-		// простая карта поддерживаемых версий
-		switch k.config.Version {
-		case "2.8.0":
-			consumerConfig.Version = sarama.V2_8_0_0
-		case "3.2.0":
-			consumerConfig.Version = sarama.V3_2_0_0
-		}
-	}
-
-	consumerConfig.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
-	if strings.ToLower(k.config.AutoOffset) == "latest" {
-		consumerConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
-	} else {
-		consumerConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+// prepareOrder декодирует сообщение о заказе и проверяет его по схеме и бизнес-правилам
+func (k *KafkaService) prepareOrder(meta MessageMetadata, message *sarama.ConsumerMessage) (*models.Order, error) {
+	// Поддерживаются каноничный формат WB и упрощенный OrderMessage
+	order, err := DecodeOrderMessage(message)
+	if err != nil {
+		return nil, err
 	}
 
-	consumerConfig.Consumer.Offsets.AutoCommit.Enable = true
-	consumerConfig.Consumer.Offsets.AutoCommit.Interval = 1 * time.Second
+	// Идентификаторы цепочки сохраняются вместе с заказом
+	order.CorrelationID = meta.CorrelationID
+	order.TraceID = meta.TraceID
 
-	// Настройка конфигурации для producer
-	producerConfig := sarama.NewConfig()
-	producerConfig.Version = consumerConfig.Version
-	producerConfig.Producer.RequiredAcks = sarama.WaitForAll
-	producerConfig.Producer.Retry.Max = 3
-	producerConfig.Producer.Return.Successes = true
+	log.Printf("Получено сообщение о заказе: %s, трек-номер: %s [%s]", order.OrderUID, order.TrackNumber, meta)
 
-	// Подключение к consumer group
-	consumer, err := sarama.NewConsumerGroup(k.config.GetBrokers(), k.config.GetGroupID(), consumerConfig)
-	if err != nil {
-		return eris.Wrapf(err, "failed to create consumer group")
+	// Проверяем заказ по схеме до обращения к БД
+	if err := k.validator.Validate(order, k.validator.SchemaVersionFor(message)); err != nil {
+		log.Printf("Заказ %s не прошел валидацию [%s]: %v", order.OrderUID, meta, err)
+		return nil, err
 	}
 
-	// Подключение к producer
-	producer, err := sarama.NewSyncProducer(k.config.GetBrokers(), producerConfig)
-	if err != nil {
-		consumer.Close()
-		return eris.Wrapf(err, "failed to create producer")
+	// Проверяем бизнес-инварианты: вердикт сохраняется вместе с заказом
+	if err := k.rules.Evaluate(order); err != nil {
+		return nil, err
 	}
 
-	k.consumer = consumer
-	k.producer = producer
-
-	log.Printf("Успешно подключились к Kafka brokers: %s", k.config.GetBrokersString())
-
-	return nil
+	return order, nil
 }
 
-func (k *KafkaService) StartConsuming() error {
-	if k.consumer == nil {
-		return eris.New("consumer не инициализирован, сначала вызовите Connect()")
+func messageSource(meta MessageMetadata) *models.MessageSource {
+	return &models.MessageSource{
+		Topic:         meta.SourceTopic,
+		Partition:     meta.Partition,
+		Offset:        meta.Offset,
+		CorrelationID: meta.CorrelationID,
+		TraceID:       meta.TraceID,
+		Key:           meta.Key,
+		Timestamp:     meta.Timestamp,
+		ReceivedAt:    meta.ReceivedAt,
+		RoutingRule:   meta.Headers[HeaderRoutingRule],
 	}
+}
 
+// RegisterHandler регистрирует обработчик топика. Если consumer уже запущен,
+// он перезаходит в группу, чтобы подписаться на новый топик
+func (k *KafkaService) RegisterHandler(topic string, handler MessageHandler) {
 	k.mu.Lock()
-	k.isRunning = true
+	k.handlers[topic] = handler
 	k.mu.Unlock()
 
-	go func() {
-		for {
-			select {
-			case <-k.ctx.Done():
-				log.Println("Остановка потребления сообщений Kafka")
-				return
-			default:
-				topics := []string{k.config.GetTopic()}
-
-				err := k.consumer.Consume(k.ctx, topics, k)
-				if err != nil {
-					log.Printf("Ошибка при потреблении сообщений: %v", err)
-					time.Sleep(delayToRepeat * time.Second) // Пауза перед повторной попыткой
-				}
-			}
-		}
-	}()
-
-	log.Printf("Начато потребление сообщений из топика: %s", k.config.GetTopic())
-
-	return nil
+	k.refreshSubscription("зарегистрирован обработчик: " + topic)
 }
 
+// Stop останавливает супервизор: текущая сессия завершается, соединения с Kafka закрываются.
+// После остановки сервис можно снова запустить через Start.
 func (k *KafkaService) Stop() error {
+	return k.Shutdown(context.Background())
+}
+
+// Shutdown останавливает потребление после текущего сообщения или пакета, фиксирует offset'ы,
+// дожидается отправки сообщений producer'а и закрывает соединения. Если ctx истекает раньше,
+// возвращается ошибка, а остановка продолжается в фоне.
+func (k *KafkaService) Shutdown(ctx context.Context) error {
 	k.mu.Lock()
-	defer k.mu.Unlock()
 
-	if !k.isRunning {
+	if k.supervisorDone == nil {
+		k.mu.Unlock()
 		return nil
 	}
 
-	k.isRunning = false
-	k.cancel()
+	cancel, done := k.cancel, k.supervisorDone
+	k.mu.Unlock()
 
-	if k.consumer != nil {
-		if err := k.consumer.Close(); err != nil {
-			log.Printf("Ошибка при закрытии consumer: %v", err)
-		}
-	}
+	k.supervisor.set(KafkaStateStopping, nil)
 
-	if k.producer != nil {
-		if err := k.producer.Close(); err != nil {
-			log.Printf("Ошибка при закрытии producer: %v", err)
-		}
+	cancel()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return eris.Wrap(ctx.Err(), "kafka shutdown timed out")
 	}
 
+	k.mu.Lock()
+	k.isRunning = false
+	k.paused = false
+	k.supervisorDone = nil
+	k.mu.Unlock()
+
 	log.Println("Kafka сервис остановлен")
 
 	return nil
 }
 
+// SendMessage отправляет сообщение и ждет подтверждения брокера
 func (k *KafkaService) SendMessage(topic string, key string, message []byte) error {
-	if k.producer == nil {
-		return eris.New("producer не инициализирован")
-	}
-
-	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Key:   sarama.StringEncoder(key),
-		Value: sarama.ByteEncoder(message),
-	}
+	return k.SendMessageWithHeaders(context.Background(), topic, key, message, nil)
+}
 
-	partition, offset, err := k.producer.SendMessage(msg)
+// SendMessageWithHeaders отправляет сообщение с заголовками и ждет подтверждения брокера.
+// Correlation и trace ID берутся из ctx, если не заданы в headers явно.
+func (k *KafkaService) SendMessageWithHeaders(
+	ctx context.Context,
+	topic, key string,
+	message []byte,
+	headers map[string]string,
+) error {
+	result, err := k.SendMessageAsync(ctx, topic, key, message, headers).Wait(ctx)
 	if err != nil {
-		return eris.Wrapf(err, "failed to send message to topic %s", topic)
+		return err
 	}
 
-	log.Printf("Сообщение отправлено в топик %s, partition: %d, offset: %d", topic, partition, offset)
+	log.Printf("Сообщение отправлено в топик %s, partition: %d, offset: %d, correlation_id: %s",
+		topic, result.Partition, result.Offset, result.CorrelationID)
 
 	return nil
 }
@@ -299,6 +277,14 @@ func (k *KafkaService) Cleanup(sarama.ConsumerGroupSession) error {
 }
 
 func (k *KafkaService) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	if handler, ok := k.batchHandler(claim.Topic()); ok {
+		return k.consumeBatches(session, claim, handler)
+	}
+
+	if k.config.IsParallelMode() {
+		return k.consumeParallel(session, claim)
+	}
+
 	for {
 		select {
 		case message, ok := <-claim.Messages():
@@ -309,32 +295,42 @@ func (k *KafkaService) ConsumeClaim(session sarama.ConsumerGroupSession, claim s
 			log.Printf("Получено сообщение из топика %s, partition: %d, offset: %d",
 				message.Topic, message.Partition, message.Offset)
 
-			// Обработка сообщения
-			if err := k.handleMessage(message.Topic, message.Value); err != nil {
-				log.Printf("Ошибка обработки сообщения: %v", err)
-				// В продакшене здесь можно добавить логику retry или dead letter queue
+			k.lag.recordMessage(message)
+
+			// Обработка сообщения с повторами. Не подтверждаем сообщение, пока оно
+			// не обработано или не сохранено в топик повторов/DLQ: после перезапуска
+			// сессии оно будет прочитано повторно
+			if err := k.processMessage(session.Context(), message); err != nil {
+				log.Printf("Сообщение из топика %s, partition: %d, offset: %d не подтверждено: %v",
+					message.Topic, message.Partition, message.Offset, err)
+
+				return err
 			}
 
 			// Подтверждение обработки сообщения
 			session.MarkMessage(message, "")
 
+			if k.config.IsManualCommit() {
+				session.Commit()
+			}
+
 		case <-session.Context().Done():
 			return nil
 		}
 	}
 }
 
-func (k *KafkaService) handleMessage(topic string, message []byte) error {
+func (k *KafkaService) handleMessage(ctx context.Context, meta MessageMetadata, message *sarama.ConsumerMessage) error {
 	k.mu.RLock()
-	handler, exists := k.handlers[topic]
+	handler, exists := k.handlers[meta.Topic]
 	k.mu.RUnlock()
 
 	if !exists {
-		log.Printf("Обработчик для топика %s не найден", topic)
+		log.Printf("Обработчик для топика %s не найден", meta.Topic)
 		return nil
 	}
 
-	return handler(message)
+	return handler(ctx, meta, message)
 }
 
 func (k *KafkaService) IsRunning() bool {
@@ -345,14 +341,46 @@ func (k *KafkaService) IsRunning() bool {
 }
 
 func (k *KafkaService) GetStatus() map[string]interface{} {
+	hasProducer := k.hasProducer()
+
 	k.mu.RLock()
 	defer k.mu.RUnlock()
 
 	return map[string]interface{}{
-		"is_running": k.isRunning,
-		"brokers":    k.config.GetBrokers(),
-		"topic":      k.config.GetTopic(),
-		"group_id":   k.config.GetGroupID(),
-		"connected":  k.consumer != nil && k.producer != nil,
+		"is_running":  k.isRunning,
+		"paused":      k.paused,
+		"brokers":     k.config.GetBrokers(),
+		"topic":       k.config.GetTopic(),
+		"group_id":    k.config.GetGroupID(),
+		"commit_mode": k.config.GetCommitMode(),
+		"connected":   k.consumer != nil && hasProducer,
+		"dead_letter": map[string]interface{}{
+			"enabled": k.config.DeadLetterEnabled,
+			"topic":   k.config.GetDeadLetterTopic(),
+			"stats":   k.deadLetters.snapshot(),
+		},
+		"validation":  k.validator.GetStats(),
+		"consistency": k.rules.GetStats(),
+		"retry": map[string]interface{}{
+			"max_attempts": k.config.GetRetryMaxAttempts(),
+			"topics":       k.retryTopics(k.config.GetTopic()),
+			"stats":        k.retries.snapshot(),
+		},
+		"batch": map[string]interface{}{
+			"enabled": k.config.IsBatchMode(),
+			"size":    k.config.BatchSize,
+			"timeout": k.config.GetBatchTimeout().String(),
+			"stats":   k.batches.snapshot(),
+		},
+		"workers": map[string]interface{}{
+			"enabled":    k.config.IsParallelMode(),
+			"per_claim":  k.config.Workers,
+			"queue_size": k.config.GetWorkerQueueSize(),
+			"stats":      k.workerPool.snapshot(),
+		},
+		"subscription": k.subscriptionStatus(),
+		"lag":          k.lag.snapshot(),
+		"supervisor":   k.supervisor.snapshot(),
+		"producer":     k.producerStatus(),
 	}
 }
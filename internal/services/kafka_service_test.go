@@ -0,0 +1,258 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"wb/config"
+	"wb/internal/orm/models"
+	"wb/internal/orm/repositories"
+)
+
+const testOrder = `{
+	"order_uid": "b563feb7b2b84b6test",
+	"track_number": "WBILMTESTTRACK",
+	"entry": "WBIL",
+	"delivery": {
+		"name": "Test Testov",
+		"phone": "+9720000000",
+		"zip": "2639809",
+		"city": "Kiryat Mozkin",
+		"address": "Ploshad Mira 15",
+		"region": "Kraiot",
+		"email": "test@gmail.com"
+	},
+	"payment": {
+		"transaction": "b563feb7b2b84b6test",
+		"request_id": "",
+		"currency": "USD",
+		"provider": "wbpay",
+		"amount": 1817,
+		"payment_dt": "2021-11-26T06:22:19Z",
+		"bank": "alpha",
+		"delivery_cost": 1500,
+		"goods_total": 317,
+		"custom_fee": 0
+	},
+	"items": [{
+		"chrt_id": 9934930,
+		"track_number": "WBILMTESTTRACK",
+		"price": 453,
+		"rid": "ab4219087a764ae0btest",
+		"name": "Mascaras",
+		"sale": 30,
+		"size": "0",
+		"total_price": 317,
+		"nm_id": 2389212,
+		"brand": "Vivienne Sabo",
+		"status": 202
+	}],
+	"locale": "en",
+	"internal_signature": "",
+	"customer_id": "test",
+	"delivery_service": "meest",
+	"shardkey": "9",
+	"sm_id": 99,
+	"date_created": "2021-11-26T06:22:19Z",
+	"oof_shard": "1"
+}`
+
+// callLog общий журнал вызовов хранилища и сессии: по нему проверяется порядок
+// сохранения заказа и подтверждения offset'а
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls = append(l.calls, fmt.Sprintf(format, args...))
+}
+
+func (l *callLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.calls...)
+}
+
+// fakeOrderStore хранит заказы в памяти и, как репозиторий, пропускает повторный order_uid
+type fakeOrderStore struct {
+	log    *callLog
+	err    error
+	orders map[string]*models.Order
+}
+
+func (s *fakeOrderStore) SaveOrderFromMessage(
+	order *models.Order,
+	_ *models.MessageSource,
+) (repositories.UpsertResult, error) {
+	s.log.add("save %s", order.OrderUID)
+
+	if s.err != nil {
+		return repositories.UpsertSkipped, s.err
+	}
+
+	if _, ok := s.orders[order.OrderUID]; ok {
+		return repositories.UpsertSkipped, nil
+	}
+
+	s.orders[order.OrderUID] = order
+
+	return repositories.UpsertCreated, nil
+}
+
+func (s *fakeOrderStore) SaveOrdersBatch(
+	orders []*models.Order,
+	sources []*models.MessageSource,
+) ([]repositories.UpsertResult, error) {
+	results := make([]repositories.UpsertResult, 0, len(orders))
+
+	for i, order := range orders {
+		result, err := s.SaveOrderFromMessage(order, sources[i])
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// fakeSession записывает подтверждения offset'ов и коммиты в журнал
+type fakeSession struct {
+	ctx context.Context
+	log *callLog
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return nil }
+func (s *fakeSession) MemberID() string           { return "test" }
+func (s *fakeSession) GenerationID() int32        { return 1 }
+func (s *fakeSession) Context() context.Context   { return s.ctx }
+func (s *fakeSession) Commit()                    { s.log.add("commit") }
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, _ string) {
+	s.log.add("mark %s/%d@%d", topic, partition, offset)
+}
+
+func (s *fakeSession) ResetOffset(string, int32, int64, string) {}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+// fakeClaim отдает сообщения partition consumer'а из sarama/mocks
+type fakeClaim struct {
+	sarama.PartitionConsumer
+
+	topic     string
+	partition int32
+}
+
+func (c *fakeClaim) Topic() string        { return c.topic }
+func (c *fakeClaim) Partition() int32     { return c.partition }
+func (c *fakeClaim) InitialOffset() int64 { return sarama.OffsetOldest }
+
+func newTestKafkaService(t *testing.T, store orderStore) *KafkaService {
+	t.Helper()
+
+	orders := &config.Orders{}
+
+	service, err := NewKafkaService(&config.KafkaConfig{
+		CommitMode:        "manual",
+		RetryMaxAttempts:  1,
+		DeadLetterEnabled: true,
+	}, nil, NewOrderValidator(orders), NewOrderRuleEngine(orders))
+	if err != nil {
+		t.Fatalf("NewKafkaService: %v", err)
+	}
+
+	service.cache = store
+
+	return service
+}
+
+// consumeOrders выдает сообщения через mock consumer и обрабатывает их ConsumeClaim
+func consumeOrders(t *testing.T, service *KafkaService, log *callLog, values ...string) error {
+	t.Helper()
+
+	consumer := mocks.NewConsumer(t, nil)
+
+	expectation := consumer.ExpectConsumePartition("orders", 0, sarama.OffsetOldest)
+	for _, value := range values {
+		expectation.YieldMessage(&sarama.ConsumerMessage{Value: []byte(value)})
+	}
+
+	partitionConsumer, err := consumer.ConsumePartition("orders", 0, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatalf("ConsumePartition: %v", err)
+	}
+
+	// Сообщения уже в буфере: после их разбора канал закроется и ConsumeClaim вернется
+	partitionConsumer.AsyncClose()
+
+	session := &fakeSession{ctx: context.Background(), log: log}
+
+	return service.ConsumeClaim(session, &fakeClaim{PartitionConsumer: partitionConsumer, topic: "orders"})
+}
+
+func TestConsumeClaimCommitsAfterOrderIsSaved(t *testing.T) {
+	log := &callLog{}
+	service := newTestKafkaService(t, &fakeOrderStore{log: log, orders: map[string]*models.Order{}})
+
+	if err := consumeOrders(t, service, log, testOrder); err != nil {
+		t.Fatalf("ConsumeClaim: %v", err)
+	}
+
+	want := []string{"save b563feb7b2b84b6test", "mark orders/0@1", "commit"}
+	if got := log.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("calls = %q, want %q", got, want)
+	}
+}
+
+func TestConsumeClaimLeavesOffsetUnmarkedWhenSaveFails(t *testing.T) {
+	log := &callLog{}
+	store := &fakeOrderStore{log: log, err: errors.New("database is down"), orders: map[string]*models.Order{}}
+	service := newTestKafkaService(t, store)
+
+	// Без producer'а сообщение нельзя переложить в DLQ, поэтому оно должно остаться неподтвержденным
+	if err := consumeOrders(t, service, log, testOrder); err == nil {
+		t.Fatal("ConsumeClaim returned nil, want error")
+	}
+
+	want := []string{"save b563feb7b2b84b6test"}
+	if got := log.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("calls = %q, want %q", got, want)
+	}
+}
+
+func TestConsumeClaimRedeliveredOrderIsNoOp(t *testing.T) {
+	log := &callLog{}
+	store := &fakeOrderStore{log: log, orders: map[string]*models.Order{}}
+	service := newTestKafkaService(t, store)
+
+	if err := consumeOrders(t, service, log, testOrder, testOrder); err != nil {
+		t.Fatalf("ConsumeClaim: %v", err)
+	}
+
+	want := []string{
+		"save b563feb7b2b84b6test", "mark orders/0@1", "commit",
+		"save b563feb7b2b84b6test", "mark orders/0@2", "commit",
+	}
+	if got := log.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("calls = %q, want %q", got, want)
+	}
+
+	if len(store.orders) != 1 {
+		t.Fatalf("stored orders = %d, want 1", len(store.orders))
+	}
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// subscriptionState текущая подписка consumer group и управление перезаходом в группу
+type subscriptionState struct {
+	topics     []string
+	rejoin     context.CancelFunc
+	rejoins    uint64
+	lastReason string
+	lastAt     time.Time
+}
+
+// UnregisterHandler удаляет обработчик топика и перезаходит в группу без этого топика.
+// Обработчики основного топика и закрепленных топиков удалить нельзя: их сообщения
+// остались бы без обработки.
+func (k *KafkaService) UnregisterHandler(topic string) error {
+	if topic == k.config.GetTopic() {
+		return eris.Errorf("обработчик основного топика %s нельзя удалить", topic)
+	}
+
+	if owner := k.topicOwner(topic); owner != "" {
+		return eris.Errorf("обработчик топика %s (%s) нельзя удалить", topic, owner)
+	}
+
+	k.mu.Lock()
+	_, exists := k.handlers[topic]
+	delete(k.handlers, topic)
+	delete(k.batchHandlers, topic)
+	k.mu.Unlock()
+
+	if !exists {
+		return eris.Errorf("обработчик для топика %s не найден", topic)
+	}
+
+	k.refreshSubscription("обработчик удален: " + topic)
+
+	return nil
+}
+
+// reserveTopics закрепляет топики за встроенным обработчиком owner. Вызывается до загрузки
+// конвейеров, чтобы сохраненный конвейер не заменил встроенный обработчик.
+func (k *KafkaService) reserveTopics(owner string, topics ...string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, topic := range topics {
+		k.reservedTopics[topic] = owner
+	}
+}
+
+// topicOwner возвращает владельца закрепленного топика или пустую строку
+func (k *KafkaService) topicOwner(topic string) string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.reservedTopics[topic]
+}
+
+// HandlerTopics возвращает отсортированный список топиков с обработчиками
+func (k *KafkaService) HandlerTopics() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	topics := make([]string, 0, len(k.handlers))
+	for topic := range k.handlers {
+		topics = append(topics, topic)
+	}
+
+	sort.Strings(topics)
+
+	return topics
+}
+
+// subscriptionTopics возвращает все топики подписки: основные топики и их топики отложенных повторов
+func (k *KafkaService) subscriptionTopics() []string {
+	base := k.baseTopics()
+
+	topics := make([]string, 0, len(base)*(len(k.config.RetryDelays)+1))
+	for _, topic := range base {
+		topics = append(topics, topic)
+		topics = append(topics, k.retryTopics(topic)...)
+	}
+
+	sort.Strings(topics)
+
+	return topics
+}
+
+// baseTopics возвращает основной топик, топики с обработчиками, топики из KAFKA_TOPICS
+// и существующие топики, подходящие под KAFKA_TOPIC_PATTERNS
+func (k *KafkaService) baseTopics() []string {
+	base := map[string]bool{k.config.GetTopic(): true}
+
+	for _, topic := range k.HandlerTopics() {
+		base[topic] = true
+	}
+
+	for _, topic := range k.config.Topics {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			base[topic] = true
+		}
+	}
+
+	for _, topic := range k.patternTopics() {
+		base[topic] = true
+	}
+
+	topics := make([]string, 0, len(base))
+	for topic := range base {
+		topics = append(topics, topic)
+	}
+
+	sort.Strings(topics)
+
+	return topics
+}
+
+// patternTopics возвращает топики кластера, подходящие под регулярные выражения из конфигурации.
+// Служебные топики, DLQ и топики повторов в подписку по шаблону не попадают.
+func (k *KafkaService) patternTopics() []string {
+	k.mu.RLock()
+	client := k.client
+	k.mu.RUnlock()
+
+	if len(k.config.TopicPatterns) == 0 || client == nil {
+		return nil
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(k.config.TopicPatterns))
+
+	for _, raw := range k.config.TopicPatterns {
+		pattern, err := regexp.Compile("^(?:" + raw + ")$")
+		if err != nil {
+			log.Printf("Некорректный шаблон топика %q: %v", raw, err)
+			continue
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	if err := client.RefreshMetadata(); err != nil {
+		log.Printf("Не удалось обновить метаданные Kafka: %v", err)
+	}
+
+	available, err := client.Topics()
+	if err != nil {
+		log.Printf("Не удалось получить список топиков Kafka: %v", err)
+		return nil
+	}
+
+	var matched []string
+
+	for _, topic := range available {
+		if strings.HasPrefix(topic, "__") || topic == k.config.GetDeadLetterTopic() || strings.Contains(topic, ".retry.") {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if pattern.MatchString(topic) {
+				matched = append(matched, topic)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// beginSession запоминает топики новой сессии и возвращает контекст, отмена которого
+// завершает сессию и заставляет перезайти в группу с актуальным набором топиков
+func (k *KafkaService) beginSession(parent context.Context, topics []string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	k.mu.Lock()
+	k.subscription.topics = topics
+	k.subscription.rejoin = cancel
+	k.mu.Unlock()
+
+	return ctx, cancel
+}
+
+// refreshSubscription перезаходит в группу, если набор топиков подписки изменился
+func (k *KafkaService) refreshSubscription(reason string) {
+	topics := k.subscriptionTopics()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.isRunning || k.subscription.rejoin == nil || equalTopics(topics, k.subscription.topics) {
+		return
+	}
+
+	k.subscription.rejoins++
+	k.subscription.lastReason = reason
+	k.subscription.lastAt = time.Now()
+
+	log.Printf("Подписка изменилась (%s), перезаходим в группу с топиками: %s", reason, strings.Join(topics, ", "))
+
+	k.subscription.rejoin()
+}
+
+// watchTopicPatterns периодически проверяет, не появились ли новые топики под шаблоны подписки
+func (k *KafkaService) watchTopicPatterns(ctx context.Context) {
+	if len(k.config.TopicPatterns) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(k.config.GetTopicRefreshInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			k.refreshSubscription("изменился список топиков по шаблонам")
+		}
+	}
+}
+
+// subscriptionStatus описывает активную подписку для GetStatus. Вызывается под k.mu.
+func (k *KafkaService) subscriptionStatus() map[string]interface{} {
+	handlers := make([]string, 0, len(k.handlers))
+	for topic := range k.handlers {
+		handlers = append(handlers, topic)
+	}
+
+	sort.Strings(handlers)
+
+	status := map[string]interface{}{
+		"topics":         k.subscription.topics,
+		"handler_topics": handlers,
+		"config_topics":  k.config.Topics,
+		"patterns":       k.config.TopicPatterns,
+		"rejoins":        k.subscription.rejoins,
+		"last_reason":    k.subscription.lastReason,
+	}
+
+	if !k.subscription.lastAt.IsZero() {
+		status["last_rejoin_at"] = k.subscription.lastAt
+	}
+
+	return status
+}
+
+func equalTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
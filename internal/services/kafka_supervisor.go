@@ -0,0 +1,400 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+)
+
+// Состояния подключения к Kafka, которыми управляет супервизор
+const (
+	KafkaStateDisconnected = "disconnected"
+	KafkaStateConnecting   = "connecting"
+	KafkaStateConsuming    = "consuming"
+	KafkaStatePaused       = "paused"
+	KafkaStateStopping     = "stopping"
+)
+
+// maxStateTransitions сколько последних переходов состояния хранится для GetStatus
+const maxStateTransitions = 20
+
+// stateTransition переход состояния супервизора
+type stateTransition struct {
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	At    time.Time `json:"at"`
+	Error string    `json:"error,omitempty"`
+}
+
+// supervisorState состояние подключения, история переходов и счетчики
+type supervisorState struct {
+	mu             sync.Mutex
+	state          string
+	since          time.Time
+	lastError      string
+	connects       uint64
+	consumerErrors uint64
+	transitions    []stateTransition
+}
+
+func newSupervisorState() *supervisorState {
+	return &supervisorState{
+		state: KafkaStateDisconnected,
+		since: time.Now(),
+	}
+}
+
+func (s *supervisorState) set(state string, cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transition := stateTransition{From: s.state, To: state, At: time.Now()}
+	if cause != nil {
+		transition.Error = cause.Error()
+		s.lastError = cause.Error()
+	}
+
+	if s.state != state {
+		log.Printf("Kafka: %s -> %s", s.state, state)
+	}
+
+	s.state = state
+	s.since = transition.At
+
+	s.transitions = append(s.transitions, transition)
+	if len(s.transitions) > maxStateTransitions {
+		s.transitions = s.transitions[len(s.transitions)-maxStateTransitions:]
+	}
+}
+
+func (s *supervisorState) current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+func (s *supervisorState) recordConnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connects++
+}
+
+func (s *supervisorState) recordConsumerError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.consumerErrors++
+	s.lastError = err.Error()
+}
+
+func (s *supervisorState) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return map[string]interface{}{
+		"state":           s.state,
+		"since":           s.since,
+		"last_error":      s.lastError,
+		"connects":        s.connects,
+		"consumer_errors": s.consumerErrors,
+		"transitions":     append([]stateTransition(nil), s.transitions...),
+	}
+}
+
+// Start запускает супервизор: он подключается к Kafka с экспоненциальной паузой между
+// попытками, запускает потребление и переподключается, если соединение потеряно.
+// Повторный вызов при работающем супервизоре ничего не делает.
+func (k *KafkaService) Start() error {
+	k.mu.Lock()
+
+	if k.supervisorDone != nil {
+		k.mu.Unlock()
+		return nil
+	}
+
+	// Контекст создается на каждый запуск, поэтому после Stop сервис можно запустить снова
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	k.ctx = ctx
+	k.cancel = cancel
+	k.supervisorDone = done
+	k.isRunning = true
+	k.mu.Unlock()
+
+	go k.supervise(ctx, done)
+	go k.watchTopicPatterns(ctx)
+	go k.sampleLag(ctx)
+
+	log.Println("Супервизор Kafka запущен")
+
+	return nil
+}
+
+// OnConnected регистрирует функцию, которая вызывается после каждого успешного подключения
+func (k *KafkaService) OnConnected(hook func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.connectedHooks = append(k.connectedHooks, hook)
+}
+
+// State возвращает текущее состояние подключения
+func (k *KafkaService) State() string {
+	return k.supervisor.current()
+}
+
+func (k *KafkaService) supervise(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	backoff := k.config.GetReconnectBackoff()
+
+	for {
+		k.supervisor.set(KafkaStateConnecting, nil)
+
+		err := k.connect()
+		if err == nil {
+			backoff = k.config.GetReconnectBackoff()
+			err = k.consumeUntilLost(ctx)
+		}
+
+		if ctx.Err() != nil {
+			k.supervisor.set(KafkaStateDisconnected, nil)
+			return
+		}
+
+		k.supervisor.set(KafkaStateDisconnected, err)
+		log.Printf("Соединение с Kafka потеряно: %v, повторное подключение через %v", err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > k.config.GetReconnectMaxBackoff() {
+			backoff = k.config.GetReconnectMaxBackoff()
+		}
+	}
+}
+
+// consumeUntilLost запускает потребление и ждет остановки сервиса или потери соединения.
+// В обоих случаях соединение закрывается перед возвратом.
+func (k *KafkaService) consumeUntilLost(ctx context.Context) error {
+	k.supervisor.recordConnected()
+
+	lost := make(chan error, 1)
+
+	k.mu.Lock()
+	k.lost = lost
+	hooks := append([]func(){}, k.connectedHooks...)
+	k.mu.Unlock()
+
+	for _, hook := range hooks {
+		go hook()
+	}
+
+	k.supervisor.set(KafkaStateConsuming, nil)
+	k.startConsumeLoop(ctx)
+
+	var err error
+
+	select {
+	case <-ctx.Done():
+	case err = <-lost:
+	}
+
+	k.teardown()
+
+	return err
+}
+
+// connect создает клиента, consumer group и producer по конфигурации
+func (k *KafkaService) connect() error {
+	// Версия, таймауты, ребалансировка, TLS и SASL берутся из KafkaConfig
+	consumerConfig, err := newSaramaConfig(k.config)
+	if err != nil {
+		return err
+	}
+
+	producerConfig, err := newSaramaConfig(k.config)
+	if err != nil {
+		return err
+	}
+
+	// Клиент нужен consumer group и для поиска топиков по шаблонам подписки
+	client, err := sarama.NewClient(k.config.GetBrokers(), consumerConfig)
+	if err != nil {
+		return eris.Wrapf(err, "failed to create client")
+	}
+
+	// Топики создаются до входа в группу, чтобы подписка сразу получила партиции
+	if err := k.ensureTopics(client); err != nil {
+		client.Close()
+		return err
+	}
+
+	// Подключение к consumer group
+	consumer, err := sarama.NewConsumerGroupFromClient(k.config.GetGroupID(), client)
+	if err != nil {
+		client.Close()
+		return eris.Wrapf(err, "failed to create consumer group")
+	}
+
+	// Подключение к producer: синхронному или асинхронному по KAFKA_PRODUCER_MODE
+	producer, asyncProducer, producerDone, err := k.newProducer(producerConfig)
+	if err != nil {
+		consumer.Close()
+		client.Close()
+
+		return err
+	}
+
+	k.producerMu.Lock()
+	k.producer = producer
+	k.asyncProducer = asyncProducer
+	k.producerDone = producerDone
+	k.producerMu.Unlock()
+
+	k.mu.Lock()
+	k.client = client
+	k.consumer = consumer
+	k.paused = false
+	k.mu.Unlock()
+
+	log.Printf("Успешно подключились к Kafka brokers: %s", k.config.GetBrokersString())
+
+	return nil
+}
+
+// teardown останавливает цикл потребления и закрывает соединения с Kafka. Закрытие
+// consumer group фиксирует отмеченные offset'ы, закрытие producer'а дожидается
+// подтверждения уже отправленных сообщений.
+func (k *KafkaService) teardown() {
+	k.stopConsumeLoop()
+
+	k.mu.Lock()
+	consumer, client, paused := k.consumer, k.client, k.paused
+	k.consumer, k.client = nil, nil
+	k.lost = nil
+	k.mu.Unlock()
+
+	// Запись в producerMu дожидается отправок, начатых до teardown; новые получат ошибку
+	k.producerMu.Lock()
+	producer, asyncProducer, producerDone := k.producer, k.asyncProducer, k.producerDone
+	k.producer, k.asyncProducer, k.producerDone = nil, nil, nil
+	k.producerMu.Unlock()
+
+	// На паузе consumer group уже закрыт
+	if consumer != nil && !paused {
+		if err := consumer.Close(); err != nil {
+			log.Printf("Ошибка при закрытии consumer: %v", err)
+		}
+	}
+
+	closeProducer(producer, asyncProducer, producerDone)
+
+	if client != nil {
+		if err := client.Close(); err != nil {
+			log.Printf("Ошибка при закрытии клиента Kafka: %v", err)
+		}
+	}
+}
+
+// startConsumeLoop запускает цикл сессий consumer group. Цикл останавливается вместе
+// с сервисом, через Pause или при потере соединения, о которой сообщает супервизору
+func (k *KafkaService) startConsumeLoop(parent context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+
+	k.mu.Lock()
+	consumer := k.consumer
+	lost := k.lost
+	k.loopCancel = cancel
+	k.loopDone = done
+	k.mu.Unlock()
+
+	go k.drainConsumerErrors(consumer)
+
+	go func() {
+		defer close(done)
+
+		failures := 0
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("Остановка потребления сообщений Kafka")
+				return
+			default:
+				// Набор топиков пересчитывается перед каждой сессией: регистрация обработчика
+				// или новый топик по шаблону завершают текущую сессию через ее контекст
+				topics := k.subscriptionTopics()
+				sessionCtx, cancelSession := k.beginSession(ctx, topics)
+
+				log.Printf("Потребление сообщений из топиков: %s", strings.Join(topics, ", "))
+
+				err := consumer.Consume(sessionCtx, topics, k)
+
+				cancelSession()
+
+				if err == nil {
+					failures = 0
+					continue
+				}
+
+				failures++
+				log.Printf("Ошибка при потреблении сообщений (%d подряд): %v", failures, err)
+
+				// Закрытый клиент или серия неудачных сессий — пересоздаем соединение
+				if errors.Is(err, sarama.ErrClosedClient) || errors.Is(err, sarama.ErrClosedConsumerGroup) ||
+					failures >= k.config.GetReconnectAfterFailures() {
+					select {
+					case lost <- err:
+					default:
+					}
+
+					return
+				}
+
+				// Пауза перед повторной попыткой
+				select {
+				case <-ctx.Done():
+				case <-time.After(delayToRepeat * time.Second):
+				}
+			}
+		}
+	}()
+}
+
+// stopConsumeLoop останавливает цикл потребления и ждет завершения текущей сессии
+func (k *KafkaService) stopConsumeLoop() {
+	k.mu.Lock()
+	cancel, done := k.loopCancel, k.loopDone
+	k.loopCancel, k.loopDone = nil, nil
+	k.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+// drainConsumerErrors читает канал ошибок consumer group до его закрытия
+func (k *KafkaService) drainConsumerErrors(consumer sarama.ConsumerGroup) {
+	for err := range consumer.Errors() {
+		k.supervisor.recordConsumerError(err)
+		log.Printf("Ошибка consumer group: %v", err)
+	}
+}
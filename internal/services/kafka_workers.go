@@ -0,0 +1,295 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// workerResult результат обработки сообщения воркером
+type workerResult struct {
+	message *sarama.ConsumerMessage
+	err     error
+}
+
+// workerPoolStats метрики пулов воркеров всех активных claim'ов
+type workerPoolStats struct {
+	mu           sync.Mutex
+	totalWorkers int
+	busyWorkers  int
+	queued       int
+	maxQueued    int
+	inFlight     int
+	processed    uint64
+	busyTime     time.Duration
+}
+
+func newWorkerPoolStats() *workerPoolStats {
+	return &workerPoolStats{}
+}
+
+func (s *workerPoolStats) addWorkers(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.totalWorkers += delta
+}
+
+func (s *workerPoolStats) recordQueued() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queued++
+	s.inFlight++
+
+	if s.queued > s.maxQueued {
+		s.maxQueued = s.queued
+	}
+}
+
+func (s *workerPoolStats) recordStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queued--
+	s.busyWorkers++
+}
+
+func (s *workerPoolStats) recordDropped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queued--
+}
+
+func (s *workerPoolStats) recordFinished(took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.busyWorkers--
+	s.processed++
+	s.busyTime += took
+}
+
+func (s *workerPoolStats) recordCompleted(count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight -= count
+}
+
+func (s *workerPoolStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var utilization, avgProcess float64
+	if s.totalWorkers > 0 {
+		utilization = float64(s.busyWorkers) / float64(s.totalWorkers)
+	}
+
+	if s.processed > 0 {
+		avgProcess = float64(s.busyTime.Milliseconds()) / float64(s.processed)
+	}
+
+	return map[string]interface{}{
+		"total_workers":   s.totalWorkers,
+		"busy_workers":    s.busyWorkers,
+		"utilization":     utilization,
+		"queue_depth":     s.queued,
+		"max_queue_depth": s.maxQueued,
+		"in_flight":       s.inFlight,
+		"processed":       s.processed,
+		"avg_process_ms":  avgProcess,
+	}
+}
+
+// offsetTracker хранит сообщения claim'а в порядке выдачи воркерам и позволяет
+// подтверждать только непрерывный префикс обработанных offset'ов
+type offsetTracker struct {
+	pending []*sarama.ConsumerMessage
+	done    map[int64]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		done: make(map[int64]bool),
+	}
+}
+
+func (t *offsetTracker) add(message *sarama.ConsumerMessage) {
+	t.pending = append(t.pending, message)
+}
+
+func (t *offsetTracker) len() int {
+	return len(t.pending)
+}
+
+// complete отмечает сообщение обработанным и возвращает последнее сообщение непрерывного
+// обработанного префикса (nil, если префикс не сдвинулся) и число вышедших из него сообщений
+func (t *offsetTracker) complete(message *sarama.ConsumerMessage) (*sarama.ConsumerMessage, int) {
+	t.done[message.Offset] = true
+
+	var (
+		last  *sarama.ConsumerMessage
+		count int
+	)
+
+	for len(t.pending) > 0 && t.done[t.pending[0].Offset] {
+		last = t.pending[0]
+		delete(t.done, last.Offset)
+		t.pending = t.pending[1:]
+		count++
+	}
+
+	return last, count
+}
+
+// consumeParallel обрабатывает claim пулом из KAFKA_WORKERS воркеров. Сообщения с одним
+// ключом (order_uid) всегда попадают к одному воркеру и обрабатываются по порядку,
+// в работе одновременно не больше KAFKA_WORKER_QUEUE_SIZE сообщений, а offset
+// подтверждается только для непрерывного префикса обработанных сообщений.
+func (k *KafkaService) consumeParallel(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	workers := k.config.Workers
+	limit := k.config.GetWorkerQueueSize()
+
+	ctx, cancel := context.WithCancel(session.Context())
+
+	// Буферы рассчитаны на весь лимит, поэтому ни диспетчер, ни воркеры не блокируются на отправке
+	queues := make([]chan *sarama.ConsumerMessage, workers)
+	results := make(chan workerResult, limit)
+
+	var wg sync.WaitGroup
+
+	k.workerPool.addWorkers(workers)
+	defer k.workerPool.addWorkers(-workers)
+
+	for i := range queues {
+		queues[i] = make(chan *sarama.ConsumerMessage, limit)
+
+		wg.Add(1)
+
+		go func(queue <-chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+
+			for message := range queue {
+				if ctx.Err() != nil {
+					k.workerPool.recordDropped()
+					continue
+				}
+
+				k.workerPool.recordStarted()
+				started := time.Now()
+
+				err := k.processMessage(ctx, message)
+
+				k.workerPool.recordFinished(time.Since(started))
+				results <- workerResult{message: message, err: err}
+			}
+		}(queues[i])
+	}
+
+	tracker := newOffsetTracker()
+
+	defer func() {
+		// Сначала отменяем контекст, чтобы воркеры не брали в работу оставшиеся в очередях сообщения
+		cancel()
+
+		for _, queue := range queues {
+			close(queue)
+		}
+
+		wg.Wait()
+		k.workerPool.recordCompleted(tracker.len())
+	}()
+
+	messages := claim.Messages()
+
+	for {
+		// Ограничиваем число сообщений в работе: пока лимит исчерпан, новые не читаем
+		incoming := messages
+		if tracker.len() >= limit {
+			incoming = nil
+		}
+
+		select {
+		case message, ok := <-incoming:
+			if !ok {
+				messages = nil
+
+				if tracker.len() == 0 {
+					return nil
+				}
+
+				continue
+			}
+
+			k.lag.recordMessage(message)
+
+			tracker.add(message)
+			k.workerPool.recordQueued()
+			queues[workerIndex(message, workers)] <- message
+
+		case result := <-results:
+			if result.err != nil {
+				log.Printf("Сообщение из топика %s, partition: %d, offset: %d не подтверждено: %v",
+					result.message.Topic, result.message.Partition, result.message.Offset, result.err)
+
+				return result.err
+			}
+
+			last, count := tracker.complete(result.message)
+			k.workerPool.recordCompleted(count)
+
+			if last != nil {
+				session.MarkMessage(last, "")
+
+				if k.config.IsManualCommit() {
+					session.Commit()
+				}
+			}
+
+			if messages == nil && tracker.len() == 0 {
+				return nil
+			}
+
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// workerIndex выбирает воркер по ключу упорядочивания сообщения
+func workerIndex(message *sarama.ConsumerMessage, workers int) int {
+	hash := fnv.New32a()
+	hash.Write(orderingKey(message))
+
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// orderingKey возвращает ключ сообщения, а если producer его не задал — order_uid
+// (или order_id упрощенного формата) из тела сообщения
+func orderingKey(message *sarama.ConsumerMessage) []byte {
+	if len(message.Key) > 0 {
+		return message.Key
+	}
+
+	var ids struct {
+		OrderUID string `json:"order_uid"`
+		OrderID  string `json:"order_id"`
+	}
+
+	if err := json.Unmarshal(message.Value, &ids); err != nil {
+		return nil
+	}
+
+	if ids.OrderUID != "" {
+		return []byte(ids.OrderUID)
+	}
+
+	return []byte(ids.OrderID)
+}
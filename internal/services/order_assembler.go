@@ -0,0 +1,646 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm"
+	"wb/config"
+	"wb/internal/orm/models"
+	"wb/internal/orm/repositories"
+)
+
+// ErrIncompleteOrder за время ожидания пришли не все части заказа
+var ErrIncompleteOrder = errors.New("incomplete order")
+
+// assemblyParts части, из которых собирается заказ, в порядке сборки
+var assemblyParts = []string{models.FragmentPartOrder, models.FragmentPartPayment, models.FragmentPartDelivery}
+
+// IncompleteOrderAlert сообщение о заказе, который не удалось собрать за ASSEMBLY_TIMEOUT
+type IncompleteOrderAlert struct {
+	AssemblyKey     string                `json:"assembly_key"`
+	Missing         []string              `json:"missing"`
+	FirstReceivedAt time.Time             `json:"first_received_at"`
+	ExpiredAt       time.Time             `json:"expired_at"`
+	Fragments       []IncompleteOrderPart `json:"fragments"`
+}
+
+// IncompleteOrderPart полученная часть незавершенного заказа
+type IncompleteOrderPart struct {
+	Part       string          `json:"part"`
+	Topic      string          `json:"topic"`
+	Partition  int32           `json:"partition"`
+	Offset     int64           `json:"offset"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// assemblyStats счетчики сборки заказов
+type assemblyStats struct {
+	mu            sync.Mutex
+	received      map[string]uint64
+	assembled     uint64
+	expired       uint64
+	late          uint64
+	failed        uint64
+	lastError     string
+	lastAssembled time.Time
+}
+
+func (s *assemblyStats) recordReceived(part string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.received[part]++
+}
+
+func (s *assemblyStats) recordAssembled() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assembled++
+	s.lastAssembled = time.Now()
+}
+
+func (s *assemblyStats) recordExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expired++
+}
+
+func (s *assemblyStats) recordLate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.late++
+}
+
+func (s *assemblyStats) recordFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed++
+	s.lastError = err.Error()
+}
+
+func (s *assemblyStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	received := make(map[string]uint64, len(s.received))
+	for part, count := range s.received {
+		received[part] = count
+	}
+
+	stats := map[string]interface{}{
+		"received":   received,
+		"assembled":  s.assembled,
+		"expired":    s.expired,
+		"late":       s.late,
+		"failed":     s.failed,
+		"last_error": s.lastError,
+	}
+
+	if !s.lastAssembled.IsZero() {
+		stats["last_assembled_at"] = s.lastAssembled
+	}
+
+	return stats
+}
+
+// OrderAssembler собирает заказы из частей, которые приходят в отдельные топики: заказ,
+// оплата и доставка. Части хранятся в order_fragments до прихода остальных, поэтому
+// ожидание переживает перезапуск сервиса. Собранный заказ сохраняется тем же путем, что
+// и заказ из основного топика; сборка, не завершенная за ASSEMBLY_TIMEOUT, превращается
+// в сообщение о незавершенном заказе или отправляется в DLQ. Части, пришедшие после
+// сборки или просрочки, отбрасываются в течение ASSEMBLY_COMPLETED_RETENTION.
+//
+// Части связываются по order_uid. Оплата без order_uid связывается по transaction,
+// который в формате WB совпадает с order_uid. Если заказ уже содержит оплату или
+// доставку, отдельная часть для нее не нужна, а пришедшая часть заменяет вложенную.
+type OrderAssembler struct {
+	config *config.Assembly
+	repo   *repositories.OrderFragmentRepository
+	kafka  *KafkaService
+	cache  *CacheService
+	stats  *assemblyStats
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewOrderAssembler(
+	cfg *config.Assembly,
+	repo *repositories.OrderFragmentRepository,
+	kafka *KafkaService,
+	cache *CacheService,
+) *OrderAssembler {
+	// Топики частей закрепляются сразу: конвейеры загружаются раньше, чем запускается сборка
+	if cfg.Enabled {
+		kafka.reserveTopics("order assembler", cfg.OrderTopic, cfg.PaymentTopic, cfg.DeliveryTopic)
+
+		if cfg.GetTimeoutAction() == config.AssemblyTimeoutAlert {
+			kafka.declareOutputTopics(cfg.GetAlertTopic())
+		}
+	}
+
+	return &OrderAssembler{
+		config: cfg,
+		repo:   repo,
+		kafka:  kafka,
+		cache:  cache,
+		stats:  &assemblyStats{received: make(map[string]uint64)},
+	}
+}
+
+// Start регистрирует обработчики топиков частей и запускает проверку просроченных сборок.
+// Вызывается до запуска consumer'а, чтобы первая подписка включила топики частей.
+// Повторный вызов ничего не делает.
+func (a *OrderAssembler) Start() {
+	if !a.config.Enabled {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.done != nil {
+		return
+	}
+
+	a.kafka.RegisterHandler(a.config.OrderTopic, a.handler(models.FragmentPartOrder))
+	a.kafka.RegisterHandler(a.config.PaymentTopic, a.handler(models.FragmentPartPayment))
+	a.kafka.RegisterHandler(a.config.DeliveryTopic, a.handler(models.FragmentPartDelivery))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.done = make(chan struct{})
+
+	go a.run(ctx, a.done)
+
+	log.Printf("Сборка заказов запущена: топики %s, %s, %s, ожидание частей %s",
+		a.config.OrderTopic, a.config.PaymentTopic, a.config.DeliveryTopic, a.config.GetTimeout())
+}
+
+// Stop останавливает проверку просроченных сборок после текущего прохода
+func (a *OrderAssembler) Stop(ctx context.Context) error {
+	a.mu.Lock()
+	cancel, done := a.cancel, a.done
+	a.cancel, a.done = nil, nil
+	a.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+		log.Println("Проверка просроченных сборок заказов остановлена")
+		return nil
+	case <-ctx.Done():
+		return eris.Wrap(ctx.Err(), "order assembler shutdown timed out")
+	}
+}
+
+// Backlog возвращает незавершенные сборки вместе со счетчиками
+func (a *OrderAssembler) Backlog() (map[string]interface{}, error) {
+	result := map[string]interface{}{
+		"enabled": a.config.Enabled,
+		"stats":   a.stats.snapshot(),
+	}
+
+	if !a.config.Enabled {
+		return result, nil
+	}
+
+	backlog, err := a.repo.Backlog()
+	if err != nil {
+		return nil, err
+	}
+
+	result["topics"] = map[string]string{
+		models.FragmentPartOrder:    a.config.OrderTopic,
+		models.FragmentPartPayment:  a.config.PaymentTopic,
+		models.FragmentPartDelivery: a.config.DeliveryTopic,
+	}
+	result["timeout"] = a.config.GetTimeout().String()
+	result["timeout_action"] = a.config.GetTimeoutAction()
+	result["backlog"] = backlog
+
+	if backlog.OldestPending != nil {
+		result["oldest_pending_age"] = time.Since(*backlog.OldestPending).Round(time.Millisecond).String()
+	}
+
+	return result, nil
+}
+
+// handler сохраняет часть заказа и, если пришли все части, сохраняет собранный заказ
+func (a *OrderAssembler) handler(part string) MessageHandler {
+	return func(ctx context.Context, meta MessageMetadata, message *sarama.ConsumerMessage) error {
+		fragment, err := newOrderFragment(part, meta, message)
+		if err != nil {
+			return err
+		}
+
+		a.stats.recordReceived(part)
+
+		var (
+			order  *models.Order
+			result repositories.UpsertResult
+		)
+
+		status, err := a.repo.Add(fragment, func(tx *gorm.DB, fragments []models.OrderFragment) (bool, error) {
+			var err error
+
+			order, result, err = a.assemble(tx, fragments)
+
+			return order != nil, err
+		})
+		if err != nil {
+			a.stats.recordFailed(err)
+			log.Printf("Часть %s заказа %s не обработана [%s]: %v", part, fragment.AssemblyKey, meta, err)
+
+			return err
+		}
+
+		switch status {
+		case repositories.FragmentLate:
+			a.stats.recordLate()
+			log.Printf("Часть %s заказа %s пришла после завершения сборки и отброшена [%s]", part, fragment.AssemblyKey, meta)
+
+			return nil
+		case repositories.FragmentPending:
+			log.Printf("Получена часть %s заказа %s, ожидаются остальные [%s]", part, fragment.AssemblyKey, meta)
+			return nil
+		}
+
+		// Кеш обновляется только после фиксации транзакции сборки
+		if result != repositories.UpsertSkipped {
+			a.cache.SetOrder(order)
+		}
+
+		a.stats.recordAssembled()
+		log.Printf("Заказ %s собран из частей и сохранен (%s) [%s]", order.OrderUID, result, meta)
+
+		return nil
+	}
+}
+
+// assemble собирает заказ, если среди частей есть все необходимые, и сохраняет его
+// в транзакции сборки tx. Возвращает nil, если части еще не все. Метаданными заказа
+// считаются метаданные части заказа: по ним определяются версия, схема и происхождение записи.
+func (a *OrderAssembler) assemble(
+	tx *gorm.DB,
+	fragments []models.OrderFragment,
+) (*models.Order, repositories.UpsertResult, error) {
+	document, missing, orderFragment, err := mergeFragments(fragments)
+	if err != nil || len(missing) > 0 {
+		return nil, "", err
+	}
+
+	payload, err := json.Marshal(document)
+	if err != nil {
+		return nil, "", eris.Wrapf(err, "failed to marshal assembled order %s", orderFragment.AssemblyKey)
+	}
+
+	message, err := fragmentMessage(orderFragment, payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Собранный документ всегда в каноничном формате, какой бы формат ни указал producer части
+	headers := message.Headers[:0]
+	for _, header := range message.Headers {
+		if string(header.Key) != HeaderOrderFormat {
+			headers = append(headers, header)
+		}
+	}
+
+	message.Headers = append(headers, &sarama.RecordHeader{
+		Key:   []byte(HeaderOrderFormat),
+		Value: []byte(OrderFormatCanonical),
+	})
+
+	meta := newMessageMetadata(message)
+	if orderFragment.CorrelationID != "" {
+		meta.CorrelationID = orderFragment.CorrelationID
+	}
+
+	if orderFragment.TraceID != "" {
+		meta.TraceID = orderFragment.TraceID
+	}
+
+	order, err := a.kafka.prepareOrder(meta, message)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result, err := a.cache.SaveOrderInTx(tx, order, messageSource(meta))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return order, result, nil
+}
+
+func (a *OrderAssembler) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(a.config.GetSweepInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.sweep()
+		}
+	}
+}
+
+// sweep обрабатывает сборки, которые не завершились за ASSEMBLY_TIMEOUT,
+// и удаляет устаревшие отметки о завершенных сборках
+func (a *OrderAssembler) sweep() {
+	if _, err := a.repo.PurgeCompleted(time.Now().Add(-a.config.GetCompletedRetention())); err != nil {
+		log.Printf("Ошибка удаления отметок о завершенных сборках заказов: %v", err)
+	}
+
+	before := time.Now().Add(-a.config.GetTimeout())
+
+	keys, err := a.repo.Expired(before, a.config.GetSweepBatchSize())
+	if err != nil {
+		log.Printf("Ошибка поиска просроченных сборок заказов: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		expired, err := a.repo.Expire(key, before, a.expire)
+		if err != nil {
+			a.stats.recordFailed(err)
+			log.Printf("Просроченная сборка заказа %s не обработана: %v", key, err)
+
+			return
+		}
+
+		if expired {
+			a.stats.recordExpired()
+		}
+	}
+}
+
+// expire готовит сообщение о незавершенной сборке для топика оповещений или копии ее частей
+// для DLQ. Сообщения записываются в outbox вместе с отметкой о просрочке, и публикует их relay:
+// неудачная отправка повторяется без повторной обработки сборки.
+func (a *OrderAssembler) expire(fragments []models.OrderFragment) ([]*models.OutboxEvent, error) {
+	_, missing, _, err := mergeFragments(fragments)
+	if err != nil {
+		missing = nil
+	}
+
+	key := fragments[0].AssemblyKey
+	cause := eris.Wrapf(ErrIncompleteOrder, "order %s is missing %v after %s", key, missing, a.config.GetTimeout())
+
+	if a.config.GetTimeoutAction() == config.AssemblyTimeoutDeadLetter {
+		if !a.kafka.config.DeadLetterEnabled {
+			log.Printf("DLQ отключен, части незавершенного заказа %s отброшены: %v", key, cause)
+			return nil, nil
+		}
+
+		events := make([]*models.OutboxEvent, 0, len(fragments))
+
+		for i := range fragments {
+			message, err := fragmentMessage(&fragments[i], []byte(fragments[i].Payload))
+			if err != nil {
+				return nil, err
+			}
+
+			event, err := outboxMessage(
+				models.OutboxMessageAssemblyDeadLetter,
+				key,
+				failedMessageCopy(a.kafka.config.GetDeadLetterTopic(), message, cause, 1),
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			event.CorrelationID = fragments[i].CorrelationID
+			event.TraceID = fragments[i].TraceID
+			events = append(events, event)
+		}
+
+		log.Printf("Части незавершенного заказа %s поставлены в очередь на отправку в DLQ: %v", key, cause)
+
+		return events, nil
+	}
+
+	alert := IncompleteOrderAlert{
+		AssemblyKey:     key,
+		Missing:         missing,
+		FirstReceivedAt: fragments[0].CreatedAt,
+		ExpiredAt:       time.Now(),
+		Fragments:       make([]IncompleteOrderPart, 0, len(fragments)),
+	}
+
+	for _, fragment := range fragments {
+		if fragment.CreatedAt.Before(alert.FirstReceivedAt) {
+			alert.FirstReceivedAt = fragment.CreatedAt
+		}
+
+		alert.Fragments = append(alert.Fragments, IncompleteOrderPart{
+			Part:       fragment.Part,
+			Topic:      fragment.Topic,
+			Partition:  fragment.Partition,
+			Offset:     fragment.Offset,
+			ReceivedAt: fragment.CreatedAt,
+			Payload:    json.RawMessage(fragment.Payload),
+		})
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to marshal incomplete order alert %s", key)
+	}
+
+	event, err := models.NewMessageOutboxEvent(models.OutboxMessageAssemblyAlert, key, a.config.GetAlertTopic(), key, body,
+		map[string]string{HeaderError: cause.Error()})
+	if err != nil {
+		return nil, err
+	}
+
+	event.CorrelationID = fragments[0].CorrelationID
+	event.TraceID = fragments[0].TraceID
+
+	log.Printf("Заказ %s не собран за %s, оповещение поставлено в очередь на отправку в топик %s: %v",
+		key, a.config.GetTimeout(), a.config.GetAlertTopic(), missing)
+
+	return []*models.OutboxEvent{event}, nil
+}
+
+// outboxMessage переводит сообщение для Kafka в событие outbox, которое relay опубликует как есть
+func outboxMessage(eventType, aggregateID string, message *sarama.ProducerMessage) (*models.OutboxEvent, error) {
+	headers := make(map[string]string, len(message.Headers))
+	for _, header := range message.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+
+	var key []byte
+
+	if message.Key != nil {
+		encoded, err := message.Key.Encode()
+		if err != nil {
+			return nil, eris.Wrapf(err, "failed to encode key of message for topic %s", message.Topic)
+		}
+
+		key = encoded
+	}
+
+	value, err := message.Value.Encode()
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to encode message for topic %s", message.Topic)
+	}
+
+	return models.NewMessageOutboxEvent(eventType, aggregateID, message.Topic, string(key), value, headers)
+}
+
+// newOrderFragment извлекает из сообщения часть заказа и ключ сборки
+func newOrderFragment(part string, meta MessageMetadata, message *sarama.ConsumerMessage) (*models.OrderFragment, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message.Value, &fields); err != nil {
+		return nil, eris.Wrapf(ErrInvalidMessage, "invalid %s fragment: %v", part, err)
+	}
+
+	key := fragmentString(fields, "order_uid")
+	if key == "" && part == models.FragmentPartPayment {
+		key = fragmentString(fields, "transaction")
+	}
+
+	if key == "" {
+		return nil, eris.Wrapf(ErrInvalidMessage, "%s fragment has no order_uid", part)
+	}
+
+	headers, err := json.Marshal(meta.Headers)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to marshal headers of %s fragment", part)
+	}
+
+	return &models.OrderFragment{
+		AssemblyKey:   key,
+		Part:          part,
+		Payload:       string(message.Value),
+		Topic:         meta.Topic,
+		Partition:     message.Partition,
+		Offset:        message.Offset,
+		MessageKey:    meta.Key,
+		Headers:       string(headers),
+		Timestamp:     meta.Timestamp,
+		CorrelationID: meta.CorrelationID,
+		TraceID:       meta.TraceID,
+	}, nil
+}
+
+// mergeFragments собирает документ заказа из частей и возвращает недостающие части
+func mergeFragments(fragments []models.OrderFragment) (
+	map[string]json.RawMessage, []string, *models.OrderFragment, error,
+) {
+	byPart := make(map[string]*models.OrderFragment, len(fragments))
+	for i := range fragments {
+		byPart[fragments[i].Part] = &fragments[i]
+	}
+
+	orderFragment := byPart[models.FragmentPartOrder]
+	document := map[string]json.RawMessage{}
+
+	if orderFragment != nil {
+		if err := json.Unmarshal([]byte(orderFragment.Payload), &document); err != nil {
+			return nil, nil, nil, eris.Wrapf(ErrInvalidMessage, "invalid order fragment: %v", err)
+		}
+	}
+
+	var missing []string
+
+	for _, part := range assemblyParts {
+		if part == models.FragmentPartOrder {
+			if orderFragment == nil {
+				missing = append(missing, part)
+			}
+
+			continue
+		}
+
+		fragment, ok := byPart[part]
+		if !ok {
+			if raw := bytes.TrimSpace(document[part]); len(raw) == 0 || string(raw) == "null" {
+				missing = append(missing, part)
+			}
+
+			continue
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(fragment.Payload), &fields); err != nil {
+			return nil, nil, nil, eris.Wrapf(ErrInvalidMessage, "invalid %s fragment: %v", part, err)
+		}
+
+		// order_uid нужен только для связывания частей, в модели оплаты и доставки его нет
+		delete(fields, "order_uid")
+
+		raw, err := json.Marshal(fields)
+		if err != nil {
+			return nil, nil, nil, eris.Wrapf(err, "failed to marshal %s fragment", part)
+		}
+
+		document[part] = raw
+	}
+
+	return document, missing, orderFragment, nil
+}
+
+// fragmentMessage восстанавливает сообщение, из которого пришла часть, с телом value
+func fragmentMessage(fragment *models.OrderFragment, value []byte) (*sarama.ConsumerMessage, error) {
+	var headers map[string]string
+	if fragment.Headers != "" {
+		if err := json.Unmarshal([]byte(fragment.Headers), &headers); err != nil {
+			return nil, eris.Wrapf(err, "failed to parse headers of %s fragment %s", fragment.Part, fragment.AssemblyKey)
+		}
+	}
+
+	message := &sarama.ConsumerMessage{
+		Topic:     fragment.Topic,
+		Partition: fragment.Partition,
+		Offset:    fragment.Offset,
+		Value:     value,
+		Timestamp: fragment.Timestamp,
+		Headers:   make([]*sarama.RecordHeader, 0, len(headers)+1),
+	}
+
+	if fragment.MessageKey != "" {
+		message.Key = []byte(fragment.MessageKey)
+	}
+
+	for key, value := range headers {
+		message.Headers = append(message.Headers, &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+
+	return message, nil
+}
+
+func fragmentString(fields map[string]json.RawMessage, name string) string {
+	var value string
+	if err := json.Unmarshal(fields[name], &value); err != nil {
+		return ""
+	}
+
+	return value
+}
@@ -0,0 +1,388 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+	"wb/internal/orm/models"
+)
+
+// HeaderOrderFormat заголовок, которым producer может явно указать формат сообщения о заказе
+const HeaderOrderFormat = "x-order-format"
+
+// HeaderOrderVersion заголовок с версией заказа, имеет приоритет над полем version в теле
+const HeaderOrderVersion = "x-order-version"
+
+// Поддерживаемые форматы сообщений о заказах
+const (
+	// OrderFormatCanonical каноничный формат WB (как в test_data.json)
+	OrderFormatCanonical = "canonical"
+	// OrderFormatLegacy упрощенный формат OrderMessage (order_id, user_id, ...)
+	OrderFormatLegacy = "legacy"
+)
+
+// OrderMessage упрощенный формат сообщения о заказе
+type OrderMessage struct {
+	OrderID   string                 `json:"order_id"`
+	UserID    string                 `json:"user_id"`
+	Status    string                 `json:"status"`
+	Items     []models.OrderItem     `json:"items"`
+	Payment   models.Payment         `json:"payment"`
+	Delivery  models.Delivery        `json:"delivery"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// CanonicalOrder каноничный формат заказа WB
+type CanonicalOrder struct {
+	OrderUID          string            `json:"order_uid"`
+	TrackNumber       string            `json:"track_number"`
+	Entry             string            `json:"entry"`
+	Delivery          CanonicalDelivery `json:"delivery"`
+	Payment           CanonicalPayment  `json:"payment"`
+	Items             []CanonicalItem   `json:"items"`
+	Locale            string            `json:"locale"`
+	InternalSignature string            `json:"internal_signature"`
+	CustomerID        string            `json:"customer_id"`
+	DeliveryService   string            `json:"delivery_service"`
+	ShardKey          string            `json:"shardkey"`
+	SmID              int               `json:"sm_id"`
+	DateCreated       time.Time         `json:"date_created"`
+	OofShard          string            `json:"oof_shard"`
+	Version           int64             `json:"version"`
+	Status            string            `json:"status"`
+}
+
+type CanonicalDelivery struct {
+	Name    string `json:"name"`
+	Phone   string `json:"phone"`
+	Zip     string `json:"zip"`
+	City    string `json:"city"`
+	Address string `json:"address"`
+	Region  string `json:"region"`
+	Email   string `json:"email"`
+}
+
+type CanonicalPayment struct {
+	Transaction  string        `json:"transaction"`
+	RequestID    string        `json:"request_id"`
+	Currency     string        `json:"currency"`
+	Provider     string        `json:"provider"`
+	Amount       float64       `json:"amount"`
+	PaymentDt    UnixOrRFC3339 `json:"payment_dt"`
+	Bank         string        `json:"bank"`
+	DeliveryCost float64       `json:"delivery_cost"`
+	GoodsTotal   float64       `json:"goods_total"`
+	CustomFee    float64       `json:"custom_fee"`
+}
+
+type CanonicalItem struct {
+	ChrtID      int     `json:"chrt_id"`
+	TrackNumber string  `json:"track_number"`
+	Price       float64 `json:"price"`
+	Rid         string  `json:"rid"`
+	Name        string  `json:"name"`
+	Sale        int     `json:"sale"`
+	Size        string  `json:"size"`
+	Quantity    *int    `json:"quantity"` // nil, если поле не передано
+	TotalPrice  float64 `json:"total_price"`
+	NmID        int     `json:"nm_id"`
+	Brand       string  `json:"brand"`
+	Status      int     `json:"status"`
+}
+
+// UnixOrRFC3339 время, которое приходит либо unix timestamp (секунды), либо строкой RFC3339
+type UnixOrRFC3339 struct {
+	time.Time
+}
+
+func (t *UnixOrRFC3339) UnmarshalJSON(data []byte) error {
+	raw := strings.Trim(string(bytes.TrimSpace(data)), `"`)
+	if raw == "" || raw == "null" {
+		return nil
+	}
+
+	if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		t.Time = time.Unix(seconds, 0).UTC()
+		return nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return eris.Wrapf(ErrInvalidMessage, "invalid timestamp %q: %v", raw, err)
+	}
+
+	t.Time = parsed
+
+	return nil
+}
+
+// DecodeOrderMessage декодирует сообщение о заказе в модель Order.
+// Формат берется из заголовка x-order-format, а если его нет — определяется по содержимому.
+func DecodeOrderMessage(message *sarama.ConsumerMessage) (*models.Order, error) {
+	format := strings.ToLower(headerValue(message.Headers, HeaderOrderFormat))
+	if format == "" {
+		detected, err := detectOrderFormat(message.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		format = detected
+	}
+
+	var (
+		order *models.Order
+		err   error
+	)
+
+	switch format {
+	case OrderFormatCanonical:
+		order, err = decodeCanonicalOrder(message.Value)
+	case OrderFormatLegacy:
+		order, err = decodeLegacyOrder(message.Value)
+	default:
+		return nil, eris.Wrapf(ErrInvalidMessage, "unsupported order format %q", format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyOrderVersion(order, message); err != nil {
+		return nil, err
+	}
+
+	// Пустой статус допустим: новый заказ получит created, у существующего статус не изменится
+	order.Status = strings.ToLower(strings.TrimSpace(order.Status))
+	if order.Status != "" && !models.IsValidOrderStatus(order.Status) {
+		return nil, eris.Wrapf(ErrInvalidMessage, "unknown order status %q", order.Status)
+	}
+
+	return order, nil
+}
+
+// applyOrderVersion задает версию заказа для разрешения конфликтов по order_uid:
+// заголовок x-order-version, затем версия из тела, затем время сообщения в миллисекундах.
+// Для копий из топиков повторов и DLQ берется время исходного сообщения.
+func applyOrderVersion(order *models.Order, message *sarama.ConsumerMessage) error {
+	if raw := headerValue(message.Headers, HeaderOrderVersion); raw != "" {
+		version, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return eris.Wrapf(ErrInvalidMessage, "invalid %s header %q", HeaderOrderVersion, raw)
+		}
+
+		order.Version = version
+
+		return nil
+	}
+
+	if order.Version != 0 {
+		return nil
+	}
+
+	if raw := headerValue(message.Headers, HeaderOriginalTimestamp); raw != "" {
+		timestamp, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return eris.Wrapf(ErrInvalidMessage, "invalid %s header %q", HeaderOriginalTimestamp, raw)
+		}
+
+		order.Version = timestamp
+
+		return nil
+	}
+
+	if !message.Timestamp.IsZero() {
+		order.Version = message.Timestamp.UnixMilli()
+	}
+
+	return nil
+}
+
+// detectOrderFormat определяет формат по ключам верхнего уровня
+func detectOrderFormat(payload []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return "", eris.Wrapf(ErrInvalidMessage, "failed to unmarshal order message: %v", err)
+	}
+
+	if _, ok := fields["order_uid"]; ok {
+		return OrderFormatCanonical, nil
+	}
+
+	if _, ok := fields["order_id"]; ok {
+		return OrderFormatLegacy, nil
+	}
+
+	return "", eris.Wrap(ErrInvalidMessage, "unknown order message format: neither order_uid nor order_id present")
+}
+
+func decodeCanonicalOrder(payload []byte) (*models.Order, error) {
+	var canonical CanonicalOrder
+	if err := json.Unmarshal(payload, &canonical); err != nil {
+		return nil, eris.Wrapf(ErrInvalidMessage, "failed to unmarshal canonical order: %v", err)
+	}
+
+	if strings.TrimSpace(canonical.OrderUID) == "" {
+		return nil, eris.Wrap(ErrInvalidMessage, "order_uid is required")
+	}
+
+	order := &models.Order{
+		OrderUID:          canonical.OrderUID,
+		TrackNumber:       canonical.TrackNumber,
+		Entry:             canonical.Entry,
+		Locale:            canonical.Locale,
+		InternalSignature: canonical.InternalSignature,
+		CustomerID:        canonical.CustomerID,
+		DeliveryService:   canonical.DeliveryService,
+		ShardKey:          canonical.ShardKey,
+		SmID:              canonical.SmID,
+		DateCreated:       canonical.DateCreated,
+		OofShard:          canonical.OofShard,
+		Version:           canonical.Version,
+		Status:            canonical.Status,
+		Delivery: &models.Delivery{
+			Name:    canonical.Delivery.Name,
+			Phone:   canonical.Delivery.Phone,
+			Zip:     canonical.Delivery.Zip,
+			City:    canonical.Delivery.City,
+			Address: canonical.Delivery.Address,
+			Region:  canonical.Delivery.Region,
+			Email:   canonical.Delivery.Email,
+		},
+		Payment: &models.Payment{
+			Transaction:  canonical.Payment.Transaction,
+			RequestID:    canonical.Payment.RequestID,
+			Currency:     canonical.Payment.Currency,
+			Provider:     canonical.Payment.Provider,
+			Amount:       canonical.Payment.Amount,
+			PaymentDt:    canonical.Payment.PaymentDt.Time,
+			Bank:         canonical.Payment.Bank,
+			DeliveryCost: canonical.Payment.DeliveryCost,
+			GoodsTotal:   canonical.Payment.GoodsTotal,
+			CustomFee:    canonical.Payment.CustomFee,
+		},
+	}
+
+	for _, item := range canonical.Items {
+		// Без поля quantity позиция считается одной штукой. Явный 0 сохраняем как есть,
+		// чтобы его отклонило правило схемы items[].quantity
+		quantity := 1
+		if item.Quantity != nil {
+			quantity = *item.Quantity
+		}
+
+		order.Items = append(order.Items, models.OrderItem{
+			ChrtID:      item.ChrtID,
+			TrackNumber: item.TrackNumber,
+			Price:       item.Price,
+			Rid:         item.Rid,
+			Name:        item.Name,
+			Sale:        item.Sale,
+			Size:        item.Size,
+			Quantity:    quantity,
+			TotalPrice:  item.TotalPrice,
+			NmID:        item.NmID,
+			Brand:       item.Brand,
+			Status:      item.Status,
+		})
+	}
+
+	order.TotalAmount = orderTotal(order.Items)
+
+	return order, nil
+}
+
+func decodeLegacyOrder(payload []byte) (*models.Order, error) {
+	var orderMsg OrderMessage
+	if err := json.Unmarshal(payload, &orderMsg); err != nil {
+		return nil, eris.Wrapf(ErrInvalidMessage, "failed to unmarshal order message: %v", err)
+	}
+
+	// Базовая валидация
+	if strings.TrimSpace(orderMsg.OrderID) == "" {
+		return nil, eris.Wrap(ErrInvalidMessage, "order_id is required")
+	}
+
+	// Преобразуем сообщение в модель Order
+	order := &models.Order{
+		OrderUID:    orderMsg.OrderID,
+		TrackNumber: orderMsg.OrderID, // В упрощенном формате нет track_number, используем OrderID
+		CustomerID:  orderMsg.UserID,
+		DateCreated: orderMsg.CreatedAt,
+		Status:      orderMsg.Status,
+		TotalAmount: 0, // Будет рассчитано из Items
+	}
+
+	// Версией упрощенного формата служит время последнего изменения
+	if !orderMsg.UpdatedAt.IsZero() {
+		order.Version = orderMsg.UpdatedAt.UnixMilli()
+	}
+
+	// Копируем Items
+	for _, item := range orderMsg.Items {
+		order.Items = append(order.Items, models.OrderItem{
+			ChrtID:      item.ChrtID,
+			TrackNumber: item.TrackNumber,
+			Price:       item.Price,
+			Rid:         item.Rid,
+			Name:        item.Name,
+			Sale:        item.Sale,
+			Size:        item.Size,
+			TotalPrice:  item.TotalPrice,
+			NmID:        item.NmID,
+			Brand:       item.Brand,
+			Status:      item.Status,
+		})
+	}
+
+	order.TotalAmount = orderTotal(order.Items)
+
+	// Копируем Payment
+	order.Payment = &models.Payment{
+		Transaction:  orderMsg.Payment.Transaction,
+		RequestID:    orderMsg.Payment.RequestID,
+		Currency:     orderMsg.Payment.Currency,
+		Provider:     orderMsg.Payment.Provider,
+		Amount:       orderMsg.Payment.Amount,
+		PaymentDt:    orderMsg.Payment.PaymentDt,
+		Bank:         orderMsg.Payment.Bank,
+		DeliveryCost: orderMsg.Payment.DeliveryCost,
+		GoodsTotal:   orderMsg.Payment.GoodsTotal,
+		CustomFee:    orderMsg.Payment.CustomFee,
+	}
+
+	// Копируем Delivery
+	order.Delivery = &models.Delivery{
+		Name:    orderMsg.Delivery.Name,
+		Phone:   orderMsg.Delivery.Phone,
+		Zip:     orderMsg.Delivery.Zip,
+		City:    orderMsg.Delivery.City,
+		Address: orderMsg.Delivery.Address,
+		Region:  orderMsg.Delivery.Region,
+		Email:   orderMsg.Delivery.Email,
+	}
+
+	return order, nil
+}
+
+// orderTotal считает сумму заказа по позициям без потери копеек.
+// Позиция без total_price учитывается по цене.
+func orderTotal(items []models.OrderItem) float64 {
+	var total float64
+
+	for _, item := range items {
+		if item.TotalPrice > 0 {
+			total += item.TotalPrice
+		} else {
+			total += item.Price
+		}
+	}
+
+	return roundMoney(total)
+}
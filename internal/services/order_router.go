@@ -0,0 +1,792 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"wb/internal/orm/models"
+	"wb/internal/orm/repositories"
+)
+
+// HeaderRoutingRule имя правила, по которому заказ опубликован в топик
+const HeaderRoutingRule = "x-routing-rule"
+
+var (
+	// ErrInvalidRoutingRule определение правила маршрутизации некорректно
+	ErrInvalidRoutingRule = errors.New("invalid routing rule")
+	// ErrRoutingRuleNotFound правило с таким именем не найдено
+	ErrRoutingRuleNotFound = errors.New("routing rule not found")
+)
+
+// RouteCondition условие правила маршрутизации. Узел либо объединяет вложенные условия
+// (all, any, not), либо проверяет поле заказа по пути через точку (payment.provider).
+// Проверки поля (eq, in, gt, gte, lt, lte, regex, exists) должны выполняться все.
+type RouteCondition struct {
+	All []RouteCondition `json:"all,omitempty"`
+	Any []RouteCondition `json:"any,omitempty"`
+	Not *RouteCondition  `json:"not,omitempty"`
+
+	Field  string        `json:"field,omitempty"`
+	Eq     interface{}   `json:"eq,omitempty"`
+	In     []interface{} `json:"in,omitempty"`
+	Gt     *float64      `json:"gt,omitempty"`
+	Gte    *float64      `json:"gte,omitempty"`
+	Lt     *float64      `json:"lt,omitempty"`
+	Lte    *float64      `json:"lte,omitempty"`
+	Regex  string        `json:"regex,omitempty"`
+	Exists *bool         `json:"exists,omitempty"`
+}
+
+// RoutingRuleDefinition правило маршрутизации: заказы, подходящие под условие, публикуются
+// в Topic. Правила применяются по возрастанию Priority; Stop прекращает проверку
+// следующих правил после совпадения.
+type RoutingRuleDefinition struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Topic       string         `json:"topic"`
+	Priority    int            `json:"priority"`
+	Stop        bool           `json:"stop"`
+	Disabled    bool           `json:"disabled"`
+	Condition   RouteCondition `json:"condition"`
+}
+
+// ConditionCheck результат одной проверки поля при пробном прогоне
+type ConditionCheck struct {
+	Field    string      `json:"field"`
+	Check    string      `json:"check"`
+	Expected interface{} `json:"expected,omitempty"`
+	Actual   interface{} `json:"actual"`
+	Matched  bool        `json:"matched"`
+}
+
+// RoutingDecision результат проверки правила на заказе
+type RoutingDecision struct {
+	Rule    string           `json:"rule"`
+	Topic   string           `json:"topic"`
+	Matched bool             `json:"matched"`
+	Skipped string           `json:"skipped,omitempty"`
+	Checks  []ConditionCheck `json:"checks"`
+}
+
+// RoutingRuleInfo правило вместе с его счетчиками
+type RoutingRuleInfo struct {
+	RoutingRuleDefinition
+
+	Version   int64                  `json:"version"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	Stats     map[string]interface{} `json:"stats"`
+}
+
+// routeStats счетчики правила
+type routeStats struct {
+	mu          sync.Mutex
+	evaluated   uint64
+	matched     uint64
+	published   uint64
+	failed      uint64
+	lastError   string
+	lastMatched time.Time
+}
+
+func (s *routeStats) recordEvaluated(matched bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evaluated++
+
+	if matched {
+		s.matched++
+		s.lastMatched = time.Now()
+	}
+}
+
+func (s *routeStats) recordPublished(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.failed++
+		s.lastError = err.Error()
+
+		return
+	}
+
+	s.published++
+}
+
+func (s *routeStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"evaluated":  s.evaluated,
+		"matched":    s.matched,
+		"published":  s.published,
+		"failed":     s.failed,
+		"last_error": s.lastError,
+	}
+
+	if !s.lastMatched.IsZero() {
+		stats["last_matched_at"] = s.lastMatched
+	}
+
+	return stats
+}
+
+// fieldCheck проверка поля заказа
+type fieldCheck struct {
+	name     string
+	expected interface{}
+	test     func(value interface{}, found bool) bool
+}
+
+// compiledCondition условие, готовое к проверке
+type compiledCondition struct {
+	all    []*compiledCondition
+	any    []*compiledCondition
+	not    *compiledCondition
+	field  string
+	checks []fieldCheck
+}
+
+// compiledRoute правило, готовое к применению
+type compiledRoute struct {
+	definition RoutingRuleDefinition
+	condition  *compiledCondition
+	version    int64
+	updatedAt  time.Time
+	stats      *routeStats
+}
+
+// OrderRouter публикует сохраненные заказы в топики по правилам маршрутизации.
+// Заказы берутся из событий order.persisted, которые пишутся в outbox в одной транзакции
+// с заказом. На каждое совпавшее правило в outbox записывается отдельное событие
+// order.routed: relay публикует и повторяет копии по правилам независимо друг от друга.
+type OrderRouter struct {
+	repo   *repositories.RoutingRuleRepository
+	kafka  *KafkaService
+	outbox *OutboxRelay
+
+	// changes упорядочивает изменения, чтобы БД и действующие правила не расходились
+	changes sync.Mutex
+	once    sync.Once
+
+	mu     sync.RWMutex
+	routes []*compiledRoute
+	stats  map[string]*routeStats
+}
+
+func NewOrderRouter(
+	repo *repositories.RoutingRuleRepository,
+	kafka *KafkaService,
+	outbox *OutboxRelay,
+) *OrderRouter {
+	return &OrderRouter{
+		repo:   repo,
+		kafka:  kafka,
+		outbox: outbox,
+		stats:  make(map[string]*routeStats),
+	}
+}
+
+// Load загружает правила из БД и подключает маршрутизацию к публикации событий outbox.
+// Некорректные сохраненные правила пропускаются с предупреждением.
+func (r *OrderRouter) Load() error {
+	r.changes.Lock()
+	defer r.changes.Unlock()
+
+	rows, err := r.repo.List()
+	if err != nil {
+		return err
+	}
+
+	routes := make([]*compiledRoute, 0, len(rows))
+
+	for i := range rows {
+		route, err := r.routeFromRow(&rows[i])
+		if err != nil {
+			log.Printf("Правило маршрутизации %s пропущено: %v", rows[i].Name, err)
+			continue
+		}
+
+		routes = append(routes, route)
+	}
+
+	r.mu.Lock()
+	r.routes = routes
+	r.mu.Unlock()
+
+	r.once.Do(func() {
+		r.outbox.OnOrderPersisted(r.route)
+		r.outbox.OnOrderRouted(r.publish)
+	})
+
+	log.Printf("Загружено правил маршрутизации заказов: %d", len(routes))
+
+	return nil
+}
+
+// Apply проверяет, сохраняет и применяет правило, заменяя прежнее с тем же именем
+func (r *OrderRouter) Apply(definition RoutingRuleDefinition) (*RoutingRuleInfo, error) {
+	r.changes.Lock()
+	defer r.changes.Unlock()
+
+	definition.Name = strings.TrimSpace(definition.Name)
+
+	condition, err := r.compileDefinition(definition)
+	if err != nil {
+		return nil, err
+	}
+
+	conditionJSON, err := json.Marshal(definition.Condition)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to marshal condition of routing rule %s", definition.Name)
+	}
+
+	row := &models.RoutingRule{
+		Name:        definition.Name,
+		Description: definition.Description,
+		Topic:       definition.Topic,
+		Priority:    definition.Priority,
+		Stop:        definition.Stop,
+		Disabled:    definition.Disabled,
+		Condition:   string(conditionJSON),
+	}
+
+	if err := r.repo.Save(row); err != nil {
+		return nil, err
+	}
+
+	route := &compiledRoute{
+		definition: definition,
+		condition:  condition,
+		version:    row.Version,
+		updatedAt:  row.UpdatedAt,
+		stats:      r.statsFor(definition.Name),
+	}
+
+	r.mu.Lock()
+	routes := make([]*compiledRoute, 0, len(r.routes)+1)
+
+	for _, existing := range r.routes {
+		if existing.definition.Name != route.definition.Name {
+			routes = append(routes, existing)
+		}
+	}
+
+	routes = append(routes, route)
+	sortRoutes(routes)
+	r.routes = routes
+	r.mu.Unlock()
+
+	log.Printf("Правило маршрутизации %s применено (версия %d): топик %s", row.Name, row.Version, row.Topic)
+
+	info := route.info()
+
+	return &info, nil
+}
+
+// Delete удаляет правило
+func (r *OrderRouter) Delete(name string) error {
+	r.changes.Lock()
+	defer r.changes.Unlock()
+
+	deleted, err := r.repo.Delete(name)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	routes := make([]*compiledRoute, 0, len(r.routes))
+
+	for _, route := range r.routes {
+		if route.definition.Name == name {
+			deleted = true
+			continue
+		}
+
+		routes = append(routes, route)
+	}
+
+	r.routes = routes
+	delete(r.stats, name)
+	r.mu.Unlock()
+
+	if !deleted {
+		return eris.Wrapf(ErrRoutingRuleNotFound, "rule: %s", name)
+	}
+
+	log.Printf("Правило маршрутизации %s удалено", name)
+
+	return nil
+}
+
+// List возвращает действующие правила в порядке применения со счетчиками
+func (r *OrderRouter) List() []RoutingRuleInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rules := make([]RoutingRuleInfo, 0, len(r.routes))
+	for _, route := range r.routes {
+		rules = append(rules, route.info())
+	}
+
+	return rules
+}
+
+// DryRun проверяет заказ без публикации: правилом rule, если оно передано,
+// иначе всеми действующими правилами. Счетчики правил не меняются.
+func (r *OrderRouter) DryRun(rule *RoutingRuleDefinition, sample json.RawMessage) ([]RoutingDecision, error) {
+	var order models.Order
+	if err := json.Unmarshal(sample, &order); err != nil {
+		return nil, eris.Wrapf(ErrInvalidMessage, "invalid sample order: %v", err)
+	}
+
+	document, err := orderDocument(&order)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*compiledRoute
+
+	if rule != nil {
+		condition, err := r.compileDefinition(*rule)
+		if err != nil {
+			return nil, err
+		}
+
+		routes = []*compiledRoute{{definition: *rule, condition: condition}}
+	} else {
+		r.mu.RLock()
+		routes = append(routes, r.routes...)
+		r.mu.RUnlock()
+	}
+
+	decisions := make([]RoutingDecision, 0, len(routes))
+	stopped := ""
+
+	for _, route := range routes {
+		decision := RoutingDecision{
+			Rule:   route.definition.Name,
+			Topic:  route.definition.Topic,
+			Checks: []ConditionCheck{},
+		}
+
+		switch {
+		case route.definition.Disabled:
+			decision.Skipped = "правило отключено"
+		case stopped != "":
+			decision.Skipped = "проверка остановлена правилом " + stopped
+		default:
+			decision.Matched = route.condition.evaluate(document, &decision.Checks)
+
+			if decision.Matched && route.definition.Stop {
+				stopped = route.definition.Name
+			}
+		}
+
+		decisions = append(decisions, decision)
+	}
+
+	return decisions, nil
+}
+
+// route применяет правила к заказу из события order.persisted и возвращает события
+// order.routed для топиков совпавших правил. Заказы, уже опубликованные маршрутизацией,
+// повторно не маршрутизируются, чтобы конвейер топика назначения не замкнул цикл.
+func (r *OrderRouter) route(event *models.OrderEvent) ([]models.OrderEvent, error) {
+	order := event.Order
+	if order == nil || event.RoutingRule != "" {
+		return nil, nil
+	}
+
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+
+	if len(routes) == 0 {
+		return nil, nil
+	}
+
+	document, err := orderDocument(order)
+	if err != nil {
+		log.Printf("Заказ %s не проверен правилами маршрутизации: %v", order.OrderUID, err)
+		return nil, nil
+	}
+
+	var routed []models.OrderEvent
+
+	for _, route := range routes {
+		if route.definition.Disabled {
+			continue
+		}
+
+		matched := route.condition.evaluate(document, nil)
+		route.stats.recordEvaluated(matched)
+
+		if !matched {
+			continue
+		}
+
+		routed = append(routed, models.OrderEvent{
+			EventType:   models.OrderEventRouted,
+			OrderUID:    order.OrderUID,
+			Status:      order.Status,
+			Version:     order.Version,
+			Order:       order,
+			RoutingRule: route.definition.Name,
+			Topic:       route.definition.Topic,
+
+			CorrelationID: event.CorrelationID,
+			TraceID:       event.TraceID,
+		})
+
+		if route.definition.Stop {
+			break
+		}
+	}
+
+	return routed, nil
+}
+
+// publish публикует копию заказа из события order.routed в топик правила.
+// Ошибка отправки возвращается relay, и повторяется только это событие.
+func (r *OrderRouter) publish(ctx context.Context, event *models.OrderEvent) error {
+	if event.Order == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(event.Order)
+	if err != nil {
+		return eris.Wrapf(err, "failed to marshal order %s", event.OrderUID)
+	}
+
+	err = r.kafka.SendMessageWithHeaders(ctx, event.Topic, event.OrderUID, payload, map[string]string{
+		HeaderRoutingRule: event.RoutingRule,
+	})
+
+	r.mu.RLock()
+	stats := r.stats[event.RoutingRule]
+	r.mu.RUnlock()
+
+	if stats != nil {
+		stats.recordPublished(err)
+	}
+
+	if err != nil {
+		log.Printf("Заказ %s не опубликован в топик %s по правилу %s: %v",
+			event.OrderUID, event.Topic, event.RoutingRule, err)
+
+		return eris.Wrapf(err, "routing rule %s", event.RoutingRule)
+	}
+
+	return nil
+}
+
+func (r *OrderRouter) routeFromRow(row *models.RoutingRule) (*compiledRoute, error) {
+	definition := RoutingRuleDefinition{
+		Name:        row.Name,
+		Description: row.Description,
+		Topic:       row.Topic,
+		Priority:    row.Priority,
+		Stop:        row.Stop,
+		Disabled:    row.Disabled,
+	}
+
+	if err := json.Unmarshal([]byte(row.Condition), &definition.Condition); err != nil {
+		return nil, eris.Wrapf(ErrInvalidRoutingRule, "failed to parse condition: %v", err)
+	}
+
+	condition, err := r.compileDefinition(definition)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compiledRoute{
+		definition: definition,
+		condition:  condition,
+		version:    row.Version,
+		updatedAt:  row.UpdatedAt,
+		stats:      r.statsFor(row.Name),
+	}, nil
+}
+
+// compileDefinition проверяет правило. Публикация в основной топик заказов и служебные
+// топики запрещена: заказ снова попал бы на вход сервиса.
+func (r *OrderRouter) compileDefinition(definition RoutingRuleDefinition) (*compiledCondition, error) {
+	if definition.Name == "" {
+		return nil, eris.Wrap(ErrInvalidRoutingRule, "name is required")
+	}
+
+	topic := definition.Topic
+	config := r.kafka.config
+
+	switch {
+	case topic == "":
+		return nil, eris.Wrap(ErrInvalidRoutingRule, "topic is required")
+	case topic == config.GetTopic() || topic == config.GetDeadLetterTopic() || strings.Contains(topic, ".retry."):
+		return nil, eris.Wrapf(ErrInvalidRoutingRule, "orders cannot be routed to service topic %s", topic)
+	}
+
+	return compileCondition(definition.Condition, "condition")
+}
+
+// statsFor возвращает счетчики правила; при замене правила они сохраняются
+func (r *OrderRouter) statsFor(name string) *routeStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, ok := r.stats[name]
+	if !ok {
+		stats = &routeStats{}
+		r.stats[name] = stats
+	}
+
+	return stats
+}
+
+func (route *compiledRoute) info() RoutingRuleInfo {
+	return RoutingRuleInfo{
+		RoutingRuleDefinition: route.definition,
+		Version:               route.version,
+		UpdatedAt:             route.updatedAt,
+		Stats:                 route.stats.snapshot(),
+	}
+}
+
+func sortRoutes(routes []*compiledRoute) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].definition.Priority != routes[j].definition.Priority {
+			return routes[i].definition.Priority < routes[j].definition.Priority
+		}
+
+		return routes[i].definition.Name < routes[j].definition.Name
+	})
+}
+
+// orderDocument представляет заказ в виде JSON-документа, по полям которого проверяются условия
+func orderDocument(order *models.Order) (interface{}, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to marshal order %s", order.OrderUID)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, eris.Wrapf(err, "failed to decode order %s", order.OrderUID)
+	}
+
+	return document, nil
+}
+
+func compileCondition(condition RouteCondition, path string) (*compiledCondition, error) {
+	compiled := &compiledCondition{field: condition.Field}
+
+	kinds := 0
+
+	if len(condition.All) > 0 {
+		kinds++
+
+		for i, nested := range condition.All {
+			child, err := compileCondition(nested, fmt.Sprintf("%s.all[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+
+			compiled.all = append(compiled.all, child)
+		}
+	}
+
+	if len(condition.Any) > 0 {
+		kinds++
+
+		for i, nested := range condition.Any {
+			child, err := compileCondition(nested, fmt.Sprintf("%s.any[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+
+			compiled.any = append(compiled.any, child)
+		}
+	}
+
+	if condition.Not != nil {
+		kinds++
+
+		child, err := compileCondition(*condition.Not, path+".not")
+		if err != nil {
+			return nil, err
+		}
+
+		compiled.not = child
+	}
+
+	if condition.Field != "" {
+		kinds++
+
+		checks, err := compileFieldChecks(condition)
+		if err != nil {
+			return nil, eris.Wrapf(err, "%s", path)
+		}
+
+		compiled.checks = checks
+	}
+
+	if kinds != 1 {
+		return nil, eris.Wrapf(ErrInvalidRoutingRule, "%s: exactly one of all, any, not or field must be set", path)
+	}
+
+	return compiled, nil
+}
+
+func compileFieldChecks(condition RouteCondition) ([]fieldCheck, error) {
+	var checks []fieldCheck
+
+	if condition.Eq != nil {
+		expected := fmt.Sprint(condition.Eq)
+
+		checks = append(checks, fieldCheck{name: "eq", expected: condition.Eq, test: func(value interface{}, found bool) bool {
+			return found && fmt.Sprint(value) == expected
+		}})
+	}
+
+	if len(condition.In) > 0 {
+		expected := make(map[string]bool, len(condition.In))
+		for _, value := range condition.In {
+			expected[fmt.Sprint(value)] = true
+		}
+
+		checks = append(checks, fieldCheck{name: "in", expected: condition.In, test: func(value interface{}, found bool) bool {
+			return found && expected[fmt.Sprint(value)]
+		}})
+	}
+
+	bounds := []struct {
+		name  string
+		bound *float64
+		test  func(actual, bound float64) bool
+	}{
+		{"gt", condition.Gt, func(actual, bound float64) bool { return actual > bound }},
+		{"gte", condition.Gte, func(actual, bound float64) bool { return actual >= bound }},
+		{"lt", condition.Lt, func(actual, bound float64) bool { return actual < bound }},
+		{"lte", condition.Lte, func(actual, bound float64) bool { return actual <= bound }},
+	}
+
+	for _, bound := range bounds {
+		if bound.bound == nil {
+			continue
+		}
+
+		limit, compare := *bound.bound, bound.test
+
+		checks = append(checks, fieldCheck{name: bound.name, expected: limit, test: func(value interface{}, found bool) bool {
+			actual, ok := numericValue(value)
+
+			return found && ok && compare(actual, limit)
+		}})
+	}
+
+	if condition.Regex != "" {
+		pattern, err := regexp.Compile(condition.Regex)
+		if err != nil {
+			return nil, eris.Wrapf(ErrInvalidRoutingRule, "invalid regex %q: %v", condition.Regex, err)
+		}
+
+		checks = append(checks, fieldCheck{name: "regex", expected: condition.Regex, test: func(value interface{}, found bool) bool {
+			return found && value != nil && pattern.MatchString(fmt.Sprint(value))
+		}})
+	}
+
+	if condition.Exists != nil {
+		want := *condition.Exists
+
+		checks = append(checks, fieldCheck{name: "exists", expected: want, test: func(_ interface{}, found bool) bool {
+			return found == want
+		}})
+	}
+
+	if len(checks) == 0 {
+		return nil, eris.Wrapf(ErrInvalidRoutingRule, "field %s has no checks", condition.Field)
+	}
+
+	return checks, nil
+}
+
+// evaluate проверяет условие на документе заказа. Если trace не nil, в него
+// записываются результаты всех выполненных проверок полей.
+func (c *compiledCondition) evaluate(document interface{}, trace *[]ConditionCheck) bool {
+	switch {
+	case c.all != nil:
+		for _, child := range c.all {
+			if !child.evaluate(document, trace) {
+				return false
+			}
+		}
+
+		return true
+	case c.any != nil:
+		for _, child := range c.any {
+			if child.evaluate(document, trace) {
+				return true
+			}
+		}
+
+		return false
+	case c.not != nil:
+		return !c.not.evaluate(document, trace)
+	}
+
+	value, found := jsonField(document, c.field)
+	matched := true
+
+	for _, check := range c.checks {
+		ok := check.test(value, found)
+
+		if trace != nil {
+			*trace = append(*trace, ConditionCheck{
+				Field:    c.field,
+				Check:    check.name,
+				Expected: check.expected,
+				Actual:   value,
+				Matched:  ok,
+			})
+		}
+
+		if !ok {
+			matched = false
+
+			if trace == nil {
+				return false
+			}
+		}
+	}
+
+	return matched
+}
+
+func numericValue(value interface{}) (float64, bool) {
+	switch typed := value.(type) {
+	case json.Number:
+		number, err := typed.Float64()
+		return number, err == nil
+	case string:
+		number, err := strconv.ParseFloat(typed, 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
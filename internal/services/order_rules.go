@@ -0,0 +1,305 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/rotisserie/eris"
+	"wb/config"
+	"wb/internal/orm/models"
+)
+
+// Режимы реакции на нарушение бизнес-инвариантов
+const (
+	ConsistencyModeReject  = "reject"
+	ConsistencyModeFlag    = "flag"
+	ConsistencyModeCorrect = "correct"
+)
+
+// ConsistencyRule бизнес-инвариант заказа. Правила выполняются по порядку регистрации,
+// поэтому исправление в одном правиле учитывается следующими
+type ConsistencyRule interface {
+	// Name уникальное имя правила, используется в счетчиках и в списке нарушений
+	Name() string
+	// Check возвращает нарушения с учетом допустимого расхождения сумм
+	Check(order *models.Order, tolerance float64) []models.ConsistencyIssue
+	// Correct приводит заказ в соответствие с правилом
+	Correct(order *models.Order)
+}
+
+// OrderRuleEngine проверяет бизнес-инварианты заказа и в зависимости от режима
+// отклоняет, помечает или исправляет несогласованные заказы
+type OrderRuleEngine struct {
+	cfg   *config.Orders
+	rules []ConsistencyRule
+
+	mu        sync.Mutex
+	verdicts  map[string]uint64
+	byRule    map[string]uint64
+	evaluated uint64
+}
+
+func NewOrderRuleEngine(cfg *config.Orders) *OrderRuleEngine {
+	engine := &OrderRuleEngine{
+		cfg:      cfg,
+		verdicts: make(map[string]uint64),
+		byRule:   make(map[string]uint64),
+	}
+
+	// Порядок важен: сначала суммы позиций, затем итог по товарам, затем сумма платежа
+	engine.RegisterRule(itemTotalRule{})
+	engine.RegisterRule(goodsTotalRule{})
+	engine.RegisterRule(paymentAmountRule{})
+
+	return engine
+}
+
+// RegisterRule добавляет правило в конец цепочки
+func (e *OrderRuleEngine) RegisterRule(rule ConsistencyRule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = append(e.rules, rule)
+}
+
+// Evaluate проверяет заказ и записывает вердикт в ConsistencyStatus/ConsistencyIssues.
+// В режиме reject несогласованный заказ возвращает постоянную ошибку.
+func (e *OrderRuleEngine) Evaluate(order *models.Order) error {
+	e.mu.Lock()
+	rules := append([]ConsistencyRule(nil), e.rules...)
+	e.mu.Unlock()
+
+	tolerance := e.cfg.GetConsistencyTolerance(orderCurrency(order))
+	mode := e.cfg.GetConsistencyMode()
+
+	var issues models.ConsistencyIssues
+
+	for _, rule := range rules {
+		found := rule.Check(order, tolerance)
+		if len(found) == 0 {
+			continue
+		}
+
+		issues = append(issues, found...)
+
+		if mode == ConsistencyModeCorrect {
+			rule.Correct(order)
+		}
+	}
+
+	order.ConsistencyIssues = issues
+
+	// Исправления меняют суммы позиций, итог заказа пересчитывается по исправленным позициям
+	if mode == ConsistencyModeCorrect && len(issues) > 0 && len(order.Items) > 0 {
+		order.TotalAmount = goodsTotalRule{}.expected(order)
+	}
+
+	switch {
+	case len(issues) == 0:
+		order.ConsistencyStatus = models.ConsistencyConsistent
+	case mode == ConsistencyModeCorrect:
+		order.ConsistencyStatus = models.ConsistencyCorrected
+	default:
+		order.ConsistencyStatus = models.ConsistencyInconsistent
+	}
+
+	e.record(order.ConsistencyStatus, issues)
+
+	if len(issues) > 0 {
+		log.Printf("Заказ %s: нарушено бизнес-правил: %d, вердикт: %s", order.OrderUID, len(issues), order.ConsistencyStatus)
+	}
+
+	if len(issues) > 0 && mode == ConsistencyModeReject {
+		return eris.Wrapf(ErrInvalidMessage, "order %s is inconsistent: %s", order.OrderUID, describeIssues(issues))
+	}
+
+	return nil
+}
+
+func (e *OrderRuleEngine) record(verdict string, issues models.ConsistencyIssues) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.evaluated++
+	e.verdicts[verdict]++
+
+	for _, issue := range issues {
+		e.byRule[issue.Rule]++
+	}
+}
+
+// GetStats возвращает счетчики вердиктов и нарушенных правил
+func (e *OrderRuleEngine) GetStats() map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	verdicts := make(map[string]uint64, len(e.verdicts))
+	for verdict, count := range e.verdicts {
+		verdicts[verdict] = count
+	}
+
+	byRule := make(map[string]uint64, len(e.byRule))
+	for rule, count := range e.byRule {
+		byRule[rule] = count
+	}
+
+	names := make([]string, 0, len(e.rules))
+	for _, rule := range e.rules {
+		names = append(names, rule.Name())
+	}
+
+	return map[string]interface{}{
+		"mode":      e.cfg.GetConsistencyMode(),
+		"rules":     names,
+		"evaluated": e.evaluated,
+		"verdicts":  verdicts,
+		"by_rule":   byRule,
+	}
+}
+
+func orderCurrency(order *models.Order) string {
+	if order.Payment == nil {
+		return ""
+	}
+
+	return order.Payment.Currency
+}
+
+func describeIssues(issues models.ConsistencyIssues) string {
+	parts := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		parts = append(parts, fmt.Sprintf("%s (%s: expected %.2f, got %.2f)", issue.Rule, issue.Field, issue.Expected, issue.Actual))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// roundMoney округляет сумму до копеек
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// itemTotalRule total_price позиции равен price * (100 - sale) / 100 * quantity
+type itemTotalRule struct{}
+
+func (itemTotalRule) Name() string {
+	return "item_total_price"
+}
+
+func (itemTotalRule) expected(item models.OrderItem) float64 {
+	quantity := item.Quantity
+	if quantity < 1 {
+		quantity = 1
+	}
+
+	return roundMoney(item.Price * float64(100-item.Sale) / 100 * float64(quantity))
+}
+
+func (r itemTotalRule) Check(order *models.Order, tolerance float64) []models.ConsistencyIssue {
+	var issues []models.ConsistencyIssue
+
+	for i, item := range order.Items {
+		expected := r.expected(item)
+		if math.Abs(expected-item.TotalPrice) > tolerance {
+			issues = append(issues, models.ConsistencyIssue{
+				Rule:     r.Name(),
+				Field:    fmt.Sprintf("items[%d].total_price", i),
+				Expected: expected,
+				Actual:   item.TotalPrice,
+				Message:  "total_price must equal price minus sale multiplied by quantity",
+			})
+		}
+	}
+
+	return issues
+}
+
+func (r itemTotalRule) Correct(order *models.Order) {
+	for i := range order.Items {
+		order.Items[i].TotalPrice = r.expected(order.Items[i])
+	}
+}
+
+// goodsTotalRule goods_total платежа равен сумме total_price позиций
+type goodsTotalRule struct{}
+
+func (goodsTotalRule) Name() string {
+	return "goods_total"
+}
+
+func (goodsTotalRule) expected(order *models.Order) float64 {
+	var total float64
+	for _, item := range order.Items {
+		total += item.TotalPrice
+	}
+
+	return roundMoney(total)
+}
+
+func (r goodsTotalRule) Check(order *models.Order, tolerance float64) []models.ConsistencyIssue {
+	if order.Payment == nil || len(order.Items) == 0 {
+		return nil
+	}
+
+	expected := r.expected(order)
+	if math.Abs(expected-order.Payment.GoodsTotal) <= tolerance {
+		return nil
+	}
+
+	return []models.ConsistencyIssue{{
+		Rule:     r.Name(),
+		Field:    "payment.goods_total",
+		Expected: expected,
+		Actual:   order.Payment.GoodsTotal,
+		Message:  "goods_total must equal the sum of item total prices",
+	}}
+}
+
+func (r goodsTotalRule) Correct(order *models.Order) {
+	if order.Payment == nil || len(order.Items) == 0 {
+		return
+	}
+
+	order.Payment.GoodsTotal = r.expected(order)
+}
+
+// paymentAmountRule amount платежа равен goods_total + delivery_cost + custom_fee
+type paymentAmountRule struct{}
+
+func (paymentAmountRule) Name() string {
+	return "payment_amount"
+}
+
+func (paymentAmountRule) expected(payment *models.Payment) float64 {
+	return roundMoney(payment.GoodsTotal + payment.DeliveryCost + payment.CustomFee)
+}
+
+func (r paymentAmountRule) Check(order *models.Order, tolerance float64) []models.ConsistencyIssue {
+	if order.Payment == nil {
+		return nil
+	}
+
+	expected := r.expected(order.Payment)
+	if math.Abs(expected-order.Payment.Amount) <= tolerance {
+		return nil
+	}
+
+	return []models.ConsistencyIssue{{
+		Rule:     r.Name(),
+		Field:    "payment.amount",
+		Expected: expected,
+		Actual:   order.Payment.Amount,
+		Message:  "amount must equal goods_total + delivery_cost + custom_fee",
+	}}
+}
+
+func (r paymentAmountRule) Correct(order *models.Order) {
+	if order.Payment == nil {
+		return
+	}
+
+	order.Payment.Amount = r.expected(order.Payment)
+}
@@ -0,0 +1,465 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/IBM/sarama"
+	"wb/config"
+	"wb/internal/orm/models"
+)
+
+// HeaderSchemaVersion заголовок, которым producer может указать версию схемы заказа
+const HeaderSchemaVersion = "x-schema-version"
+
+// HeaderValidationErrors заголовок DLQ-сообщения со списком нарушений схемы (JSON)
+const HeaderValidationErrors = "x-validation-errors"
+
+// Схема для упрощенного формата OrderMessage, в котором нет части полей каноничного заказа
+const legacySchemaVersion = "legacy"
+
+// Правила валидации
+const (
+	RuleRequired  = "required"
+	RuleMaxLength = "max_length"
+	RuleMin       = "min"
+	RuleMax       = "max"
+	RuleMinItems  = "min_items"
+	RuleFormat    = "format"
+	RuleSchema    = "schema"
+)
+
+// FieldViolation нарушение правила схемы конкретным полем
+type FieldViolation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError ошибка валидации заказа со списком всех нарушений.
+// Является постоянной ошибкой: сообщение сразу уходит в DLQ.
+type ValidationError struct {
+	SchemaVersion string           `json:"schema_version"`
+	Violations    []FieldViolation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		parts = append(parts, fmt.Sprintf("%s: %s", violation.Field, violation.Rule))
+	}
+
+	return fmt.Sprintf("order does not match schema v%s: %s", e.SchemaVersion, strings.Join(parts, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidMessage
+}
+
+// FieldRule правило схемы для поля. Path задается через точку,
+// "items[]" означает проверку каждого элемента массива
+type FieldRule struct {
+	Path     string
+	Required bool
+	MaxLen   int
+	Min      *float64
+	Max      *float64
+	MinItems int
+	Format   string
+}
+
+// OrderSchema версионированная схема заказа
+type OrderSchema struct {
+	Version string
+	Rules   []FieldRule
+}
+
+// OrderValidator проверяет заказы по схеме до записи в БД и считает нарушения по правилам
+type OrderValidator struct {
+	schemasMu      sync.RWMutex
+	schemas        map[string]*OrderSchema
+	defaultVersion string
+	formats        map[string]*regexp.Regexp
+	arrayIndex     *regexp.Regexp
+
+	mu       sync.Mutex
+	checked  uint64
+	rejected uint64
+	byRule   map[string]uint64
+	byField  map[string]uint64
+}
+
+func NewOrderValidator(cfg *config.Orders) *OrderValidator {
+	validator := &OrderValidator{
+		schemas:        make(map[string]*OrderSchema),
+		defaultVersion: cfg.GetSchemaVersion(),
+		formats: map[string]*regexp.Regexp{
+			"email":    regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`),
+			"phone":    regexp.MustCompile(`^\+?[0-9][0-9\s\-()]{4,19}$`),
+			"zip":      regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z\- ]{2,19}$`),
+			"currency": regexp.MustCompile(`^[A-Z]{3}$`),
+		},
+		arrayIndex: regexp.MustCompile(`\[\d+\]`),
+		byRule:     make(map[string]uint64),
+		byField:    make(map[string]uint64),
+	}
+
+	validator.RegisterSchema(orderSchemaV1())
+	validator.RegisterSchema(orderSchemaLegacy())
+
+	return validator
+}
+
+// RegisterSchema добавляет или заменяет версию схемы
+func (v *OrderValidator) RegisterSchema(schema *OrderSchema) {
+	v.schemasMu.Lock()
+	defer v.schemasMu.Unlock()
+
+	v.schemas[schema.Version] = schema
+}
+
+func (v *OrderValidator) schema(version string) (*OrderSchema, bool) {
+	v.schemasMu.RLock()
+	defer v.schemasMu.RUnlock()
+
+	schema, ok := v.schemas[version]
+
+	return schema, ok
+}
+
+// SchemaVersionFor выбирает версию схемы для сообщения: заголовок x-schema-version,
+// затем схема упрощенного формата, затем версия из конфигурации
+func (v *OrderValidator) SchemaVersionFor(message *sarama.ConsumerMessage) string {
+	if version := headerValue(message.Headers, HeaderSchemaVersion); version != "" {
+		return strings.TrimPrefix(version, "v")
+	}
+
+	if format, err := detectOrderFormat(message.Value); err == nil && format == OrderFormatLegacy {
+		return legacySchemaVersion
+	}
+
+	return v.defaultVersion
+}
+
+// Validate проверяет заказ по схеме указанной версии.
+// Возвращает *ValidationError со всеми найденными нарушениями.
+func (v *OrderValidator) Validate(order *models.Order, version string) error {
+	violations := v.violations(order, version)
+
+	v.record(violations)
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	return &ValidationError{SchemaVersion: version, Violations: violations}
+}
+
+func (v *OrderValidator) violations(order *models.Order, version string) []FieldViolation {
+	schema, ok := v.schema(version)
+	if !ok {
+		return []FieldViolation{{Field: "$", Rule: RuleSchema, Message: fmt.Sprintf("unknown schema version %q", version)}}
+	}
+
+	// Проверяем JSON-представление заказа, чтобы пути полей совпадали с форматом сообщения
+	raw, err := json.Marshal(order)
+	if err != nil {
+		return []FieldViolation{{Field: "$", Rule: RuleSchema, Message: err.Error()}}
+	}
+
+	var document map[string]interface{}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return []FieldViolation{{Field: "$", Rule: RuleSchema, Message: err.Error()}}
+	}
+
+	var violations []FieldViolation
+
+	for _, rule := range schema.Rules {
+		violations = append(violations, v.checkRule(document, rule)...)
+	}
+
+	return violations
+}
+
+func (v *OrderValidator) checkRule(document map[string]interface{}, rule FieldRule) []FieldViolation {
+	var violations []FieldViolation
+
+	for _, field := range resolvePath(document, rule.Path) {
+		violations = append(violations, v.checkValue(field.path, field.value, rule)...)
+	}
+
+	return violations
+}
+
+func (v *OrderValidator) checkValue(path string, value interface{}, rule FieldRule) []FieldViolation {
+	if isEmptyValue(value) {
+		if rule.Required {
+			return []FieldViolation{{Field: path, Rule: RuleRequired, Message: "field is required"}}
+		}
+
+		return nil
+	}
+
+	var violations []FieldViolation
+
+	switch typed := value.(type) {
+	case string:
+		if rule.MaxLen > 0 && utf8.RuneCountInString(typed) > rule.MaxLen {
+			violations = append(violations, FieldViolation{
+				Field: path, Rule: RuleMaxLength, Message: fmt.Sprintf("must be at most %d characters", rule.MaxLen),
+			})
+		}
+
+		if pattern, ok := v.formats[rule.Format]; ok && !pattern.MatchString(typed) {
+			violations = append(violations, FieldViolation{
+				Field: path, Rule: RuleFormat, Message: fmt.Sprintf("must be a valid %s", rule.Format),
+			})
+		}
+	case float64:
+		if rule.Min != nil && typed < *rule.Min {
+			violations = append(violations, FieldViolation{
+				Field: path, Rule: RuleMin, Message: fmt.Sprintf("must be >= %v", *rule.Min),
+			})
+		}
+
+		if rule.Max != nil && typed > *rule.Max {
+			violations = append(violations, FieldViolation{
+				Field: path, Rule: RuleMax, Message: fmt.Sprintf("must be <= %v", *rule.Max),
+			})
+		}
+	case []interface{}:
+		if len(typed) < rule.MinItems {
+			violations = append(violations, FieldViolation{
+				Field: path, Rule: RuleMinItems, Message: fmt.Sprintf("must contain at least %d items", rule.MinItems),
+			})
+		}
+	}
+
+	return violations
+}
+
+func (v *OrderValidator) record(violations []FieldViolation) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.checked++
+	if len(violations) > 0 {
+		v.rejected++
+	}
+
+	for _, violation := range violations {
+		v.byRule[violation.Rule]++
+		// Индексы элементов массивов не учитываем, чтобы не плодить счетчики
+		v.byField[v.arrayIndex.ReplaceAllString(violation.Field, "[]")+":"+violation.Rule]++
+	}
+}
+
+// GetStats возвращает счетчики проверок и нарушений по правилам
+func (v *OrderValidator) GetStats() map[string]interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	byRule := make(map[string]uint64, len(v.byRule))
+	for rule, count := range v.byRule {
+		byRule[rule] = count
+	}
+
+	byField := make(map[string]uint64, len(v.byField))
+	for field, count := range v.byField {
+		byField[field] = count
+	}
+
+	v.schemasMu.RLock()
+	versions := make([]string, 0, len(v.schemas))
+	for version := range v.schemas {
+		versions = append(versions, version)
+	}
+	v.schemasMu.RUnlock()
+
+	sort.Strings(versions)
+
+	return map[string]interface{}{
+		"default_schema": v.defaultVersion,
+		"schemas":        versions,
+		"checked":        v.checked,
+		"rejected":       v.rejected,
+		"by_rule":        byRule,
+		"by_field":       byField,
+	}
+}
+
+type resolvedField struct {
+	path  string
+	value interface{}
+}
+
+// resolvePath находит значения по пути вида "delivery.email" или "items[].price"
+func resolvePath(document map[string]interface{}, path string) []resolvedField {
+	fields := []resolvedField{{path: "", value: document}}
+
+	for _, segment := range strings.Split(path, ".") {
+		each := strings.HasSuffix(segment, "[]")
+		name := strings.TrimSuffix(segment, "[]")
+
+		next := make([]resolvedField, 0, len(fields))
+
+		for _, field := range fields {
+			object, ok := field.value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			fieldPath := joinPath(field.path, name)
+			value := object[name]
+
+			items, isArray := value.([]interface{})
+			if !each || !isArray {
+				next = append(next, resolvedField{path: fieldPath, value: value})
+				continue
+			}
+
+			for i, item := range items {
+				next = append(next, resolvedField{path: fieldPath + "[" + strconv.Itoa(i) + "]", value: item})
+			}
+		}
+
+		fields = next
+	}
+
+	return fields
+}
+
+func joinPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+
+	return parent + "." + name
+}
+
+// isEmptyValue считает пустыми отсутствующие значения, пустые строки и нулевое время
+func isEmptyValue(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return true
+	case string:
+		if strings.TrimSpace(typed) == "" {
+			return true
+		}
+
+		parsed, err := time.Parse(time.RFC3339, typed)
+
+		return err == nil && parsed.IsZero()
+	default:
+		return false
+	}
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
+
+// orderSchemaV1 схема каноничного заказа. Длины строк соответствуют size в gorm-тегах моделей
+func orderSchemaV1() *OrderSchema {
+	return &OrderSchema{
+		Version: "1",
+		Rules: []FieldRule{
+			{Path: "order_uid", Required: true, MaxLen: 100},
+			{Path: "track_number", Required: true, MaxLen: 100},
+			{Path: "entry", Required: true, MaxLen: 50},
+			{Path: "locale", Required: true, MaxLen: 10},
+			{Path: "internal_signature", MaxLen: 255},
+			{Path: "customer_id", Required: true, MaxLen: 100},
+			{Path: "delivery_service", Required: true, MaxLen: 100},
+			{Path: "shardkey", Required: true, MaxLen: 10},
+			{Path: "sm_id", Min: floatPtr(0)},
+			{Path: "date_created", Required: true},
+			{Path: "oof_shard", Required: true, MaxLen: 10},
+
+			{Path: "delivery", Required: true},
+			{Path: "delivery.name", Required: true, MaxLen: 255},
+			{Path: "delivery.phone", Required: true, MaxLen: 20, Format: "phone"},
+			{Path: "delivery.zip", Required: true, MaxLen: 20, Format: "zip"},
+			{Path: "delivery.city", Required: true, MaxLen: 100},
+			{Path: "delivery.address", Required: true, MaxLen: 255},
+			{Path: "delivery.region", Required: true, MaxLen: 100},
+			{Path: "delivery.email", Required: true, MaxLen: 255, Format: "email"},
+
+			{Path: "payment", Required: true},
+			{Path: "payment.transaction", Required: true, MaxLen: 100},
+			{Path: "payment.request_id", MaxLen: 100},
+			{Path: "payment.currency", Required: true, MaxLen: 10, Format: "currency"},
+			{Path: "payment.provider", Required: true, MaxLen: 100},
+			{Path: "payment.amount", Min: floatPtr(0)},
+			{Path: "payment.payment_dt", Required: true},
+			{Path: "payment.bank", Required: true, MaxLen: 100},
+			{Path: "payment.delivery_cost", Min: floatPtr(0)},
+			{Path: "payment.goods_total", Min: floatPtr(0)},
+			{Path: "payment.custom_fee", Min: floatPtr(0)},
+
+			{Path: "items", Required: true, MinItems: 1},
+			{Path: "items[].chrt_id", Min: floatPtr(1)},
+			{Path: "items[].track_number", Required: true, MaxLen: 100},
+			{Path: "items[].price", Min: floatPtr(0)},
+			{Path: "items[].rid", Required: true, MaxLen: 100},
+			{Path: "items[].name", Required: true, MaxLen: 255},
+			{Path: "items[].sale", Min: floatPtr(0), Max: floatPtr(100)},
+			{Path: "items[].size", Required: true, MaxLen: 20},
+			{Path: "items[].quantity", Min: floatPtr(1)},
+			{Path: "items[].total_price", Min: floatPtr(0)},
+			{Path: "items[].nm_id", Min: floatPtr(1)},
+			{Path: "items[].brand", Required: true, MaxLen: 100},
+			{Path: "items[].status", Min: floatPtr(0)},
+		},
+	}
+}
+
+// orderSchemaLegacy схема упрощенного формата: проверяются только поля, которые в нем есть
+func orderSchemaLegacy() *OrderSchema {
+	return &OrderSchema{
+		Version: legacySchemaVersion,
+		Rules: []FieldRule{
+			{Path: "order_uid", Required: true, MaxLen: 100},
+			{Path: "customer_id", MaxLen: 100},
+			{Path: "delivery.name", MaxLen: 255},
+			{Path: "delivery.phone", MaxLen: 20, Format: "phone"},
+			{Path: "delivery.zip", MaxLen: 20, Format: "zip"},
+			{Path: "delivery.city", MaxLen: 100},
+			{Path: "delivery.address", MaxLen: 255},
+			{Path: "delivery.region", MaxLen: 100},
+			{Path: "delivery.email", MaxLen: 255, Format: "email"},
+			{Path: "payment.transaction", MaxLen: 100},
+			{Path: "payment.currency", MaxLen: 10, Format: "currency"},
+			{Path: "payment.amount", Min: floatPtr(0)},
+			{Path: "items[].price", Min: floatPtr(0)},
+			{Path: "items[].sale", Min: floatPtr(0), Max: floatPtr(100)},
+			{Path: "items[].total_price", Min: floatPtr(0)},
+			{Path: "items[].name", MaxLen: 255},
+			{Path: "items[].size", MaxLen: 20},
+			{Path: "items[].brand", MaxLen: 100},
+		},
+	}
+}
+
+// validationHeader сериализует нарушения для заголовка DLQ-сообщения
+func validationHeader(cause error) (sarama.RecordHeader, bool) {
+	var validationErr *ValidationError
+	if !errors.As(cause, &validationErr) {
+		return sarama.RecordHeader{}, false
+	}
+
+	payload, err := json.Marshal(validationErr)
+	if err != nil {
+		return sarama.RecordHeader{}, false
+	}
+
+	return sarama.RecordHeader{Key: []byte(HeaderValidationErrors), Value: payload}, true
+}
@@ -0,0 +1,363 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+	"wb/config"
+	"wb/internal/orm/models"
+	"wb/internal/orm/repositories"
+)
+
+// Заголовки событий outbox
+const (
+	HeaderEventType = "x-event-type"
+	HeaderEventID   = "x-event-id"
+)
+
+// outboxHeadSize сколько первых событий очереди показывает Backlog
+const outboxHeadSize = 10
+
+// outboxStats счетчики relay
+type outboxStats struct {
+	mu        sync.Mutex
+	published uint64
+	failed    uint64
+	passes    uint64
+	lastError string
+	lastAt    time.Time
+}
+
+func (s *outboxStats) recordPass(published int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.passes++
+	s.published += uint64(published)
+
+	if published > 0 {
+		s.lastAt = time.Now()
+	}
+}
+
+func (s *outboxStats) recordFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed++
+	s.lastError = err.Error()
+}
+
+func (s *outboxStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"published":  s.published,
+		"failed":     s.failed,
+		"passes":     s.passes,
+		"last_error": s.lastError,
+	}
+
+	if !s.lastAt.IsZero() {
+		stats["last_published_at"] = s.lastAt
+	}
+
+	return stats
+}
+
+// OutboxRelay публикует события из outbox_events в Kafka в порядке их записи
+type OutboxRelay struct {
+	config *config.Outbox
+	repo   *repositories.OutboxRepository
+	kafka  *KafkaService
+	stats  *outboxStats
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	persistedHooks []func(event *models.OrderEvent) ([]models.OrderEvent, error)
+	routedPublish  func(ctx context.Context, event *models.OrderEvent) error
+}
+
+func NewOutboxRelay(cfg *config.Outbox, repo *repositories.OutboxRepository, kafka *KafkaService) *OutboxRelay {
+	kafka.declareOutputTopics(cfg.GetTopic())
+
+	return &OutboxRelay{
+		config: cfg,
+		repo:   repo,
+		kafka:  kafka,
+		stats:  &outboxStats{},
+	}
+}
+
+// Start запускает периодическую публикацию событий. Повторный вызов ничего не делает.
+func (o *OutboxRelay) Start() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.done != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o.cancel = cancel
+	o.done = make(chan struct{})
+
+	go o.run(ctx, o.done)
+
+	log.Printf("Outbox relay запущен, топик событий: %s", o.config.GetTopic())
+}
+
+// OnOrderPersisted добавляет функцию, которая вызывается после публикации каждого события
+// order.persisted. События, которые она возвращает, записываются в outbox в одной транзакции
+// с отметкой об отправке, поэтому при повторе события они не дублируются.
+func (o *OutboxRelay) OnOrderPersisted(hook func(event *models.OrderEvent) ([]models.OrderEvent, error)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.persistedHooks = append(o.persistedHooks, hook)
+}
+
+// OnOrderRouted задает функцию, которая публикует события order.routed вместо топика событий.
+// Ошибка функции возвращает событие в очередь. ctx несет correlation и trace ID события.
+func (o *OutboxRelay) OnOrderRouted(publish func(ctx context.Context, event *models.OrderEvent) error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.routedPublish = publish
+}
+
+// Stop останавливает relay после текущего прохода
+func (o *OutboxRelay) Stop(ctx context.Context) error {
+	o.mu.Lock()
+	cancel, done := o.cancel, o.done
+	o.cancel, o.done = nil, nil
+	o.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+		log.Println("Outbox relay остановлен")
+		return nil
+	case <-ctx.Done():
+		return eris.Wrap(ctx.Err(), "outbox relay shutdown timed out")
+	}
+}
+
+func (o *OutboxRelay) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(o.config.GetPollInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.relay(ctx)
+		}
+	}
+}
+
+// relay публикует накопившиеся события, пока очередь не опустеет или не случится ошибка.
+// Отмена ctx при остановке прерывает ожидание подтверждения брокера.
+func (o *OutboxRelay) relay(ctx context.Context) {
+	// Без подключения к Kafka попытки не тратятся: события дождутся переподключения
+	if state := o.kafka.State(); state != KafkaStateConsuming && state != KafkaStatePaused {
+		return
+	}
+
+	publish := func(event *models.OutboxEvent) ([]*models.OutboxEvent, error) {
+		return o.publish(ctx, event)
+	}
+
+	for {
+		published, err := o.repo.PublishPending(o.config.GetBatchSize(), o.config.GetLease(), publish, o.config.GetRetryDelay)
+		o.stats.recordPass(published)
+
+		if err != nil {
+			log.Printf("Ошибка публикации событий outbox: %v", err)
+			return
+		}
+
+		if published < o.config.GetBatchSize() {
+			return
+		}
+	}
+}
+
+func (o *OutboxRelay) publish(ctx context.Context, event *models.OutboxEvent) ([]*models.OutboxEvent, error) {
+	eventID := strconv.FormatUint(uint64(event.ID), 10)
+
+	// Событие продолжает цепочку сообщения, которое изменило заказ
+	ctx = WithCorrelationID(ctx, event.CorrelationID)
+	ctx = WithTraceID(ctx, event.TraceID)
+
+	var (
+		followUps []*models.OutboxEvent
+		err       error
+	)
+
+	switch {
+	case event.Topic != "":
+		err = o.sendMessage(ctx, event)
+	case event.EventType == models.OrderEventRouted:
+		err = o.publishRouted(ctx, event)
+	default:
+		if err = o.send(ctx, event, eventID); err == nil {
+			followUps, err = o.orderPersisted(event)
+		}
+	}
+
+	if err != nil {
+		o.stats.recordFailed(err)
+		log.Printf("Событие outbox %s (%s, заказ %s) не опубликовано, попытка %d: %v",
+			eventID, event.EventType, event.AggregateID, event.Attempts+1, err)
+
+		return nil, err
+	}
+
+	return followUps, nil
+}
+
+func (o *OutboxRelay) send(ctx context.Context, event *models.OutboxEvent, eventID string) error {
+	_, err := o.kafka.sendAndWait(ctx, &sarama.ProducerMessage{
+		Topic: o.config.GetTopic(),
+		Key:   sarama.StringEncoder(event.AggregateID),
+		Value: sarama.StringEncoder(event.Payload),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(HeaderEventType), Value: []byte(event.EventType)},
+			{Key: []byte(HeaderEventID), Value: []byte(eventID)},
+		},
+	})
+
+	return err
+}
+
+// sendMessage публикует готовое сообщение события в его топик
+func (o *OutboxRelay) sendMessage(ctx context.Context, event *models.OutboxEvent) error {
+	var headers map[string]string
+	if event.Headers != "" {
+		if err := json.Unmarshal([]byte(event.Headers), &headers); err != nil {
+			return eris.Wrapf(err, "failed to unmarshal headers of %s event %d", event.EventType, event.ID)
+		}
+	}
+
+	message := &sarama.ProducerMessage{
+		Topic:   event.Topic,
+		Value:   sarama.StringEncoder(event.Payload),
+		Headers: recordHeaders(headers),
+	}
+
+	if event.MessageKey != "" {
+		message.Key = sarama.StringEncoder(event.MessageKey)
+	}
+
+	_, err := o.kafka.sendAndWait(ctx, message)
+
+	return err
+}
+
+// publishRouted передает событие order.routed функции OnOrderRouted
+func (o *OutboxRelay) publishRouted(ctx context.Context, event *models.OutboxEvent) error {
+	o.mu.Lock()
+	publish := o.routedPublish
+	o.mu.Unlock()
+
+	if publish == nil {
+		return eris.Errorf("no publisher for %s event %d", event.EventType, event.ID)
+	}
+
+	orderEvent, err := decodeOrderEvent(event)
+	if err != nil {
+		return err
+	}
+
+	return publish(ctx, orderEvent)
+}
+
+// orderPersisted передает опубликованное событие order.persisted функциям OnOrderPersisted
+// и возвращает события, которые они породили
+func (o *OutboxRelay) orderPersisted(event *models.OutboxEvent) ([]*models.OutboxEvent, error) {
+	if event.EventType != models.OrderEventPersisted {
+		return nil, nil
+	}
+
+	o.mu.Lock()
+	hooks := o.persistedHooks
+	o.mu.Unlock()
+
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+
+	orderEvent, err := decodeOrderEvent(event)
+	if err != nil {
+		return nil, err
+	}
+
+	var followUps []*models.OutboxEvent
+
+	for _, hook := range hooks {
+		events, err := hook(orderEvent)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, followUp := range events {
+			followUp.OccurredAt = time.Now()
+
+			row, err := models.NewOrderOutboxEvent(followUp)
+			if err != nil {
+				return nil, err
+			}
+
+			followUps = append(followUps, row)
+		}
+	}
+
+	return followUps, nil
+}
+
+func decodeOrderEvent(event *models.OutboxEvent) (*models.OrderEvent, error) {
+	var orderEvent models.OrderEvent
+	if err := json.Unmarshal([]byte(event.Payload), &orderEvent); err != nil {
+		return nil, eris.Wrapf(err, "failed to unmarshal %s event %d", event.EventType, event.ID)
+	}
+
+	return &orderEvent, nil
+}
+
+// Backlog возвращает очередь неотправленных событий вместе со счетчиками relay
+func (o *OutboxRelay) Backlog() (map[string]interface{}, error) {
+	backlog, err := o.repo.Backlog(outboxHeadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{
+		"topic":   o.config.GetTopic(),
+		"backlog": backlog,
+		"relay":   o.stats.snapshot(),
+	}
+
+	if backlog.OldestPending != nil {
+		result["oldest_pending_age"] = time.Since(*backlog.OldestPending).Round(time.Millisecond).String()
+	}
+
+	return result, nil
+}
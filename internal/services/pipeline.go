@@ -0,0 +1,638 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rotisserie/eris"
+)
+
+// Типы стадий конвейера
+const (
+	StageDecode       = "decode"
+	StageValidate     = "validate"
+	StageFilter       = "filter"
+	StageTransform    = "transform"
+	StageEnrich       = "enrich"
+	StagePersistOrder = "persist_order"
+	StageForward      = "forward"
+	StageDeadLetter   = "dead_letter"
+	StageLog          = "log"
+)
+
+// Условия стадии filter
+const (
+	FilterEq      = "eq"
+	FilterNe      = "ne"
+	FilterIn      = "in"
+	FilterExists  = "exists"
+	FilterMissing = "missing"
+)
+
+// Действия стадии filter для несовпавших сообщений
+const (
+	FilterActionDrop       = "drop"
+	FilterActionDeadLetter = "dead_letter"
+)
+
+// HeaderPipelineSource топик, конвейер которого переслал сообщение
+const HeaderPipelineSource = "x-pipeline-source"
+
+// ErrInvalidPipeline определение конвейера некорректно
+var ErrInvalidPipeline = errors.New("invalid pipeline")
+
+// PipelineDefinition конвейер топика: стадии выполняются по порядку для каждого сообщения
+type PipelineDefinition struct {
+	Topic       string      `json:"topic"`
+	Description string      `json:"description,omitempty"`
+	Stages      []StageSpec `json:"stages"`
+}
+
+// StageSpec параметры стадии. Какие поля используются, зависит от Type;
+// пути к полям JSON задаются через точку (delivery.city).
+type StageSpec struct {
+	Type string `json:"type"`
+
+	// validate: поля, которые должны присутствовать в сообщении
+	Required []string `json:"required,omitempty"`
+
+	// filter: условие по полю и действие для несовпавших сообщений (drop или dead_letter)
+	Path       string      `json:"path,omitempty"`
+	Op         string      `json:"op,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
+	OnMismatch string      `json:"on_mismatch,omitempty"`
+
+	// transform: переименование и удаление полей
+	Rename map[string]string `json:"rename,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+
+	// enrich: значения полей; в строках подставляются ${topic}, ${partition}, ${offset},
+	// ${key}, ${correlation_id}, ${trace_id}, ${received_at} и ${now}
+	Set map[string]interface{} `json:"set,omitempty"`
+
+	// forward: топик назначения и поле с ключом сообщения (по умолчанию исходный ключ)
+	Topic   string `json:"topic,omitempty"`
+	KeyPath string `json:"key_path,omitempty"`
+
+	// dead_letter и filter с on_mismatch=dead_letter: причина в заголовке x-error
+	Reason string `json:"reason,omitempty"`
+}
+
+// needsDocument сообщает, работает ли стадия с разобранным JSON
+func (s StageSpec) needsDocument() bool {
+	switch s.Type {
+	case StageValidate, StageFilter, StageTransform, StageEnrich:
+		return true
+	case StageForward:
+		return s.KeyPath != ""
+	default:
+		return false
+	}
+}
+
+// pipelineMessage сообщение, проходящее по стадиям конвейера
+type pipelineMessage struct {
+	meta     MessageMetadata
+	message  *sarama.ConsumerMessage
+	document interface{}
+}
+
+// body возвращает текущее тело сообщения: измененный документ или исходные байты
+func (m *pipelineMessage) body() ([]byte, error) {
+	if m.document == nil {
+		return m.message.Value, nil
+	}
+
+	body, err := json.Marshal(m.document)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to marshal pipeline document")
+	}
+
+	return body, nil
+}
+
+// pipelineStage стадия, готовая к выполнению. run возвращает false, если сообщение
+// дальше по конвейеру не идет
+type pipelineStage struct {
+	spec StageSpec
+	run  func(ctx context.Context, msg *pipelineMessage) (bool, error)
+}
+
+// pipelineStats счетчики конвейера
+type pipelineStats struct {
+	mu        sync.Mutex
+	received  uint64
+	completed uint64
+	filtered  uint64
+	forwarded uint64
+	persisted uint64
+	failed    uint64
+	lastError string
+	lastAt    time.Time
+}
+
+func (s *pipelineStats) add(counter *uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	*counter++
+	s.lastAt = time.Now()
+}
+
+func (s *pipelineStats) recordFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed++
+	s.lastError = err.Error()
+	s.lastAt = time.Now()
+}
+
+func (s *pipelineStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"received":   s.received,
+		"completed":  s.completed,
+		"filtered":   s.filtered,
+		"forwarded":  s.forwarded,
+		"persisted":  s.persisted,
+		"failed":     s.failed,
+		"last_error": s.lastError,
+	}
+
+	if !s.lastAt.IsZero() {
+		stats["last_at"] = s.lastAt
+	}
+
+	return stats
+}
+
+// compiledPipeline проверенный конвейер, который можно зарегистрировать обработчиком топика
+type compiledPipeline struct {
+	definition PipelineDefinition
+	stages     []pipelineStage
+	stats      *pipelineStats
+}
+
+// handle проводит сообщение по стадиям. Ошибка стадии возвращается consumer'у:
+// временные ошибки повторяются, постоянные отправляют сообщение в DLQ
+func (p *compiledPipeline) handle(ctx context.Context, meta MessageMetadata, message *sarama.ConsumerMessage) error {
+	p.stats.add(&p.stats.received)
+
+	msg := &pipelineMessage{meta: meta, message: message}
+
+	for i, stage := range p.stages {
+		next, err := stage.run(ctx, msg)
+		if err != nil {
+			p.stats.recordFailed(err)
+
+			return eris.Wrapf(err, "pipeline %s, stage %d (%s)", p.definition.Topic, i+1, stage.spec.Type)
+		}
+
+		if !next {
+			return nil
+		}
+	}
+
+	p.stats.add(&p.stats.completed)
+
+	return nil
+}
+
+// compilePipeline проверяет определение конвейера и готовит его стадии.
+// Конвейер с любой ошибкой отклоняется целиком.
+func (k *KafkaService) compilePipeline(definition PipelineDefinition) (*compiledPipeline, error) {
+	definition.Topic = strings.TrimSpace(definition.Topic)
+
+	if err := k.checkPipelineTopic(definition.Topic); err != nil {
+		return nil, err
+	}
+
+	if len(definition.Stages) == 0 {
+		return nil, eris.Wrapf(ErrInvalidPipeline, "pipeline %s has no stages", definition.Topic)
+	}
+
+	pipeline := &compiledPipeline{
+		definition: definition,
+		stages:     make([]pipelineStage, 0, len(definition.Stages)),
+		stats:      &pipelineStats{},
+	}
+
+	decoded := false
+
+	for i, spec := range definition.Stages {
+		if spec.needsDocument() && !decoded {
+			return nil, eris.Wrapf(ErrInvalidPipeline, "stage %d (%s) requires a preceding %s stage",
+				i+1, spec.Type, StageDecode)
+		}
+
+		if spec.Type == StageDeadLetter && i != len(definition.Stages)-1 {
+			return nil, eris.Wrapf(ErrInvalidPipeline, "stage %d (%s) must be the last one", i+1, spec.Type)
+		}
+
+		run, err := k.compileStage(pipeline, spec)
+		if err != nil {
+			return nil, eris.Wrapf(err, "stage %d (%s)", i+1, spec.Type)
+		}
+
+		if spec.Type == StageDecode {
+			decoded = true
+		}
+
+		pipeline.stages = append(pipeline.stages, pipelineStage{spec: spec, run: run})
+	}
+
+	return pipeline, nil
+}
+
+// checkPipelineTopic запрещает конвейеры для основного топика заказов, закрепленных
+// топиков встроенных обработчиков и служебных топиков: их обработка встроена в сервис
+func (k *KafkaService) checkPipelineTopic(topic string) error {
+	switch {
+	case topic == "":
+		return eris.Wrap(ErrInvalidPipeline, "topic is required")
+	case topic == k.config.GetTopic():
+		return eris.Wrapf(ErrInvalidPipeline, "topic %s is handled by the built-in orders handler", topic)
+	case k.topicOwner(topic) != "":
+		return eris.Wrapf(ErrInvalidPipeline, "topic %s is handled by the built-in %s", topic, k.topicOwner(topic))
+	case topic == k.config.GetDeadLetterTopic() || strings.Contains(topic, ".retry."):
+		return eris.Wrapf(ErrInvalidPipeline, "topic %s is a service topic", topic)
+	}
+
+	return nil
+}
+
+func (k *KafkaService) compileStage(
+	pipeline *compiledPipeline,
+	spec StageSpec,
+) (func(ctx context.Context, msg *pipelineMessage) (bool, error), error) {
+	switch spec.Type {
+	case StageDecode:
+		return decodeStage, nil
+	case StageValidate:
+		return validateStage(spec)
+	case StageFilter:
+		return filterStage(pipeline, spec)
+	case StageTransform:
+		return transformStage(spec)
+	case StageEnrich:
+		return enrichStage(spec)
+	case StagePersistOrder:
+		return k.persistOrderStage(pipeline), nil
+	case StageForward:
+		return k.forwardStage(pipeline, spec)
+	case StageDeadLetter:
+		return deadLetterStage(spec), nil
+	case StageLog:
+		return logStage(pipeline), nil
+	default:
+		return nil, eris.Wrapf(ErrInvalidPipeline, "unknown stage type %q", spec.Type)
+	}
+}
+
+func decodeStage(_ context.Context, msg *pipelineMessage) (bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(msg.message.Value))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return false, eris.Wrapf(ErrInvalidMessage, "message is not valid JSON: %v", err)
+	}
+
+	msg.document = document
+
+	return true, nil
+}
+
+func validateStage(spec StageSpec) (func(ctx context.Context, msg *pipelineMessage) (bool, error), error) {
+	if len(spec.Required) == 0 {
+		return nil, eris.Wrap(ErrInvalidPipeline, "required fields are not set")
+	}
+
+	return func(_ context.Context, msg *pipelineMessage) (bool, error) {
+		var missing []string
+
+		for _, path := range spec.Required {
+			if value, ok := jsonField(msg.document, path); !ok || value == nil {
+				missing = append(missing, path)
+			}
+		}
+
+		if len(missing) > 0 {
+			return false, eris.Wrapf(ErrInvalidMessage, "missing required fields: %s", strings.Join(missing, ", "))
+		}
+
+		return true, nil
+	}, nil
+}
+
+func filterStage(
+	pipeline *compiledPipeline,
+	spec StageSpec,
+) (func(ctx context.Context, msg *pipelineMessage) (bool, error), error) {
+	if spec.Path == "" {
+		return nil, eris.Wrap(ErrInvalidPipeline, "path is not set")
+	}
+
+	op := spec.Op
+	if op == "" {
+		op = FilterEq
+	}
+
+	var expected []string
+
+	switch op {
+	case FilterEq, FilterNe:
+		if spec.Value == nil {
+			return nil, eris.Wrapf(ErrInvalidPipeline, "value is required for %s", op)
+		}
+
+		expected = []string{fmt.Sprint(spec.Value)}
+	case FilterIn:
+		values, ok := spec.Value.([]interface{})
+		if !ok || len(values) == 0 {
+			return nil, eris.Wrapf(ErrInvalidPipeline, "value must be a non-empty array for %s", op)
+		}
+
+		for _, value := range values {
+			expected = append(expected, fmt.Sprint(value))
+		}
+	case FilterExists, FilterMissing:
+	default:
+		return nil, eris.Wrapf(ErrInvalidPipeline, "unknown filter op %q", spec.Op)
+	}
+
+	action := spec.OnMismatch
+	if action == "" {
+		action = FilterActionDrop
+	}
+
+	if action != FilterActionDrop && action != FilterActionDeadLetter {
+		return nil, eris.Wrapf(ErrInvalidPipeline, "unknown on_mismatch action %q", spec.OnMismatch)
+	}
+
+	matches := func(value interface{}, found bool) bool {
+		switch op {
+		case FilterExists:
+			return found
+		case FilterMissing:
+			return !found
+		case FilterNe:
+			return !found || fmt.Sprint(value) != expected[0]
+		default:
+			if !found {
+				return false
+			}
+
+			actual := fmt.Sprint(value)
+			for _, candidate := range expected {
+				if actual == candidate {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	return func(_ context.Context, msg *pipelineMessage) (bool, error) {
+		if matches(jsonField(msg.document, spec.Path)) {
+			return true, nil
+		}
+
+		if action == FilterActionDeadLetter {
+			return false, eris.Wrapf(ErrInvalidMessage, "filter %s %s failed: %s", spec.Path, op, spec.Reason)
+		}
+
+		pipeline.stats.add(&pipeline.stats.filtered)
+
+		return false, nil
+	}, nil
+}
+
+func transformStage(spec StageSpec) (func(ctx context.Context, msg *pipelineMessage) (bool, error), error) {
+	if len(spec.Rename) == 0 && len(spec.Remove) == 0 {
+		return nil, eris.Wrap(ErrInvalidPipeline, "rename or remove must be set")
+	}
+
+	return func(_ context.Context, msg *pipelineMessage) (bool, error) {
+		for from, to := range spec.Rename {
+			value, ok := jsonField(msg.document, from)
+			if !ok {
+				continue
+			}
+
+			removeJSONField(msg.document, from)
+
+			if !setJSONField(msg.document, to, value) {
+				return false, eris.Wrapf(ErrInvalidMessage, "cannot set field %s", to)
+			}
+		}
+
+		for _, path := range spec.Remove {
+			removeJSONField(msg.document, path)
+		}
+
+		return true, nil
+	}, nil
+}
+
+func enrichStage(spec StageSpec) (func(ctx context.Context, msg *pipelineMessage) (bool, error), error) {
+	if len(spec.Set) == 0 {
+		return nil, eris.Wrap(ErrInvalidPipeline, "set is not set")
+	}
+
+	return func(_ context.Context, msg *pipelineMessage) (bool, error) {
+		meta := msg.meta
+		replacer := strings.NewReplacer(
+			"${topic}", meta.Topic,
+			"${partition}", strconv.FormatInt(int64(meta.Partition), 10),
+			"${offset}", strconv.FormatInt(meta.Offset, 10),
+			"${key}", meta.Key,
+			"${correlation_id}", meta.CorrelationID,
+			"${trace_id}", meta.TraceID,
+			"${received_at}", meta.ReceivedAt.Format(time.RFC3339Nano),
+			"${now}", time.Now().Format(time.RFC3339Nano),
+		)
+
+		for path, value := range spec.Set {
+			if text, ok := value.(string); ok {
+				value = replacer.Replace(text)
+			}
+
+			if !setJSONField(msg.document, path, value) {
+				return false, eris.Wrapf(ErrInvalidMessage, "cannot set field %s", path)
+			}
+		}
+
+		return true, nil
+	}, nil
+}
+
+// persistOrderStage сохраняет текущее тело сообщения как заказ тем же путем,
+// что и встроенный обработчик топика заказов
+func (k *KafkaService) persistOrderStage(pipeline *compiledPipeline) func(ctx context.Context, msg *pipelineMessage) (bool, error) {
+	return func(ctx context.Context, msg *pipelineMessage) (bool, error) {
+		body, err := msg.body()
+		if err != nil {
+			return false, err
+		}
+
+		message := *msg.message
+		message.Value = body
+
+		order, err := k.prepareOrder(msg.meta, &message)
+		if err != nil {
+			return false, err
+		}
+
+		if _, err := k.cache.SaveOrderFromMessage(order, messageSource(msg.meta)); err != nil {
+			return false, err
+		}
+
+		pipeline.stats.add(&pipeline.stats.persisted)
+
+		return true, nil
+	}
+}
+
+func (k *KafkaService) forwardStage(
+	pipeline *compiledPipeline,
+	spec StageSpec,
+) (func(ctx context.Context, msg *pipelineMessage) (bool, error), error) {
+	if spec.Topic == "" {
+		return nil, eris.Wrap(ErrInvalidPipeline, "topic is not set")
+	}
+
+	if spec.Topic == pipeline.definition.Topic {
+		return nil, eris.Wrapf(ErrInvalidPipeline, "forwarding to the pipeline topic %s would loop", spec.Topic)
+	}
+
+	return func(ctx context.Context, msg *pipelineMessage) (bool, error) {
+		body, err := msg.body()
+		if err != nil {
+			return false, err
+		}
+
+		key := msg.meta.Key
+		if spec.KeyPath != "" {
+			if value, ok := jsonField(msg.document, spec.KeyPath); ok && value != nil {
+				key = fmt.Sprint(value)
+			}
+		}
+
+		headers := []sarama.RecordHeader{
+			{Key: []byte(HeaderPipelineSource), Value: []byte(msg.meta.Topic)},
+		}
+
+		for _, header := range msg.message.Headers {
+			if header != nil && !isForwardingHeader(string(header.Key)) {
+				headers = append(headers, *header)
+			}
+		}
+
+		_, err = k.sendAndWait(ctx, &sarama.ProducerMessage{
+			Topic:   spec.Topic,
+			Key:     sarama.StringEncoder(key),
+			Value:   sarama.ByteEncoder(body),
+			Headers: headers,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		pipeline.stats.add(&pipeline.stats.forwarded)
+
+		return true, nil
+	}, nil
+}
+
+func deadLetterStage(spec StageSpec) func(ctx context.Context, msg *pipelineMessage) (bool, error) {
+	reason := spec.Reason
+	if reason == "" {
+		reason = "routed to dead letter topic by pipeline"
+	}
+
+	// Постоянная ошибка отправляет сообщение в DLQ без повторов
+	return func(context.Context, *pipelineMessage) (bool, error) {
+		return false, eris.Wrap(ErrInvalidMessage, reason)
+	}
+}
+
+func logStage(pipeline *compiledPipeline) func(ctx context.Context, msg *pipelineMessage) (bool, error) {
+	return func(_ context.Context, msg *pipelineMessage) (bool, error) {
+		body, err := msg.body()
+		if err != nil {
+			return false, err
+		}
+
+		log.Printf("Конвейер топика %s [%s]: %s", pipeline.definition.Topic, msg.meta, string(body))
+
+		return true, nil
+	}
+}
+
+// isForwardingHeader сообщает, что заголовок описывает пересылку в DLQ или топик повторов
+// и не должен попасть в сообщение, пересланное конвейером
+func isForwardingHeader(key string) bool {
+	switch key {
+	case HeaderOriginalTopic, HeaderOriginalPartition, HeaderOriginalOffset,
+		HeaderError, HeaderAttemptCount, HeaderFailedAt, HeaderOriginalTimestamp,
+		HeaderRetryTier, HeaderRetryNotBefore, HeaderPipelineSource:
+		return true
+	}
+
+	return false
+}
+
+// setJSONField задает значение по пути через точку, создавая недостающие объекты.
+// Возвращает false, если на пути встретилось не-объектное значение.
+func setJSONField(document interface{}, path string, value interface{}) bool {
+	parts := strings.Split(path, ".")
+
+	current, ok := document.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	for _, part := range parts[:len(parts)-1] {
+		next, exists := current[part]
+		if !exists {
+			next = map[string]interface{}{}
+			current[part] = next
+		}
+
+		if current, ok = next.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+
+	current[parts[len(parts)-1]] = value
+
+	return true
+}
+
+// removeJSONField удаляет поле по пути через точку, если оно есть
+func removeJSONField(document interface{}, path string) {
+	parts := strings.Split(path, ".")
+
+	parent, ok := jsonField(document, strings.Join(parts[:len(parts)-1], "."))
+	if len(parts) == 1 {
+		parent, ok = document, true
+	}
+
+	if object, isObject := parent.(map[string]interface{}); ok && isObject {
+		delete(object, parts[len(parts)-1])
+	}
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"wb/config"
+	"wb/internal/orm/models"
+	"wb/internal/orm/repositories"
+)
+
+// ErrPipelineNotFound конвейер для топика не найден
+var ErrPipelineNotFound = errors.New("pipeline not found")
+
+// PipelineInfo конвейер вместе с его состоянием
+type PipelineInfo struct {
+	PipelineDefinition
+
+	Source    string                 `json:"source"`
+	Version   int64                  `json:"version"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	Active    bool                   `json:"active"`
+	Stats     map[string]interface{} `json:"stats,omitempty"`
+}
+
+// pipelineFile формат файла PIPELINES_FILE
+type pipelineFile struct {
+	Pipelines []PipelineDefinition `json:"pipelines"`
+}
+
+// activePipeline конвейер, зарегистрированный обработчиком топика
+type activePipeline struct {
+	compiled  *compiledPipeline
+	source    string
+	version   int64
+	updatedAt time.Time
+}
+
+// PipelineService управляет конвейерами: хранит их в БД и регистрирует обработчиками топиков.
+// Определение сначала проверяется целиком, затем сохраняется, и только после этого
+// обработчик топика заменяется новым, поэтому сообщения никогда не видят частично примененный конвейер.
+type PipelineService struct {
+	config *config.Pipelines
+	repo   *repositories.PipelineRepository
+	kafka  *KafkaService
+
+	// mu упорядочивает изменения, чтобы БД и зарегистрированные обработчики не расходились
+	mu     sync.Mutex
+	active map[string]*activePipeline
+}
+
+func NewPipelineService(
+	cfg *config.Pipelines,
+	repo *repositories.PipelineRepository,
+	kafka *KafkaService,
+) *PipelineService {
+	return &PipelineService{
+		config: cfg,
+		repo:   repo,
+		kafka:  kafka,
+		active: make(map[string]*activePipeline),
+	}
+}
+
+// Load применяет конвейеры из PIPELINES_FILE и регистрирует все сохраненные в БД.
+// Файл применяется целиком: если хотя бы один конвейер в нем некорректен, из файла
+// не сохраняется ничего. Конвейеры, измененные или удаленные через API, файл не перезаписывает.
+// Некорректные записи БД пропускаются с предупреждением.
+func (p *PipelineService) Load() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fileErr := p.applyFile()
+	if fileErr != nil {
+		log.Printf("Конвейеры из файла %s не применены: %v", p.config.File, fileErr)
+	}
+
+	rows, err := p.repo.List()
+	if err != nil {
+		return err
+	}
+
+	for i := range rows {
+		if err := p.activate(&rows[i]); err != nil {
+			log.Printf("Конвейер топика %s (версия %d) пропущен: %v", rows[i].Topic, rows[i].Version, err)
+		}
+	}
+
+	log.Printf("Загружено конвейеров: %d", len(p.active))
+
+	return fileErr
+}
+
+// Reload повторно применяет PIPELINES_FILE: сохраняются только изменившиеся конвейеры
+func (p *PipelineService) Reload() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.applyFile()
+}
+
+// Apply проверяет, сохраняет и активирует конвейер топика, заменяя прежний
+func (p *PipelineService) Apply(definition PipelineDefinition) (*PipelineInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	compiled, err := p.kafka.compilePipeline(definition)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := newPipelineRow(compiled.definition, models.PipelineSourceAPI)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.repo.Save(row); err != nil {
+		return nil, err
+	}
+
+	p.register(compiled, row)
+
+	return p.info(row.Topic), nil
+}
+
+// Delete удаляет конвейер; consumer перестает читать его топик
+func (p *PipelineService) Delete(topic string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deleted, err := p.repo.Delete(topic)
+	if err != nil {
+		return err
+	}
+
+	_, active := p.active[topic]
+	if !active && !deleted {
+		return eris.Wrapf(ErrPipelineNotFound, "topic: %s", topic)
+	}
+
+	// Снимается только обработчик, который зарегистрировал конвейер: сохраненный,
+	// но не активированный конвейер не затрагивает встроенный обработчик топика
+	if active {
+		delete(p.active, topic)
+
+		if err := p.kafka.UnregisterHandler(topic); err != nil {
+			log.Printf("Обработчик конвейера топика %s не снят: %v", topic, err)
+		}
+	}
+
+	log.Printf("Конвейер топика %s удален", topic)
+
+	return nil
+}
+
+// List возвращает сохраненные конвейеры с их состоянием
+func (p *PipelineService) List() ([]PipelineInfo, error) {
+	rows, err := p.repo.List()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pipelines := make([]PipelineInfo, 0, len(rows))
+
+	for i := range rows {
+		info, err := p.rowInfo(&rows[i])
+		if err != nil {
+			return nil, err
+		}
+
+		pipelines = append(pipelines, *info)
+	}
+
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].Topic < pipelines[j].Topic })
+
+	return pipelines, nil
+}
+
+// Get возвращает конвейер топика
+func (p *PipelineService) Get(topic string) (*PipelineInfo, error) {
+	row, err := p.repo.Get(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rowInfo(row)
+}
+
+// applyFile сохраняет и активирует изменившиеся конвейеры из файла. Вызывается под p.mu.
+func (p *PipelineService) applyFile() error {
+	if p.config.File == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(p.config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Файл конвейеров %s не найден, используются только сохраненные конвейеры", p.config.File)
+		return nil
+	}
+
+	if err != nil {
+		return eris.Wrapf(err, "failed to read pipelines file %s", p.config.File)
+	}
+
+	var file pipelineFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return eris.Wrapf(ErrInvalidPipeline, "failed to parse pipelines file %s: %v", p.config.File, err)
+	}
+
+	compiled := make(map[string]*compiledPipeline, len(file.Pipelines))
+	rows := make([]*models.Pipeline, 0, len(file.Pipelines))
+	seen := make(map[string]bool, len(file.Pipelines))
+
+	for _, definition := range file.Pipelines {
+		pipeline, err := p.kafka.compilePipeline(definition)
+		if err != nil {
+			return eris.Wrapf(err, "pipeline %s", definition.Topic)
+		}
+
+		if seen[pipeline.definition.Topic] {
+			return eris.Wrapf(ErrInvalidPipeline, "duplicate pipeline for topic %s", pipeline.definition.Topic)
+		}
+
+		seen[pipeline.definition.Topic] = true
+
+		row, err := newPipelineRow(pipeline.definition, models.PipelineSourceFile)
+		if err != nil {
+			return err
+		}
+
+		compiled[row.Topic] = pipeline
+		rows = append(rows, row)
+	}
+
+	saved, err := p.repo.SaveFromFile(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range saved {
+		p.register(compiled[row.Topic], row)
+	}
+
+	if len(saved) > 0 {
+		log.Printf("Применено конвейеров из файла %s: %d", p.config.File, len(saved))
+	}
+
+	return nil
+}
+
+// activate регистрирует сохраненный конвейер, если его версия еще не активна. Вызывается под p.mu.
+func (p *PipelineService) activate(row *models.Pipeline) error {
+	if current, ok := p.active[row.Topic]; ok && current.version == row.Version {
+		return nil
+	}
+
+	definition, err := pipelineDefinition(row)
+	if err != nil {
+		return err
+	}
+
+	compiled, err := p.kafka.compilePipeline(definition)
+	if err != nil {
+		return err
+	}
+
+	p.register(compiled, row)
+
+	return nil
+}
+
+// register делает конвейер обработчиком топика. Вызывается под p.mu.
+func (p *PipelineService) register(compiled *compiledPipeline, row *models.Pipeline) {
+	p.active[row.Topic] = &activePipeline{
+		compiled:  compiled,
+		source:    row.Source,
+		version:   row.Version,
+		updatedAt: row.UpdatedAt,
+	}
+
+	p.kafka.RegisterHandler(row.Topic, compiled.handle)
+
+	log.Printf("Конвейер топика %s активирован (версия %d, стадий: %d, источник: %s)",
+		row.Topic, row.Version, len(compiled.stages), row.Source)
+}
+
+// info описывает активный конвейер. Вызывается под p.mu.
+func (p *PipelineService) info(topic string) *PipelineInfo {
+	active := p.active[topic]
+
+	return &PipelineInfo{
+		PipelineDefinition: active.compiled.definition,
+		Source:             active.source,
+		Version:            active.version,
+		UpdatedAt:          active.updatedAt,
+		Active:             true,
+		Stats:              active.compiled.stats.snapshot(),
+	}
+}
+
+// rowInfo описывает сохраненный конвейер; счетчики есть только у активной версии. Вызывается под p.mu.
+func (p *PipelineService) rowInfo(row *models.Pipeline) (*PipelineInfo, error) {
+	if active, ok := p.active[row.Topic]; ok && active.version == row.Version {
+		return p.info(row.Topic), nil
+	}
+
+	definition, err := pipelineDefinition(row)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PipelineInfo{
+		PipelineDefinition: definition,
+		Source:             row.Source,
+		Version:            row.Version,
+		UpdatedAt:          row.UpdatedAt,
+	}, nil
+}
+
+func newPipelineRow(definition PipelineDefinition, source string) (*models.Pipeline, error) {
+	stages, err := json.Marshal(definition.Stages)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to marshal stages of pipeline %s", definition.Topic)
+	}
+
+	return &models.Pipeline{
+		Topic:       definition.Topic,
+		Description: definition.Description,
+		Stages:      string(stages),
+		Source:      source,
+	}, nil
+}
+
+func pipelineDefinition(row *models.Pipeline) (PipelineDefinition, error) {
+	definition := PipelineDefinition{
+		Topic:       row.Topic,
+		Description: row.Description,
+	}
+
+	if err := json.Unmarshal([]byte(row.Stages), &definition.Stages); err != nil {
+		return definition, eris.Wrapf(ErrInvalidPipeline, "failed to parse stages of pipeline %s: %v", row.Topic, err)
+	}
+
+	return definition, nil
+}
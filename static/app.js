@@ -222,6 +222,12 @@ function renderList(list) {
     meta.textContent = `${date} • ${items}`;
 
     left.appendChild(uid);
+    if (isInconsistent(order)) {
+      const badge = document.createElement('span');
+      badge.className = 'badge badge-warning';
+      badge.textContent = consistencyLabel(order.consistency_status);
+      uid.appendChild(badge);
+    }
     left.appendChild(meta);
     row.appendChild(left);
 
@@ -292,8 +298,12 @@ function renderDetail(order, element) {
       <div class="kv"><b>UID заказа</b><span>${escapeHtml(order.order_uid)}</span></div>
       <div class="kv"><b>Трек номер</b><span>${escapeHtml(order.track_number || '')}</span></div>
       <div class="kv"><b>Дата создания</b><span>${escapeHtml(formatDate(order.date_created))}</span></div>
+      <div class="kv"><b>Статус</b><span>${escapeHtml(statusLabel(order.status))}</span></div>
+      <div class="kv"><b>Согласованность</b><span>${escapeHtml(consistencyLabel(order.consistency_status))}</span></div>
     </div>
 
+    ${renderConsistencyIssues(order)}
+
     <div class="card">
       <h3>Информация о доставке</h3>
       <div class="kv"><b>Имя получателя</b><span>${escapeHtml(d.name || '')}</span></div>
@@ -350,6 +360,56 @@ function renderDetail(order, element) {
   }
 }
 
+function isInconsistent(order) {
+  return order.consistency_status === 'inconsistent' || order.consistency_status === 'corrected';
+}
+
+function statusLabel(status) {
+  switch (status) {
+    case 'paid':
+      return 'Оплачен';
+    case 'assembled':
+      return 'Собран';
+    case 'shipped':
+      return 'Отгружен';
+    case 'delivered':
+      return 'Доставлен';
+    case 'cancelled':
+      return 'Отменен';
+    case 'returned':
+      return 'Возвращен';
+    default:
+      return 'Создан';
+  }
+}
+
+function consistencyLabel(status) {
+  switch (status) {
+    case 'inconsistent':
+      return 'Несогласован';
+    case 'corrected':
+      return 'Исправлен';
+    default:
+      return 'Согласован';
+  }
+}
+
+function renderConsistencyIssues(order) {
+  const issues = order.consistency_issues || [];
+  if (!issues.length) return '';
+
+  const rows = issues.map(issue => `
+    <div class="kv"><b>${escapeHtml(issue.field)}</b><span>ожидалось ${escapeHtml(String(issue.expected))}, получено ${escapeHtml(String(issue.actual))}</span></div>
+  `).join('');
+
+  return `
+    <div class="card card-warning">
+      <h3>Нарушения бизнес-правил (${issues.length})</h3>
+      ${rows}
+    </div>
+  `;
+}
+
 function renderDetailList(order) {
   renderDetail(order, orderDetailList);
 }